@@ -0,0 +1,233 @@
+package main
+
+// Attributes of the new files: permissions (-chmod, -respect-umask), ownership and times (-preserve, -times)
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set the attributes preserved by the copies from a -preserve list (as in cp(1), plus 'sparse' for the holes of sparse files)
+func parsePreserve(value string, opts *options) error {
+	opts.preserveMode, opts.preserveTimes, opts.preserveOwner = false, false, false
+	opts.preserveXattrs, opts.preserveLinks, opts.preserveSparse = false, false, false
+	for _, attribute := range strings.Split(value, ",") {
+		switch strings.TrimSpace(attribute) {
+		case "mode":
+			opts.preserveMode = true
+		case "timestamps":
+			opts.preserveTimes = true
+		case "ownership":
+			opts.preserveOwner = true
+		case "xattr":
+			opts.preserveXattrs = true
+		case "links":
+			opts.preserveLinks = true
+		case "sparse":
+			opts.preserveSparse = true
+		case "all":
+			opts.preserveMode, opts.preserveTimes, opts.preserveOwner = true, true, true
+			opts.preserveXattrs, opts.preserveLinks, opts.preserveSparse = true, true, true
+		case "":
+		default:
+			return fmt.Errorf("unknown attribute %q", attribute)
+		}
+	}
+	return nil
+}
+
+// Give a copy the owner and the extended attributes of its target (with -preserve ownership and xattr), before its mode is set,
+// as changing the owner clears the setuid and setgid bits and a copied ACL sets the group bits
+// Without the privileges to change the owner, the copy keeps the user running the conversion
+func copyAttributes(opts *options, source, dest *os.File, symlinkPath string, info os.FileInfo) error {
+	if uid, gid, ok := fileOwner(info); ok && opts.preserveOwner {
+		if err := dest.Chown(uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return fmt.Errorf("error setting file owner: %w", err)
+		}
+	}
+	if !opts.preserveXattrs {
+		return nil
+	}
+
+	names, err := listFileXattrs(source)
+	if err != nil {
+		return nil // No support for xattrs
+	}
+	for _, name := range names {
+		if name == capabilityXattr {
+			continue // Set after the mode, see copyCapabilities
+		}
+		value, err := getFileXattr(source, name)
+		if err != nil {
+			continue
+		}
+		if err := setFileXattr(dest, name, value); err != nil {
+			coloredPrintf(redColor, "Warning: the extended attribute %s of %s could not be preserved (%v)\n", name, symlinkPath, err)
+		}
+	}
+	return nil
+}
+
+// Extended attribute holding the file capabilities of a binary
+const capabilityXattr = "security.capability"
+
+// Copy the file capabilities of the target to its copy (after the data and mode, as writing and chmod clear them)
+// Setting them needs CAP_SETFCAP; if they cannot be preserved, the program may not work, so a warning is printed
+func copyCapabilities(source, dest *os.File, symlinkPath string) {
+	value, err := getFileXattr(source, capabilityXattr)
+	if err != nil {
+		return // No capabilities (or no xattrs at all)
+	}
+	if err := setFileXattr(dest, capabilityXattr, value); err != nil {
+		coloredPrintf(redColor, "Warning: the file capabilities of %s could not be preserved (%v)\n", symlinkPath, err)
+	}
+}
+
+// Mode of the file replacing a symlink: the mode of the target (or, without -preserve mode, its permissions
+// restricted by the umask, as for any new file), restricted by the umask with -respect-umask,
+// changed by -chmod, and without the special bits with -strip-special-bits
+func newFileMode(opts *options, targetMode os.FileMode) os.FileMode {
+	if !opts.preserveMode {
+		targetMode = targetMode.Perm() &^ opts.umask
+	}
+	if opts.respectUmask {
+		targetMode &^= opts.umask
+	}
+	if len(opts.chmod) > 0 {
+		targetMode = applyModeClauses(targetMode, opts.chmod)
+	}
+	if opts.stripSpecial {
+		targetMode &^= os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	}
+	return targetMode
+}
+
+// List the options giving the new files another mode or other times than those of their targets
+func attributeOverrides(opts *options) []string {
+	var overrides []string
+	if len(opts.chmod) > 0 {
+		overrides = append(overrides, "-chmod")
+	}
+	if opts.stripSpecial {
+		overrides = append(overrides, "-strip-special-bits (or -secure)")
+	}
+	if opts.respectUmask {
+		overrides = append(overrides, "-respect-umask")
+	}
+	if !opts.preserveMode {
+		overrides = append(overrides, "-preserve without 'mode'")
+	}
+	if !opts.preserveTimes {
+		overrides = append(overrides, "-preserve without 'timestamps'")
+	}
+	if opts.times != "target" {
+		overrides = append(overrides, "-times "+opts.times)
+	}
+	return overrides
+}
+
+// Change of the mode of the new files given with -chmod, as in chmod(1)
+type modeClause struct {
+	who   uint32 // Bits the clause applies to (e.g. 04700 for 'u', 07777 for 'a' or an octal mode)
+	op    byte   // '+', '-' or '='
+	perm  uint32 // Bits added, removed or set (within who)
+	execX bool   // 'X': execute bits, only if the file is already executable by someone
+}
+
+// Parse a mode given as an octal number (e.g. 0644) or as symbolic clauses (e.g. 'u+rw,go-w')
+func parseModeClauses(spec string) ([]modeClause, error) {
+	if octal, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		if octal > 07777 {
+			return nil, fmt.Errorf("invalid mode %q", spec)
+		}
+		return []modeClause{{who: 07777, op: '=', perm: uint32(octal)}}, nil
+	}
+	whoBits := map[byte]uint32{'u': 04700, 'g': 02070, 'o': 01007, 'a': 07777}
+	permBits := map[byte]uint32{'r': 0444, 'w': 0222, 'x': 0111, 's': 06000, 't': 01000}
+	var clauses []modeClause
+	for _, text := range strings.Split(spec, ",") {
+		var clause modeClause
+		i := 0
+		for ; i < len(text) && whoBits[text[i]] != 0; i++ {
+			clause.who |= whoBits[text[i]]
+		}
+		if clause.who == 0 {
+			clause.who = 07777
+		}
+		if i == len(text) || !strings.ContainsRune("+-=", rune(text[i])) {
+			return nil, fmt.Errorf("invalid mode %q", spec)
+		}
+		clause.op = text[i]
+		for _, letter := range []byte(text[i+1:]) {
+			switch {
+			case letter == 'X':
+				clause.execX = true
+			case permBits[letter] != 0:
+				clause.perm |= permBits[letter]
+			default:
+				return nil, fmt.Errorf("invalid mode %q", spec)
+			}
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, nil
+}
+
+// Unix bits of the setuid, setgid and sticky modes
+var specialModeBits = map[os.FileMode]uint32{os.ModeSetuid: 04000, os.ModeSetgid: 02000, os.ModeSticky: 01000}
+
+// Apply the clauses of -chmod to a file mode
+func applyModeClauses(mode os.FileMode, clauses []modeClause) os.FileMode {
+	bits := uint32(mode.Perm())
+	for flag, bit := range specialModeBits {
+		if mode&flag != 0 {
+			bits |= bit
+		}
+	}
+	for _, clause := range clauses {
+		perm := clause.perm
+		if clause.execX && bits&0111 != 0 {
+			perm |= 0111
+		}
+		switch clause.op {
+		case '+':
+			bits |= perm & clause.who
+		case '-':
+			bits &^= perm & clause.who
+		case '=':
+			bits = bits&^clause.who | perm&clause.who
+		}
+	}
+	result := mode&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | os.FileMode(bits&0777)
+	for flag, bit := range specialModeBits {
+		if bits&bit != 0 {
+			result |= flag
+		}
+	}
+	return result
+}
+
+// Access and modification times of the file replacing a symlink, according to -times:
+// the times of the target (with -preserve timestamps, otherwise the current time), the times of the symlink itself, or the current time
+// The birth time cannot be copied: Linux has no call to set it (statx only reads it), so new files are born at the conversion
+func newFileTimes(opts *options, symlinkPath string, targetInfo os.FileInfo) (atime, mtime time.Time) {
+	switch opts.times {
+	case "link":
+		if info, err := lstatLong(symlinkPath); err == nil {
+			return accessTime(info), info.ModTime()
+		}
+	case "now":
+		now := time.Now()
+		return now, now
+	}
+	if !opts.preserveTimes {
+		now := time.Now()
+		return now, now
+	}
+	return accessTime(targetInfo), targetInfo.ModTime()
+}
@@ -0,0 +1,432 @@
+package main
+
+// Handling of broken symlinks (-broken-symlinks): trash, repair, placeholders and reports
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Move a broken symlink to the trash (-broken-symlinks trash); the trash keeps the symlink, so no backup is needed
+func trashBrokenSymlink(path, resolvedPath string, opts *options, processedSymlinks map[string]bool) error {
+	trashPath, err := trashSymlink(path, opts)
+	if err != nil {
+		return fmt.Errorf("error moving broken symlink %q to trash: %w", path, err)
+	}
+	coloredPrintf(redColor, "Moved broken symlink to trash: "+resetColor+"%s -> %s\n", path, trashPath)
+	processedSymlinks[path] = true
+	recordAction(opts, "trashed", path, resolvedPath, 0)
+	return nil
+}
+
+// Repair a broken symlink with the file found for it (-broken-symlinks repair), by retargeting it or
+// replacing it with a copy of the file (-repair-mode)
+func repairBrokenSymlink(path, repairCandidate string, backup bool, opts *options, processedSymlinks map[string]bool) error {
+	if backup {
+		if _, err := backupSymlink(path, opts, processedSymlinks); err != nil {
+			return fmt.Errorf("failed to backup broken symlink %q: %w", path, err)
+		}
+	}
+	if opts.repairMode == "materialize" {
+		size, err := replaceSymlinkWithFile(path, repairCandidate, nil, opts)
+		if err != nil {
+			return fmt.Errorf("failed to materialize %q from %q: %w", path, repairCandidate, err)
+		}
+		coloredPrintf(greenColor, "Repaired broken symlink with a copy of: "+resetColor+"%s -> %s\n", path, repairCandidate)
+		recordAction(opts, "repaired", path, repairCandidate, size)
+	} else {
+		if err := retargetSymlink(path, repairCandidate, opts); err != nil {
+			return fmt.Errorf("failed to retarget %q to %q: %w", path, repairCandidate, err)
+		}
+		coloredPrintf(greenColor, "Retargeted broken symlink: "+resetColor+"%s -> %s\n", path, repairCandidate)
+		recordAction(opts, "retargeted", path, repairCandidate, 0)
+	}
+	processedSymlinks[path] = true
+	return nil
+}
+
+// Replace a broken symlink with a placeholder file naming its target (-broken-symlinks placeholder)
+func placeholderBrokenSymlink(path, resolvedPath string, backup bool, opts *options, processedSymlinks map[string]bool) error {
+	if backup {
+		if _, err := backupSymlink(path, opts, processedSymlinks); err != nil {
+			return fmt.Errorf("failed to backup broken symlink %q: %w", path, err)
+		}
+	}
+	size, err := replaceWithPlaceholder(path, resolvedPath, opts)
+	if err != nil {
+		return fmt.Errorf("failed to replace broken symlink %q with a placeholder: %w", path, err)
+	}
+	coloredPrintf(redColor, "Replaced broken symlink with placeholder: "+resetColor+"%s\n", path)
+	processedSymlinks[path] = true
+	recordAction(opts, "placeholder", path, resolvedPath, size)
+	return nil
+}
+
+// Remove a symlink: a broken one with -broken-symlinks delete, or any one the decider chose to delete
+func removeSymlink(path, resolvedPath string, broken, backup bool, opts *options, processedSymlinks map[string]bool) error {
+	if backup {
+		// Backup symlink before deleting
+		if _, backupErr := backupSymlink(path, opts, processedSymlinks); backupErr != nil {
+			return fmt.Errorf("failed to backup symlink %q: %w", path, backupErr)
+		}
+	}
+	if removeErr := removeCheckedSymlink(path, opts); removeErr != nil {
+		return fmt.Errorf("error removing symlink %q: %w", path, removeErr)
+	}
+	if broken {
+		coloredPrintf(redColor, "Removed broken symlink: "+resetColor+"%s\n", path)
+	} else {
+		coloredPrintf(redColor, "Removed symlink: "+resetColor+"%s\n", path)
+	}
+	recordAction(opts, "deleted", path, resolvedPath, 0)
+	return nil
+}
+
+// Leave a broken symlink in place, with suggestions of targets and a report if requested
+func keepBrokenSymlink(path, resolvedPath string, opts *options) error {
+	coloredPrintf(redColor, "Keeping broken symlink: "+resetColor+"%s\n", path)
+	var suggestions []string
+	if opts.suggestTargets {
+		suggestions = suggestTargets(path, resolvedPath)
+		if len(suggestions) > 0 {
+			fmt.Fprintf(output, "  Did you mean: %s\n", strings.Join(suggestions, ", "))
+		}
+	}
+	if opts.brokenSymlinks == "report" {
+		if err := reportBrokenSymlink(opts, path, resolvedPath, suggestions); err != nil {
+			return err
+		}
+	}
+	recordAction(opts, "kept", path, resolvedPath, 0)
+	return nil
+}
+
+// Files found under the search roots, by name, and the expected properties of the missing targets
+type repairIndex struct {
+	byName   map[string][]string
+	manifest map[string]manifestEntry // By missing target path
+}
+
+// Expected size and checksum of a missing target
+type manifestEntry struct {
+	size     int64
+	checksum string
+}
+
+// Find the file to repair a broken symlink with: a file with the same name as the missing target under the search roots
+// If the manifest lists the missing target, candidates must match its size (and checksum, if given).
+// Returns an empty path if there is no single matching candidate
+func findRepairCandidate(opts *options, linkDest string) (string, error) {
+	if opts.stats.repairIndex == nil {
+		index, err := buildRepairIndex(opts)
+		if err != nil {
+			return "", err
+		}
+		opts.stats.repairIndex = index
+	}
+	index := opts.stats.repairIndex
+
+	candidates := index.byName[filepath.Base(linkDest)]
+	if expected, ok := index.manifest[linkDest]; ok {
+		var matching []string
+		for _, candidate := range candidates {
+			info, err := os.Stat(candidate)
+			if err != nil || info.Size() != expected.size {
+				continue
+			}
+			if expected.checksum != "" {
+				if checksum, err := fileChecksum(candidate); err != nil || !strings.EqualFold(checksum, expected.checksum) {
+					continue
+				}
+			}
+			matching = append(matching, candidate)
+		}
+		candidates = matching
+	}
+
+	switch len(candidates) {
+	case 0:
+		fmt.Fprintln(output, "No repair candidate found for:", linkDest)
+		return "", nil
+	case 1:
+		return candidates[0], nil
+	default:
+		fmt.Fprintf(output, "Ambiguous repair candidates for %s: %s\n", linkDest, strings.Join(candidates, ", "))
+		return "", nil
+	}
+}
+
+// Index the regular files under the search roots by name and load the manifest
+func buildRepairIndex(opts *options) (*repairIndex, error) {
+	index := &repairIndex{byName: make(map[string][]string), manifest: make(map[string]manifestEntry)}
+	for _, root := range opts.searchRoots {
+		err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error accessing path %q: %w", path, err)
+			}
+			if entry.Type().IsRegular() {
+				index.byName[entry.Name()] = append(index.byName[entry.Name()], path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to index search root %q: %w", root, err)
+		}
+	}
+
+	if opts.repairManifest != "" {
+		data, err := os.ReadFile(opts.repairManifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read repair manifest: %w", err)
+		}
+		for lineNumber, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Split(line, "\t")
+			if len(fields) < 2 || len(fields) > 3 {
+				return nil, fmt.Errorf("repair manifest line %d: expected 'target<TAB>size[<TAB>sha256]'", lineNumber+1)
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("repair manifest line %d: invalid size: %w", lineNumber+1, err)
+			}
+			entry := manifestEntry{size: size}
+			if len(fields) == 3 {
+				entry.checksum = fields[2]
+			}
+			index.manifest[fields[0]] = entry
+		}
+	}
+	return index, nil
+}
+
+// Append a broken symlink to the report file (tab-separated path and dangling target)
+// With -suggest-targets, a third column lists the suggested targets
+func reportBrokenSymlink(opts *options, path, linkDest string, suggestions []string) error {
+	if opts.brokenReport == "" {
+		return fmt.Errorf("broken symlink %q cannot be reported: no -broken-report file given", path)
+	}
+	if opts.stats.reportFile == nil {
+		file, err := os.Create(opts.brokenReport)
+		if err != nil {
+			return fmt.Errorf("failed to create broken symlinks report: %w", err)
+		}
+		opts.stats.reportFile = file
+		header := "# path\ttarget"
+		if opts.suggestTargets {
+			header += "\tsuggestions"
+		}
+		fmt.Fprintf(file, "# Broken symlinks found by symlink2file on %s\n%s\n", opts.stats.started.Format(time.RFC3339), header)
+	}
+	line := escapeTSV(path) + "\t" + escapeTSV(linkDest)
+	if opts.suggestTargets {
+		line += "\t" + escapeTSV(strings.Join(suggestions, ","))
+	}
+	if _, err := fmt.Fprintln(opts.stats.reportFile, line); err != nil {
+		return fmt.Errorf("failed to write broken symlinks report: %w", err)
+	}
+	return nil
+}
+
+// Suggest existing paths the broken symlink was likely meant to point to:
+// siblings of the missing target differing only in case, extension or by a small edit (renamed files),
+// and a file with the same name one directory up
+func suggestTargets(path, linkDest string) []string {
+	missing := linkDest
+	if !filepath.IsAbs(missing) {
+		missing = filepath.Join(filepath.Dir(path), missing)
+	}
+	dir, name := filepath.Dir(missing), filepath.Base(missing)
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+
+	var suggestions []string
+	if entries, err := os.ReadDir(dir); err == nil {
+		var similar []string
+		for _, entry := range entries {
+			if entry.Name() == name {
+				continue
+			}
+			if strings.EqualFold(entry.Name(), name) {
+				suggestions = append(suggestions, filepath.Join(dir, entry.Name()))
+			} else if strings.EqualFold(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), stem) ||
+				editDistance(strings.ToLower(entry.Name()), strings.ToLower(name)) <= max(2, len(name)/5) {
+				similar = append(similar, filepath.Join(dir, entry.Name()))
+			}
+		}
+		suggestions = append(suggestions, similar...)
+	}
+	if upPath := filepath.Join(filepath.Dir(dir), name); filepath.Dir(dir) != dir {
+		if _, err := os.Stat(upPath); err == nil {
+			suggestions = append(suggestions, upPath)
+		}
+	}
+
+	const maxSuggestions = 5
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions
+}
+
+// Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// Replace a broken symlink with a small text file explaining what is missing
+// Returns the size of the placeholder file
+func replaceWithPlaceholder(path, linkDest string, opts *options) (int64, error) {
+	content := fmt.Sprintf("This file replaces a broken symbolic link (created by symlink2file).\nMissing target: %s\nReplaced at: %s\n",
+		linkDest, time.Now().UTC().Format(time.RFC3339))
+
+	parent, _, linkIno, err := openSymlinkDir(opts, path)
+	if err != nil {
+		return 0, err
+	}
+	defer parent.Close()
+	tempFile, tempName, err := parent.createTemp()
+	if err != nil {
+		return 0, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			parent.remove(tempName)
+		}
+	}()
+
+	if _, err := tempFile.WriteString(content); err != nil {
+		tempFile.Close()
+		return 0, fmt.Errorf("error writing placeholder: %w", err)
+	}
+	if err := tempFile.Chmod(0644); err != nil {
+		tempFile.Close()
+		return 0, fmt.Errorf("error setting file mode: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return 0, fmt.Errorf("error closing temporary file: %w", err)
+	}
+
+	// Rename replaces the symlink atomically
+	if err := renameOverSymlink(parent, tempName, path, linkIno); err != nil {
+		if errors.Is(err, errSymlinkChanged) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("error moving placeholder to final location: %w", err)
+	}
+	renamed = true
+	return int64(len(content)), nil
+}
+
+// Move a symlink into the quarantine directory of the run (if set) or into the XDG trash
+// Symlinks are moved by recreating them, so the destination may be on another filesystem.
+// Returns the new location of the symlink
+func trashSymlink(path string, opts *options) (string, error) {
+	linkDest, err := readlinkLong(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink: %w", err)
+	}
+
+	var destination string
+	if opts.quarantineDir != "" {
+		// Keep the layout below the root, in a separate directory for each run
+		relPath, err := filepath.Rel(opts.targetDir, path)
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			relPath = strings.TrimPrefix(path, string(filepath.Separator))
+		}
+		runDir := "run-" + opts.stats.started.Format("20060102-150405")
+		destination = filepath.Join(opts.quarantineDir, runDir, relPath)
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		if err := os.Symlink(linkDest, destination); err != nil {
+			return "", fmt.Errorf("failed to create quarantined symlink: %w", err)
+		}
+	} else {
+		if destination, err = moveToXDGTrash(path, linkDest); err != nil {
+			return "", err
+		}
+	}
+
+	destinationDir, err := openDirHandle(filepath.Dir(destination))
+	if err != nil {
+		return "", err
+	}
+	defer destinationDir.Close()
+	if err := copySymlinkMetadata(path, destinationDir, filepath.Base(destination)); err != nil {
+		return "", err
+	}
+	if err := removeCheckedSymlink(path, opts); err != nil {
+		return "", fmt.Errorf("error removing symlink: %w", err)
+	}
+	return destination, nil
+}
+
+// Create a copy of a symlink in the XDG trash of the user ($XDG_DATA_HOME/Trash),
+// together with the .trashinfo file needed by the file managers to restore it
+func moveToXDGTrash(path, linkDest string) (string, error) {
+	dataDir, err := dataHome()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the trash: %w", err)
+	}
+	trashDir := filepath.Join(dataDir, "Trash")
+	for _, dir := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(trashDir, dir), 0700); err != nil {
+			return "", fmt.Errorf("failed to create trash directory: %w", err)
+		}
+	}
+
+	// Reserve a unique name by creating the info file first
+	name := filepath.Base(path)
+	for i := 1; ; i++ {
+		infoFile, err := os.OpenFile(filepath.Join(trashDir, "info", name+".trashinfo"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			name = fmt.Sprintf("%s.%d", filepath.Base(path), i)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create trash info: %w", err)
+		}
+		escapedPath := (&url.URL{Path: path}).EscapedPath()
+		_, err = fmt.Fprintf(infoFile, "[Trash Info]\nPath=%s\nDeletionDate=%s\n", escapedPath, time.Now().Format("2006-01-02T15:04:05"))
+		if closeErr := infoFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to write trash info: %w", err)
+		}
+		break
+	}
+
+	destination := filepath.Join(trashDir, "files", name)
+	if err := os.Symlink(linkDest, destination); err != nil {
+		os.Remove(filepath.Join(trashDir, "info", name+".trashinfo"))
+		return "", fmt.Errorf("failed to create symlink in trash: %w", err)
+	}
+	return destination, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+// Deduplication of the copies: the copy cache (-copy-cache), the store (-dedup-store) and hard links
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Directory of the copies by checksum: the copy cache or the dedup store (they cannot be used together), or ""
+func checksumStore(opts *options) string {
+	if opts.dedupStore != "" {
+		return opts.dedupStore
+	}
+	return opts.copyCache
+}
+
+// Entry of a file in the copy cache: its SHA-256 checksum, under a subdirectory named after the first two digits
+func cacheEntry(cacheDir, path string) (string, error) {
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, sum[:2], sum), nil
+}
+
+// Replace a symlink with a reflink of a cached copy of its target, with the mode and times of the target
+// Without reflinks, or with -dedup-store, the symlink becomes a hard link to the entry (sharing its mode and times)
+// The entry is checked against its name first, as a hard-linked copy may have been modified since
+func replaceSymlinkFromCache(symlinkPath, targetFilePath, entry string, opts *options) (int64, error) {
+	if _, err := os.Stat(entry); err != nil {
+		return 0, err
+	}
+	if sum, err := fileChecksum(entry); err != nil || sum != filepath.Base(entry) {
+		os.Remove(entry)
+		return 0, fmt.Errorf("cache entry %q does not match its content", entry)
+	}
+	info, err := statLong(targetFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("error getting file info for %q: %w", targetFilePath, err)
+	}
+	source, err := os.Open(entry)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	if opts.dedupStore != "" {
+		return replaceSymlinkWithHardlink(symlinkPath, entry, opts)
+	}
+	parent, name, linkIno, err := openSymlinkDir(opts, symlinkPath)
+	if err != nil {
+		return 0, err
+	}
+	defer parent.Close()
+	tempFile, tempName, err := parent.createTemp()
+	if err != nil {
+		return 0, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			parent.remove(tempName)
+		}
+	}()
+	if err := reflink(tempFile, source); err != nil {
+		tempFile.Close()
+		return replaceSymlinkWithHardlink(symlinkPath, entry, opts)
+	}
+	err = tempFile.Chmod(newFileMode(opts, info.Mode()))
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error setting file mode: %w", err)
+	}
+
+	if err := renameOverSymlink(parent, tempName, symlinkPath, linkIno); err != nil {
+		if errors.Is(err, errSymlinkChanged) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("error moving temporary file to final location: %w", err)
+	}
+	renamed = true
+	atime, mtime := newFileTimes(opts, symlinkPath, info)
+	if err := parent.setTimes(name, atime, mtime); err != nil {
+		return 0, fmt.Errorf("error setting file times: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// Add a converted file to the copy cache, as a reflink (or a hard link without reflinks, or always with linkOnly)
+// The cache is an optimization, so failures are only warnings; files on another filesystem than
+// a dedup store cannot share its storage and are skipped silently (reported once at the start)
+func addToCache(path, entry string, linkOnly bool) {
+	if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+		coloredPrintf(redColor, "Warning: could not add %s to the copy cache: %v\n", path, err)
+		return
+	}
+	if linkOnly {
+		if err := os.Link(path, entry); err != nil && !errors.Is(err, fs.ErrExist) && !errors.Is(err, syscall.EXDEV) {
+			coloredPrintf(redColor, "Warning: could not add %s to the dedup store: %v\n", path, err)
+		}
+		return
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+	tempFile, err := os.CreateTemp(filepath.Dir(entry), ".tmp-*")
+	if err != nil {
+		coloredPrintf(redColor, "Warning: could not add %s to the copy cache: %v\n", path, err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	err = reflink(tempFile, source)
+	tempFile.Close()
+	if err == nil {
+		err = os.Rename(tempFile.Name(), entry)
+	} else {
+		err = os.Link(path, entry)
+	}
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		coloredPrintf(redColor, "Warning: could not add %s to the copy cache: %v\n", path, err)
+	}
+}
+
+// Replace a symlink with a hard link to a file (its target, or an already converted copy of it)
+// Returns the size of the file
+func replaceSymlinkWithHardlink(symlinkPath, copyPath string, opts *options) (int64, error) {
+	info, err := statLong(copyPath)
+	if err != nil {
+		return 0, err
+	}
+	parent, _, linkIno, err := openSymlinkDir(opts, symlinkPath)
+	if err != nil {
+		return 0, err
+	}
+	defer parent.Close()
+	tempName, err := createTempEntry(func(name string) error { return parent.link(copyPath, name) })
+	if err != nil {
+		return 0, err
+	}
+	if err := renameOverSymlink(parent, tempName, symlinkPath, linkIno); err != nil {
+		parent.remove(tempName)
+		return 0, err
+	}
+	return info.Size(), nil
+}
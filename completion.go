@@ -0,0 +1,175 @@
+package main
+
+// Shell completions (completion) and the man page (man), generated from the flag definitions
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Shells with a completion script
+var completionShells = map[string]func(w io.Writer, flags *flag.FlagSet){
+	"bash":       bashCompletion,
+	"zsh":        zshCompletion,
+	"fish":       fishCompletion,
+	"powershell": powershellCompletion,
+}
+
+// Print the completion script of a shell, for the options of the conversions and the subcommands
+func completion(args []string, flags *flag.FlagSet) error {
+	if len(args) != 1 || completionShells[args[0]] == nil {
+		return errors.New("usage: symlink2file completion bash|zsh|fish|powershell")
+	}
+	completionShells[args[0]](os.Stdout, flags)
+	return nil
+}
+
+// Command-line form of a flag (single-letter flags take one dash, the others two)
+func flagName(f *flag.Flag) string {
+	if len(f.Name) == 1 {
+		return "-" + f.Name
+	}
+	return "--" + f.Name
+}
+
+// Check if a flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	value, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && value.IsBoolFlag()
+}
+
+func bashCompletion(w io.Writer, flags *flag.FlagSet) {
+	var names, valued []string
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, flagName(f))
+		if !isBoolFlag(f) {
+			valued = append(valued, flagName(f))
+		}
+	})
+	commands := make([]string, len(subcommands))
+	for i, command := range subcommands {
+		commands[i] = command.name
+	}
+	fmt.Fprintf(w, `# bash completion for symlink2file
+_symlink2file() {
+    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+    case " %s " in
+        *" $prev "*) return ;; # Value of an option: files
+    esac
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur") $(compgen -d -- "$cur"))
+    else
+        COMPREPLY=($(compgen -d -- "$cur"))
+    fi
+}
+complete -o default -o filenames -F _symlink2file symlink2file
+`, strings.Join(valued, " "), strings.Join(names, " "), strings.Join(commands, " "))
+}
+
+func zshCompletion(w io.Writer, flags *flag.FlagSet) {
+	escape := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	fmt.Fprint(w, "#compdef symlink2file\n\n_symlink2file() {\n    local state\n    _arguments \\\n")
+	flags.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		if isBoolFlag(f) {
+			fmt.Fprintf(w, "        '%s[%s]' \\\n", flagName(f), escape.Replace(usage))
+		} else {
+			fmt.Fprintf(w, "        '%s=[%s]:value:_files' \\\n", flagName(f), escape.Replace(usage))
+		}
+	})
+	fmt.Fprint(w, "        '1: :->first' \\\n        '*:directory:_files -/'\n")
+	fmt.Fprint(w, "    if [[ $state == first ]]; then\n        local -a subcommands=(\n")
+	for _, command := range subcommands {
+		fmt.Fprintf(w, "            '%s:%s'\n", command.name, escape.Replace(command.description))
+	}
+	fmt.Fprint(w, "        )\n        _describe subcommand subcommands\n        _files -/\n    fi\n}\n\n_symlink2file \"$@\"\n")
+}
+
+func fishCompletion(w io.Writer, flags *flag.FlagSet) {
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	fmt.Fprintln(w, "# fish completion for symlink2file")
+	for _, command := range subcommands {
+		fmt.Fprintf(w, "complete -c symlink2file -n __fish_use_subcommand -f -a %s -d '%s'\n", command.name, escape.Replace(command.description))
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		option := "-l " + f.Name
+		if len(f.Name) == 1 {
+			option = "-s " + f.Name
+		}
+		if !isBoolFlag(f) {
+			option += " -r"
+		}
+		fmt.Fprintf(w, "complete -c symlink2file %s -d '%s'\n", option, escape.Replace(usage))
+	})
+}
+
+func powershellCompletion(w io.Writer, flags *flag.FlagSet) {
+	escape := strings.NewReplacer(`'`, `''`)
+	fmt.Fprint(w, "# PowerShell completion for symlink2file\nRegister-ArgumentCompleter -Native -CommandName symlink2file -ScriptBlock {\n")
+	fmt.Fprint(w, "    param($wordToComplete, $commandAst, $cursorPosition)\n    $candidates = @(\n")
+	for _, command := range subcommands {
+		fmt.Fprintf(w, "        @('%s', 'Command', '%s')\n", command.name, escape.Replace(command.description))
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, "        @('%s', 'ParameterName', '%s')\n", flagName(f), escape.Replace(usage))
+	})
+	fmt.Fprint(w, `    )
+    $candidates | Where-Object { $_[0] -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_[0], $_[0], $_[1], $_[2])
+    }
+}
+`)
+}
+
+// Print the man page of symlink2file (section 1), or write it as symlink2file.1 in a directory
+func manPage(args []string, flags *flag.FlagSet) error {
+	manFlags := flag.NewFlagSet("man", flag.ExitOnError)
+	dir := manFlags.String("dir", "", "Directory to write symlink2file.1 into (default: print the page)")
+	manFlags.Parse(args)
+	if manFlags.NArg() > 0 {
+		return errors.New("usage: symlink2file man [--dir <directory>]")
+	}
+	// Backslashes and dashes are escaped, and lines starting with a control character are protected
+	escape := strings.NewReplacer(`\`, `\e`, "-", `\-`, "\n", "\n\\&")
+	var page strings.Builder
+	fmt.Fprintf(&page, ".TH SYMLINK2FILE 1 \"\" \"symlink2file %s\" \"User Commands\"\n", version)
+	page.WriteString(".SH NAME\nsymlink2file \\- converts symbolic links to regular files\n")
+	page.WriteString(".SH SYNOPSIS\n.B symlink2file\n[\\fIoptions\\fR] [\\fIdirectory\\fR ...]\n.br\n.B symlink2file\n\\fIcommand\\fR [\\fIarguments\\fR]\n")
+	page.WriteString(".SH DESCRIPTION\nReplaces the symbolic links found in the directories (the current directory if none is given) " +
+		"with copies of the files they point to. The replaced symlinks are kept as backups unless \\fB\\-\\-no\\-backup\\fR is given.\n")
+	page.WriteString(".SH OPTIONS\n")
+	flags.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		page.WriteString(".TP\n.B " + escape.Replace(flagName(f)))
+		if !isBoolFlag(f) {
+			page.WriteString(" \\fI" + escape.Replace(name) + "\\fR")
+		}
+		page.WriteString("\n" + escape.Replace(usage))
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "[]" {
+			page.WriteString(" (default: " + escape.Replace(f.DefValue) + ")")
+		}
+		page.WriteString("\n")
+	})
+	page.WriteString(".SH COMMANDS\n")
+	for _, command := range subcommands {
+		page.WriteString(".TP\n.B " + escape.Replace(command.name) + "\n" + escape.Replace(command.description) + "\n")
+	}
+	page.WriteString(".SH ENVIRONMENT\nEvery option can also be set with a \\fBSYMLINK2FILE_*\\fR variable " +
+		"(e.g. \\fBSYMLINK2FILE_NO_BACKUP=true\\fR); options given on the command line take precedence.\n")
+	page.WriteString(".SH SEE ALSO\nhttps://github.com/vmikk/symlink2file\n")
+
+	if *dir == "" {
+		_, err := fmt.Print(page.String())
+		return err
+	}
+	return os.WriteFile(filepath.Join(*dir, "symlink2file.1"), []byte(page.String()), 0644)
+}
@@ -0,0 +1,745 @@
+package main
+
+// Conversion of a single symlink: resolution, copy budget, free space, backups and verification
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Verify that each converted path is now a regular file with the size and checksum recorded during the copy
+// Prints a pass/fail line per file and returns the number of failures
+func verifyConversions(conversions []conversion) int {
+	coloredPrintf(headerColor, "Verifying %d converted files\n", len(conversions))
+	failed := 0
+	for _, c := range conversions {
+		problem := ""
+		// Opened without following a symlink put back in place (also below PATH_MAX)
+		file, err := openLongPath(c.path, os.O_RDONLY|oNofollow)
+		var info os.FileInfo
+		if err == nil {
+			info, err = file.Stat()
+			file.Close()
+		}
+		switch {
+		case err != nil:
+			problem = err.Error()
+		case !info.Mode().IsRegular():
+			problem = "not a regular file"
+		case info.Size() != c.size:
+			problem = fmt.Sprintf("size %d differs from the recorded %d", info.Size(), c.size)
+		default:
+			checksum, err := fileChecksum(c.path)
+			if err != nil {
+				problem = err.Error()
+			} else if checksum != c.checksum {
+				problem = "checksum differs from the target"
+			}
+		}
+
+		if problem != "" {
+			failed++
+			coloredPrintf(redColor, "FAIL "+resetColor+"%s: %s\n", c.path, problem)
+		} else {
+			coloredPrintf(greenColor, "OK   "+resetColor+"%s\n", c.path)
+		}
+	}
+
+	if failed > 0 {
+		coloredPrintf(redColor, "Verification failed: %d of %d files\n", failed, len(conversions))
+	} else {
+		coloredPrintf(greenColor, "Verification passed: %d files\n", len(conversions))
+	}
+	return failed
+}
+
+// Compute the SHA-256 checksum of a file
+func fileChecksum(path string) (string, error) {
+	file, err := openLongPath(path, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// With -resolve once, replace a symlink pointing to another symlink with a copy of that (intermediate) symlink,
+// so that the links further down the chain, possibly managed by another tool, are left to be followed
+func copyIntermediateLink(path, intermediate string, opts *options, processedSymlinks map[string]bool) error {
+	linkDest, err := readlinkLong(intermediate)
+	if err != nil {
+		return fmt.Errorf("failed to read symlink %q: %w", intermediate, err)
+	}
+	// Relative destinations are rebased onto the directory of the replaced symlink
+	if !filepath.IsAbs(linkDest) {
+		absDest := filepath.Join(filepath.Dir(intermediate), linkDest)
+		if linkDest, err = filepath.Rel(filepath.Dir(path), absDest); err != nil {
+			linkDest = absDest
+		}
+	}
+
+	if opts.interactive && !opts.prompt.answerAll {
+		ok, err := confirm(opts, path, fmt.Sprintf("Replace symlink %s with a copy of symlink %s (-> %s)?", path, intermediate, linkDest))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(output, "Skipping symlink:", displayPath(path))
+			recordAction(opts, "skipped", path, intermediate, 0)
+			return nil
+		}
+	}
+	if !opts.noBackup {
+		if _, err := backupSymlink(path, opts, processedSymlinks); err != nil {
+			return fmt.Errorf("failed to backup symlink %q: %w", path, err)
+		}
+	}
+	if err := retargetSymlink(path, linkDest, opts); err != nil {
+		return fmt.Errorf("failed to copy symlink %q to %q: %w", intermediate, path, err)
+	}
+	coloredPrintf(greenColor, "Replaced symlink with a copy of symlink: "+resetColor+"%s -> %s (from %s)\n", path, linkDest, intermediate)
+	processedSymlinks[path] = true
+	recordAction(opts, "copied-link", path, intermediate, 0)
+	return nil
+}
+
+// Handle a symlink that leads to a loop, according to the -loops policy
+func processLoop(path string, hops []string, opts *options, processedSymlinks map[string]bool) error {
+	opts.stats.loops++
+	cycle := path + " -> " + strings.Join(hops, " -> ")
+	coloredPrintf(redColor, "Symlink loop: "+resetColor+"%s\n", cycle)
+	linkDest, _ := readlinkLong(path)
+
+	if opts.loops == "delete" {
+		if opts.interactive && !opts.prompt.answerAll {
+			ok, err := confirm(opts, path, fmt.Sprintf("Remove symlink loop %s?", path))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Fprintln(output, "Skipping symlink:", displayPath(path))
+				recordAction(opts, "skipped", path, linkDest, 0)
+				return nil
+			}
+		}
+		if opts.backupBroken == "yes" {
+			if _, err := backupSymlink(path, opts, processedSymlinks); err != nil {
+				return fmt.Errorf("failed to backup symlink %q: %w", path, err)
+			}
+		}
+		if err := removeCheckedSymlink(path, opts); err != nil {
+			return fmt.Errorf("error removing symlink %q: %w", path, err)
+		}
+		coloredPrintf(redColor, "Removed symlink loop: "+resetColor+"%s\n", path)
+		processedSymlinks[path] = true
+		recordAction(opts, "deleted", path, linkDest, 0)
+		return nil
+	}
+
+	if opts.loops == "report" {
+		if err := reportBrokenSymlink(opts, path, strings.Join(hops, " -> "), nil); err != nil {
+			return err
+		}
+	}
+	recordAction(opts, "kept", path, linkDest, 0)
+	return nil
+}
+
+// Directory of a symlink with its own symlinks resolved, from which the kernel follows a relative destination
+// (joined lexically, ".." would go back up the symlinked directory instead); the directory as it is if unresolvable
+func linkDir(path string) string {
+	dir := filepath.Dir(path)
+	if resolved, err := evalSymlinksLong(dir); err == nil {
+		return resolved
+	}
+	return dir
+}
+
+// Error returned by linkChain for chains longer than the maximum depth
+var errLinkDepth = errors.New("symlink chain too long")
+
+// Follow a symlink hop by hop, returning every path it leads to (the last one being the final, possibly missing, target)
+// Fails with errLinkDepth if more than maxDepth symlinks must be followed, and with syscall.ELOOP if the chain loops
+func linkChain(path string, maxDepth int) ([]string, error) {
+	var hops []string
+	seen := map[string]bool{path: true}
+	current := path
+	for {
+		dest, err := readlinkLong(current)
+		if err != nil {
+			return hops, err
+		}
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(linkDir(current), dest)
+		}
+		hops = append(hops, dest)
+
+		info, err := lstatLong(dest)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return hops, nil
+		}
+		if seen[dest] {
+			return hops, syscall.ELOOP
+		}
+		if len(hops) >= maxDepth {
+			return hops, errLinkDepth
+		}
+		seen[dest] = true
+		current = dest
+	}
+}
+
+// How often the free space is checked again while waiting with -low-space pause
+const lowSpaceRecheck = 30 * time.Second
+
+// Check that copying the target of a symlink keeps the free space of its filesystem above -min-free-space
+// With -low-space pause, waits until enough space is available; with -low-space abort, stops the copies
+func enoughFreeSpace(opts *options, path, resolvedPath string) bool {
+	if opts.minFreeSpace == 0 {
+		return true
+	}
+	var size int64
+	if info, err := statLong(resolvedPath); err == nil {
+		size = info.Size()
+	}
+	for waiting := false; ; waiting = true {
+		stat, err := statFS(filepath.Dir(path))
+		if err != nil {
+			return true // Unknown free space, the copy itself will report the errors
+		}
+		// The copies in progress are counted in full (what they already wrote twice, erring on the safe side)
+		opts.stats.mu.Lock()
+		free := stat.available - opts.stats.reserved
+		opts.stats.mu.Unlock()
+		if free-size >= opts.minFreeSpace {
+			if waiting {
+				fmt.Fprintln(output, "Enough free space again, resuming")
+			}
+			return true
+		}
+		if opts.lowSpace == "abort" {
+			coloredPrintf(redColor, "Free space below %s (%s left) before copying %s; no more symlinks will be converted\n",
+				formatBytes(opts.minFreeSpace), formatBytes(free), path)
+			opts.stats.outOfSpace = true
+			return false
+		}
+		if !waiting {
+			coloredPrintf(redColor, "Free space below %s (%s left), waiting before copying %s\n",
+				formatBytes(opts.minFreeSpace), formatBytes(free), path)
+		}
+		// The other workers finish their copies meanwhile, releasing the space they reserved
+		relock := releaseWork(opts)
+		time.Sleep(lowSpaceRecheck)
+		relock()
+	}
+}
+
+// Record a symlink left unconverted for lack of space, with the space its copy needs
+func deferForSpace(opts *options, path, resolvedPath string) {
+	var size int64
+	if info, err := statLong(resolvedPath); err == nil {
+		size = info.Size()
+	}
+	opts.stats.mu.Lock()
+	opts.stats.spaceNeeded += size
+	opts.stats.spacePending++
+	opts.stats.mu.Unlock()
+	recordAction(opts, "skipped", path, resolvedPath, 0)
+}
+
+// Name for the backup of a symlink named name in the open backup directory backupDir: name, or name~N if that is taken
+// (by an earlier backup, or on case-insensitive filesystems by a backup of a name differing only in case, which
+// is looked up to be reported)
+func freeBackupName(backups *dirHandle, backupDir, name string, caseInsensitive bool) string {
+	if _, _, err := backups.lstat(name); err != nil {
+		return name
+	}
+	existing := name
+	if caseInsensitive {
+		entries, _ := backups.readDir()
+		for _, entry := range entries {
+			if entry.Name() != name && strings.EqualFold(entry.Name(), name) {
+				existing = entry.Name() // Collision by case
+			}
+		}
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s~%d", name, n)
+		if _, _, err := backups.lstat(candidate); err != nil {
+			coloredPrintf(redColor, "Warning: backup name collision with %s; the backup is saved as %s\n",
+				filepath.Join(backupDir, existing), filepath.Join(backupDir, candidate))
+			return candidate
+		}
+	}
+}
+
+// Create a backup of the symlink, and return its path
+// This function also marks the symlink as processed in the processedSymlinks map.
+func backupSymlink(path string, opts *options, processedSymlinks map[string]bool) (string, error) {
+	parent, name, _, err := openSymlinkDir(opts, path)
+	if err != nil {
+		return "", err
+	}
+	defer parent.Close()
+
+	// Create a .symlink2file directory in the same directory as the symlink
+	backupDir := filepath.Join(filepath.Dir(path), ".symlink2file")
+	if err := parent.mkdir(".symlink2file", 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	backups, err := parent.openDir(".symlink2file")
+	if err != nil {
+		return "", fmt.Errorf("failed to open backup directory: %w", err)
+	}
+	defer backups.Close()
+
+	linkDest, err := parent.readlink(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink: %w", err)
+	}
+	backupName := freeBackupName(backups, backupDir, name, directoryCapabilities(opts, filepath.Dir(path)).caseInsensitive)
+	if err := backups.symlink(linkDest, backupName); err != nil {
+		return "", fmt.Errorf("failed to create backup symlink: %w", err)
+	}
+	backupPath := filepath.Join(backupDir, backupName)
+	if err := copySymlinkMetadata(path, backups, backupName); err != nil {
+		return "", fmt.Errorf("failed to preserve symlink metadata: %w", err)
+	}
+	processedSymlinks[path] = true // Mark the symlink as processed
+	return backupPath, nil
+}
+
+// Copy the ownership and timestamps of a symlink onto another symlink, in an open directory (without following either of them),
+// so that a backup can later be moved back in place exactly as it was.
+// Changing the owner requires privileges, therefore a permission error is silently ignored.
+func copySymlinkMetadata(srcPath string, dir *dirHandle, dstName string) error {
+	info, err := lstatLong(srcPath)
+	if err != nil {
+		return fmt.Errorf("error getting symlink info for %q: %w", srcPath, err)
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return nil
+	}
+
+	if err := dir.lchown(dstName, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("error setting symlink owner: %w", err)
+	}
+
+	if err := dir.setTimes(dstName, accessTime(info), info.ModTime()); err != nil {
+		return fmt.Errorf("error setting symlink times: %w", err)
+	}
+	return nil
+}
+
+// Processes a given path within the filesystem
+// If the path is a symlink, it evaluates the symlink, potentially backs it up (based on user flags),
+// and replaces it with a copy of the target file.
+// For broken symlinks, it either deletes them or keeps them based on the provided option.
+// It also handles the logic to avoid re-processing of already processed symlinks
+func processPath(path string, opts *options, processedSymlinks map[string]bool) (err error) {
+	// Check if the symlink has already been processed
+	if processedSymlinks[path] {
+		fmt.Fprintln(output, "Symlink already processed, skipping:", displayPath(path))
+		return nil
+	}
+
+	opts.stats.mu.Lock()
+	opts.stats.current = path
+	opts.stats.mu.Unlock()
+
+	if opts.action != "convert" {
+		return rewriteSymlink(path, opts, processedSymlinks)
+	}
+	// The symlink is only replaced if it is still the one checked here (not swapped by the decider or another process);
+	// a changed symlink is left alone, and the run goes on
+	if info, lstatErr := lstatLong(path); lstatErr == nil {
+		_, ino, _ := fileID(info)
+		opts.stats.linkInodes[path] = ino
+		defer func() {
+			delete(opts.stats.linkInodes, path)
+			if errors.Is(err, errSymlinkChanged) {
+				coloredPrintf(redColor, "Warning: symlink changed since it was checked, left alone: "+resetColor+"%s\n", path)
+				recordAction(opts, "skipped", path, "", 0)
+				err = nil
+			}
+		}()
+	}
+
+	// Follow the symlink hop by hop, to report chains and limit their length
+	hops, chainErr := linkChain(path, opts.maxLinkDepth)
+	if opts.resolve == "once" && len(hops) > 1 && !errors.Is(chainErr, syscall.ELOOP) {
+		return copyIntermediateLink(path, hops[0], opts, processedSymlinks)
+	}
+	switch {
+	case errors.Is(chainErr, errLinkDepth):
+		coloredPrintf(redColor, "Symlink chain longer than %d links, skipping: "+resetColor+"%s\n", opts.maxLinkDepth, path)
+		recordAction(opts, "skipped", path, hops[len(hops)-1], 0)
+		return nil
+	case errors.Is(chainErr, syscall.ELOOP):
+		return processLoop(path, hops, opts, processedSymlinks)
+	case len(hops) > 1:
+		opts.stats.chains++
+		if opts.verbose {
+			fmt.Fprintf(output, "Symlink chain: %s -> %s\n", displayPath(path), strings.Join(hops, " -> "))
+		}
+	}
+
+	resolvedPath, broken := resolveSymlink(path, opts)
+	remove := broken && opts.brokenSymlinks == "delete"
+	trash := broken && opts.brokenSymlinks == "trash"
+	placeholder := broken && opts.brokenSymlinks == "placeholder"
+	if !broken {
+		if reason := leaveAlone(path, resolvedPath, opts); reason != "" {
+			fmt.Fprintf(output, "Symlink left alone (%s): %s\n", reason, displayPath(path))
+			recordAction(opts, "skipped", path, resolvedPath, 0)
+			return nil
+		}
+	}
+	// Broken symlinks have their own backup policy, as they cannot be recreated from their target
+	backup := !opts.noBackup
+	if broken {
+		backup = opts.backupBroken == "yes"
+	}
+	// Backups are symlinks, which some filesystems (e.g. FUSE mounts of object stores) cannot create
+	if backup && !directoryCapabilities(opts, filepath.Dir(path)).symlinks {
+		backup = false
+	}
+	// FIFOs, devices and sockets cannot be copied (reading them blocks, never ends or fails)
+	if !broken {
+		if targetInfo, err := statLong(resolvedPath); err == nil && targetInfo.Mode()&(os.ModeNamedPipe|os.ModeDevice|os.ModeSocket) != 0 {
+			return processSpecialFile(path, resolvedPath, targetInfo, backup, opts, processedSymlinks)
+		}
+	}
+	var repairCandidate string
+	if broken && opts.brokenSymlinks == "repair" {
+		var err error
+		if repairCandidate, err = findRepairCandidate(opts, resolvedPath); err != nil {
+			return err
+		}
+	}
+
+	// Let the external decider choose what to do with the symlink
+	if opts.decider != "" {
+		decision, deciderErr := runDecider(opts.decider, path, resolvedPath, broken)
+		if deciderErr != nil {
+			return fmt.Errorf("decider failed for %q: %w", path, deciderErr)
+		}
+		switch decision {
+		case "skip":
+			fmt.Fprintln(output, "Skipping symlink (decider):", displayPath(path))
+			recordAction(opts, "skipped", path, resolvedPath, 0)
+			return nil
+		case "delete":
+			remove, trash, placeholder, repairCandidate = true, false, false, ""
+		}
+	}
+
+	// Symlinks in read-only or immutable directories cannot be replaced or removed; they are listed at the end
+	// (kept broken symlinks are reported as such, and other failures to write, e.g. permissions, are errors)
+	modify := remove || trash || placeholder || repairCandidate != "" || !broken
+	if modify && readOnlyDirectory(filepath.Dir(path)) {
+		skipReadOnly(opts, path, resolvedPath)
+		return nil
+	}
+
+	// Ask for confirmation before touching the symlink
+	if opts.interactive && !opts.prompt.answerAll && modify {
+		question := fmt.Sprintf("Replace symlink %s with %s?", path, resolvedPath)
+		if remove {
+			question = fmt.Sprintf("Remove symlink %s?", path)
+		} else if trash {
+			question = fmt.Sprintf("Move broken symlink %s to trash?", path)
+		} else if placeholder {
+			question = fmt.Sprintf("Replace broken symlink %s with a placeholder file?", path)
+		} else if repairCandidate != "" {
+			question = fmt.Sprintf("Repair broken symlink %s using %s?", path, repairCandidate)
+		}
+		ok, confirmErr := confirm(opts, path, question)
+		if confirmErr != nil {
+			return confirmErr
+		}
+		if !ok {
+			fmt.Fprintln(output, "Skipping symlink:", displayPath(path))
+			recordAction(opts, "skipped", path, resolvedPath, 0)
+			return nil
+		}
+	}
+
+	switch {
+	case trash:
+		return trashBrokenSymlink(path, resolvedPath, opts, processedSymlinks)
+	case repairCandidate != "":
+		return repairBrokenSymlink(path, repairCandidate, backup, opts, processedSymlinks)
+	case placeholder:
+		return placeholderBrokenSymlink(path, resolvedPath, backup, opts, processedSymlinks)
+	case remove:
+		return removeSymlink(path, resolvedPath, broken, backup, opts, processedSymlinks)
+	case broken:
+		return keepBrokenSymlink(path, resolvedPath, opts)
+	}
+
+	// Once out of quota or space, no more copies are attempted; only the space they need is counted
+	if opts.stats.outOfSpace || !enoughFreeSpace(opts, path, resolvedPath) {
+		deferForSpace(opts, path, resolvedPath)
+		return nil
+	}
+	if budgetReached(opts, path, resolvedPath) {
+		return nil
+	}
+	defer reserveCopy(opts, resolvedPath)()
+	return convertSymlink(path, resolvedPath, backup, opts, processedSymlinks)
+}
+
+// Count the size of a copy against -max-total-bytes and -min-free-space while it is written: with -jobs, the other
+// workers check them before the copy is recorded. Returns the function releasing it (once recorded, or failed)
+func reserveCopy(opts *options, resolvedPath string) func() {
+	var size int64
+	if info, err := statLong(resolvedPath); err == nil {
+		size = info.Size()
+	}
+	opts.stats.mu.Lock()
+	opts.stats.reserved += size
+	opts.stats.mu.Unlock()
+	return func() {
+		opts.stats.mu.Lock()
+		opts.stats.reserved -= size
+		opts.stats.mu.Unlock()
+	}
+}
+
+// Resolve the target of a symlink, also under another Unicode normalization of its names;
+// the target of a broken symlink is its destination, as written in the link
+func resolveSymlink(path string, opts *options) (resolvedPath string, broken bool) {
+	resolvedPath, err := evalSymlinksLong(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if normalized, ok := resolveNormalized(path, opts.maxLinkDepth); ok {
+			fmt.Fprintf(output, "Target found under another Unicode normalization: %s -> %s\n", displayPath(path), displayPath(normalized))
+			return normalized, false
+		}
+	}
+	if err != nil {
+		linkDest, _ := readlinkLong(path)
+		if _, statErr := statLong(path); statErr != nil {
+			return linkDest, true // Report the dangling target
+		}
+		// The target exists, but its resolved path is too long to be reported: it is named after the symlink
+		if !filepath.IsAbs(linkDest) {
+			linkDest = filepath.Join(linkDir(path), linkDest)
+		}
+		return linkDest, false
+	}
+	return resolvedPath, false
+}
+
+// Check if the data budget of the run (-max-total-bytes) is used up; the remaining symlinks are then
+// deferred to the next run
+func budgetReached(opts *options, path, resolvedPath string) bool {
+	if opts.maxTotalBytes <= 0 {
+		return false
+	}
+	var size int64
+	if info, err := statLong(resolvedPath); err == nil {
+		size = info.Size()
+	}
+	opts.stats.mu.Lock()
+	if !opts.stats.budgetReached && opts.stats.bytes+opts.stats.reserved+size <= opts.maxTotalBytes {
+		opts.stats.mu.Unlock()
+		return false
+	}
+	opts.stats.budgetReached = true
+	opts.stats.deferred++
+	opts.stats.deferredBytes += size
+	opts.stats.mu.Unlock()
+	fmt.Fprintln(output, "Symlink deferred (-max-total-bytes reached):", displayPath(path))
+	recordAction(opts, "deferred", path, resolvedPath, 0)
+	return true
+}
+
+// Replace a symlink with a copy of the file it points to, after backing it up
+func convertSymlink(path, resolvedPath string, backup bool, opts *options, processedSymlinks map[string]bool) error {
+	linkDest, _ := readlinkLong(path)
+	var backupPath string
+	if backup {
+		var err error
+		if backupPath, err = backupSymlink(path, opts, processedSymlinks); errors.Is(err, syscall.EROFS) {
+			skipReadOnly(opts, path, resolvedPath) // Remounted read-only since it was checked (or a read-only bind mount)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to backup symlink %q: %w", path, err)
+		}
+	}
+
+	var checksum hash.Hash
+	if opts.verifyAfter {
+		checksum = sha256.New()
+	}
+	size, entry, err := copyTarget(path, resolvedPath, checksum, opts)
+	if errors.Is(err, syscall.EDQUOT) || errors.Is(err, syscall.ENOSPC) {
+		// The partial copy is already removed, and the symlink is still in place
+		var errno syscall.Errno
+		errors.As(err, &errno)
+		coloredPrintf(redColor, "Out of space (%v) while copying %s; no more symlinks will be converted\n", errno, path)
+		if backupPath != "" {
+			os.Remove(backupPath)
+		}
+		opts.stats.outOfSpace = true
+		deferForSpace(opts, path, resolvedPath)
+		return nil
+	}
+	if errors.Is(err, syscall.EROFS) {
+		if backupPath != "" {
+			os.Remove(backupPath)
+		}
+		skipReadOnly(opts, path, resolvedPath)
+		return nil
+	}
+	if errors.Is(err, errSymlinkChanged) {
+		if backupPath != "" {
+			os.Remove(backupPath)
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replace symlink %q with its target file %q: %w", path, resolvedPath, err)
+	}
+	if entry != "" {
+		addToCache(path, entry, opts.dedupStore != "")
+	}
+	countCopy(path, resolvedPath, size, opts)
+	if opts.verifyAfter {
+		opts.stats.conversions = append(opts.stats.conversions,
+			conversion{path: path, target: resolvedPath, size: size, checksum: hex.EncodeToString(checksum.Sum(nil))})
+	}
+
+	processedSymlinks[path] = true
+	recordConversion(opts, "converted", path, resolvedPath, size, linkDest, backupPath)
+
+	if opts.fileHook != "" {
+		if err := runHook(opts.fileHook, "SYMLINK2FILE_PATH="+path, "SYMLINK2FILE_TARGET="+resolvedPath); err != nil {
+			return fmt.Errorf("file hook failed for %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Replace a symlink with its target: as a hard link to an earlier copy of the same target, to the target itself
+// (-link-mode hardlink) or to the copy cache or dedup store, falling back to a copy of the data.
+// The returned cache entry is not empty when the new copy is to be added to the cache or store
+func copyTarget(path, resolvedPath string, checksum hash.Hash, opts *options) (size int64, entry string, err error) {
+	if first, ok := opts.stats.copies[resolvedPath]; ok && checksum == nil && opts.times != "link" {
+		// The same input staged in many task directories is stored once
+		if size, err = replaceSymlinkWithHardlink(path, first, opts); err == nil {
+			return size, "", nil
+		}
+	} else if opts.linkMode == "hardlink" && checksum == nil {
+		// Hard links are only possible within a filesystem
+		if size, err = replaceSymlinkWithHardlink(path, resolvedPath, opts); err == nil {
+			return size, "", nil
+		}
+	} else if checksumStore(opts) != "" && checksum == nil {
+		// The target is read to find its entry, but a cached copy is not written again
+		if entry, err = cacheEntry(checksumStore(opts), resolvedPath); err != nil {
+			return 0, "", fmt.Errorf("failed to compute the checksum of %q: %w", resolvedPath, err)
+		}
+		if size, err = replaceSymlinkFromCache(path, resolvedPath, entry, opts); err == nil {
+			opts.stats.cacheHits++
+			return size, "", nil
+		}
+	}
+	size, err = replaceSymlinkWithFile(path, resolvedPath, checksum, opts)
+	return size, entry, err
+}
+
+// Count a new copy in the statistics of the run: copies of the lower layer of an overlay, and the copies
+// later symlinks to the same target can share (with the Nextflow statistics of their task)
+func countCopy(path, resolvedPath string, size int64, opts *options) {
+	if mount := opts.stats.overlays[opts.targetDir]; mount != nil && mount.inLowerLayer(resolvedPath) {
+		opts.stats.lowerCopies++
+	}
+	// Files staged into many task directories share one copy; other layouts (e.g. -preset nix or conda) only with -preserve links
+	if opts.preset == "nextflow" || opts.preset == "snakemake" || opts.preserveLinks {
+		if _, ok := opts.stats.copies[resolvedPath]; !ok {
+			opts.stats.copies[resolvedPath] = path
+		}
+		if task := nextflowTask(path); task != "" && opts.preset == "nextflow" {
+			if opts.stats.tasks[task] == nil {
+				opts.stats.tasks[task] = &taskStat{}
+			}
+			opts.stats.tasks[task].symlinks++
+			opts.stats.tasks[task].bytes += size
+		}
+	}
+}
+
+// Handle a symlink to a FIFO or a device node according to the -special-files policy
+// Recreating the node falls back to leaving the symlink alone if it is not permitted (device nodes need privileges)
+// Symlinks to sockets are always left alone (a socket is only meaningful with the process listening on it)
+func processSpecialFile(path, resolvedPath string, targetInfo os.FileInfo, backup bool, opts *options, processedSymlinks map[string]bool) error {
+	if targetInfo.Mode()&os.ModeSocket != 0 {
+		coloredPrintf(redColor, "Warning: symlink to a socket left alone: "+resetColor+"%s\n", path)
+		opts.stats.sockets = append(opts.stats.sockets, path)
+		recordAction(opts, "skipped", path, resolvedPath, 0)
+		return nil
+	}
+	kind := "FIFO"
+	if targetInfo.Mode()&os.ModeDevice != 0 {
+		kind = "block device"
+		if targetInfo.Mode()&os.ModeCharDevice != 0 {
+			kind = "character device"
+		}
+	}
+	switch opts.specialFiles {
+	case "error":
+		return fmt.Errorf("symlink %q points to a %s %q", path, kind, resolvedPath)
+	case "recreate":
+		parent, name, linkIno, err := openSymlinkDir(opts, path)
+		if err != nil {
+			return err
+		}
+		defer parent.Close()
+		tempName, err := createTempEntry(func(name string) error { return parent.makeNode(name, targetInfo) })
+		if err == nil {
+			linkDest, _ := parent.readlink(name)
+			var backupPath string
+			if backup {
+				if backupPath, err = backupSymlink(path, opts, processedSymlinks); err != nil {
+					parent.remove(tempName)
+					return fmt.Errorf("failed to backup symlink %q: %w", path, err)
+				}
+			}
+			if err := renameOverSymlink(parent, tempName, path, linkIno); err != nil {
+				parent.remove(tempName)
+				return fmt.Errorf("failed to replace symlink %q with a %s: %w", path, kind, err)
+			}
+			fmt.Fprintf(output, "Symlink replaced with a %s: %s\n", kind, displayPath(path))
+			recordConversion(opts, "converted", path, resolvedPath, 0, linkDest, backupPath)
+			return nil
+		}
+		switch {
+		case errors.Is(err, errors.ErrUnsupported):
+			coloredPrintf(redColor, "Warning: a %s cannot be created for %s on this system\n", kind, path)
+		case errors.Is(err, syscall.EPERM):
+			coloredPrintf(redColor, "Warning: not permitted to create a %s for %s\n", kind, path)
+		default:
+			return fmt.Errorf("failed to create a %s for %q: %w", kind, path, err)
+		}
+	}
+	fmt.Fprintf(output, "Symlink left alone (target is a %s): %s\n", kind, displayPath(path))
+	recordAction(opts, "skipped", path, resolvedPath, 0)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+// Cron expressions of the daemon schedule (-cron)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed cron expression; every field is a bit set of the allowed values
+type cronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	anyDayOfMonth, anyDayOfWeek                bool // The day fields were '*'
+}
+
+// Shortcuts for common cron expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a standard five-field cron expression (minute hour day-of-month month day-of-week)
+// Fields support '*', lists, ranges, steps, and month/day names; @hourly, @daily, etc. are also accepted
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d in %q", len(fields), expr)
+	}
+
+	months := []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	days := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+	var schedule cronSchedule
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if schedule.dayOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12, months); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if schedule.dayOfWeek, err = parseCronField(fields[4], 0, 7, days); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1 // Sunday can be written as 7
+	}
+	schedule.anyDayOfMonth = fields[2] == "*"
+	schedule.anyDayOfWeek = fields[4] == "*"
+	return &schedule, nil
+}
+
+// Parse a single cron field into a bit set of values within [low, high]
+// Names (if given) map to values starting at low
+func parseCronField(field string, low, high int, names []string) (uint64, error) {
+	parseValue := func(value string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(value, name) {
+				return low + i, nil
+			}
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < low || number > high {
+			return 0, fmt.Errorf("invalid value %q (allowed: %d-%d)", value, low, high)
+		}
+		return number, nil
+	}
+
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := low, high
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = parseValue(startPart); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = parseValue(endPart); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = high
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// Find the first time matching the schedule strictly after the given time
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit // The expression never matches (e.g., February 30)
+}
+
+// If both day fields are restricted, either of them may match (as in the classic cron)
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dayOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := c.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if c.anyDayOfMonth || c.anyDayOfWeek {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,257 @@
+package main
+
+// Periodic runs (-daemon) and the installation of their systemd units (systemd-install)
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Health of the daemon, reported by the HTTP endpoint
+type daemonHealth struct {
+	mu         sync.Mutex
+	Started    time.Time `json:"started"`
+	Runs       int       `json:"runs"`
+	LastRun    time.Time `json:"last_run"`
+	Processed  int       `json:"last_processed"`
+	LastError  string    `json:"last_error,omitempty"`
+	NextRun    time.Time `json:"next_run"`
+	Converting bool      `json:"converting"`
+}
+
+// Periodically rescan all roots until the process receives SIGINT or SIGTERM
+// Each rescan is logged with slog (to stderr or syslog), failures do not stop the daemon
+func runDaemon(opts *options) error {
+	var logWriter io.Writer = os.Stderr
+	if opts.logSyslog {
+		writer, err := newSyslog()
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		defer writer.Close()
+		logWriter = writer
+	}
+	logger := slog.New(slog.NewTextHandler(logWriter, nil))
+
+	// Per-symlink messages are not useful in the logs
+	output = io.Discard
+
+	health := &daemonHealth{Started: time.Now()}
+	if opts.healthAddr != "" {
+		// Listening first, as a privileged port cannot be bound after -run-as
+		listener, err := net.Listen("tcp", opts.healthAddr)
+		if err != nil {
+			return fmt.Errorf("failed to serve the health endpoint: %w", err)
+		}
+		server := &http.Server{Handler: health}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.Error("health endpoint failed", "addr", opts.healthAddr, "error", err)
+			}
+		}()
+		defer server.Close()
+	}
+	if err := dropPrivileges(opts); err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	// Roots with a cron expression run on their own schedule, the others every interval (starting immediately)
+	now := time.Now()
+	schedules := make([]*rootSchedule, 0, len(opts.roots))
+	for _, root := range opts.roots {
+		schedule := &rootSchedule{root: root, cron: opts.cronSchedules[root], nextRun: now}
+		if schedule.cron != nil {
+			schedule.nextRun = schedule.cron.next(now)
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	logger.Info("daemon started", "roots", strings.Join(opts.roots, ","), "interval", opts.interval.String())
+	for {
+		// Wait for the earliest scheduled root
+		nextRun := schedules[0].nextRun
+		for _, schedule := range schedules[1:] {
+			if schedule.nextRun.Before(nextRun) {
+				nextRun = schedule.nextRun
+			}
+		}
+		select {
+		case sig := <-stop:
+			logger.Info("daemon stopped", "signal", sig.String())
+			return nil
+		case <-time.After(time.Until(nextRun)):
+		}
+
+		health.runStarted()
+		processedSymlinks := make(map[string]bool)
+		var runErr error
+		for _, schedule := range schedules {
+			if time.Now().Before(schedule.nextRun) {
+				continue
+			}
+			start := time.Now()
+			opts.targetDir = schedule.root
+			if err := processSymlinks(opts, processedSymlinks); err != nil {
+				logger.Error("rescan failed", "root", schedule.root, "error", err)
+				runErr = err
+			} else {
+				logger.Info("rescan complete", "root", schedule.root, "duration", time.Since(start).String())
+			}
+			schedule.advance(opts.interval)
+		}
+		count := countProcessed(processedSymlinks)
+		logger.Info("run complete", "processed", count)
+
+		nextRun = schedules[0].nextRun
+		for _, schedule := range schedules[1:] {
+			if schedule.nextRun.Before(nextRun) {
+				nextRun = schedule.nextRun
+			}
+		}
+		health.runFinished(count, runErr, nextRun)
+	}
+}
+
+// Schedule of a single root in the daemon mode
+type rootSchedule struct {
+	root    string
+	cron    *cronSchedule // Cron expression for the root (nil to use the interval)
+	nextRun time.Time
+}
+
+// Compute the next run time after a rescan
+func (s *rootSchedule) advance(interval time.Duration) {
+	if s.cron != nil {
+		s.nextRun = s.cron.next(time.Now())
+	} else {
+		s.nextRun = time.Now().Add(interval)
+	}
+}
+
+func (h *daemonHealth) runStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Converting = true
+}
+
+func (h *daemonHealth) runFinished(processed int, err error, nextRun time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Converting = false
+	h.Runs++
+	h.LastRun = time.Now()
+	h.Processed = processed
+	h.NextRun = nextRun
+	h.LastError = ""
+	if err != nil {
+		h.LastError = err.Error()
+	}
+}
+
+// Report the health as JSON; the status code is 503 if the last run failed
+func (h *daemonHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if h.LastError != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// Generate a systemd service and timer running symlink2file on a schedule
+// Arguments after "--" are passed to symlink2file as options.
+// The units are printed to stdout, or written to the systemd directory with --install
+func systemdInstall(args []string) error {
+	flags := flag.NewFlagSet("systemd-install", flag.ExitOnError)
+	var dirs stringList
+	flags.Var(&dirs, "dir", "Directory to process (can be repeated)")
+	schedule := flags.String("schedule", "daily", "When to run, as a systemd OnCalendar expression (e.g. 'daily', 'hourly', '*-*-* 02:00')")
+	name := flags.String("name", "symlink2file", "Name of the service and timer units")
+	install := flags.Bool("install", false, "Write the units to the systemd directory instead of printing them")
+	unitDir := flags.String("unit-dir", "/etc/systemd/system", "Directory for the installed units")
+	flags.Parse(args)
+
+	if len(dirs) == 0 {
+		return fmt.Errorf("at least one --dir is required")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the symlink2file binary: %w", err)
+	}
+	command := []string{executable}
+	command = append(command, flags.Args()...)
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("error resolving path: %w", err)
+		}
+		command = append(command, absDir)
+	}
+	for i, arg := range command {
+		command[i] = systemdQuote(arg)
+	}
+
+	service := fmt.Sprintf(`[Unit]
+Description=Replace symlinks with regular files (symlink2file)
+Documentation=https://github.com/vmikk/symlink2file
+
+[Service]
+Type=oneshot
+ExecStart=%s
+`, strings.Join(command, " "))
+
+	timer := fmt.Sprintf(`[Unit]
+Description=Run %s.service on schedule
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, *name, *schedule)
+
+	if !*install {
+		fmt.Printf("# %s.service\n%s\n# %s.timer\n%s", *name, service, *name, timer)
+		return nil
+	}
+
+	servicePath := filepath.Join(*unitDir, *name+".service")
+	timerPath := filepath.Join(*unitDir, *name+".timer")
+	if err := os.WriteFile(servicePath, []byte(service), 0644); err != nil {
+		return fmt.Errorf("failed to write service unit: %w", err)
+	}
+	if err := os.WriteFile(timerPath, []byte(timer), 0644); err != nil {
+		return fmt.Errorf("failed to write timer unit: %w", err)
+	}
+	coloredPrintf(greenColor, "Installed %s and %s\n", servicePath, timerPath)
+	fmt.Printf("Enable the timer with:\n    %ssystemctl daemon-reload && systemctl enable --now %s.timer%s\n", cmdColor, *name, resetColor)
+	return nil
+}
+
+// Quote a command-line argument for ExecStart if needed
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + replacer.Replace(arg) + `"`
+}
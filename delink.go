@@ -0,0 +1,168 @@
+package main
+
+// Reverse of the main operation: replace the files identical to a file under a root with symlinks to it (delink)
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Replace a regular file with a symlink (atomically, via a temporary symlink), if it is still the file described by info
+func replaceFileWithSymlink(path, linkDest string, info os.FileInfo) error {
+	parent, err := openDirHandle(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	name := filepath.Base(path)
+	_, fileIno, _ := fileID(info)
+	tempName, err := createTempEntry(func(name string) error { return parent.symlink(linkDest, name) })
+	if err != nil {
+		return err
+	}
+	if ino, isSymlink, err := parent.lstat(name); err != nil || isSymlink || ino != fileIno {
+		parent.remove(tempName)
+		return fmt.Errorf("file %q was changed during the replacement, left as it is", path)
+	}
+	if err := parent.rename(tempName, name); err != nil {
+		parent.remove(tempName)
+		return err
+	}
+	return nil
+}
+
+// Reverse of the main operation: replace the regular files identical (by SHA-256) to a file
+// under the reference root with symlinks to that file, reclaiming their space
+func delink(args []string) error {
+	flags := flag.NewFlagSet("delink", flag.ExitOnError)
+	targetRoot := flags.String("target-root", "", "Directory with the reference copies the symlinks will point to (required)")
+	relative := flags.Bool("relative", false, "Create relative symlinks instead of absolute ones")
+	minSize := flags.Int64("min-size", 1, "Only replace files of at least this size (in bytes)")
+	dryRun := flags.Bool("dry-run", false, "Only print the files that would be replaced")
+	interactive := flags.Bool("i", false, "Prompt before replacing each file")
+	flags.Parse(args)
+	if *targetRoot == "" || flags.NArg() == 0 {
+		return errors.New("usage: symlink2file delink --target-root <directory> [--relative] [--min-size BYTES] [--dry-run] [-i] <directory> ...")
+	}
+	refRoot, err := filepath.Abs(*targetRoot)
+	if err != nil {
+		return err
+	}
+
+	// Index the reference files by size; their checksums are only computed for files of the same size
+	bySize := make(map[int64][]string)
+	err = filepath.WalkDir(refRoot, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing path %q: %w", path, err)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() >= *minSize {
+			bySize[info.Size()] = append(bySize[info.Size()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index target root: %w", err)
+	}
+	refChecksums := make(map[string]string)
+
+	opts := newOptions()
+	opts.interactive = *interactive
+	replaced, reclaimed := 0, int64(0)
+	for _, dir := range flags.Args() {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		opts.targetDir = root
+		err = filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error accessing path %q: %w", path, err)
+			}
+			if entry.IsDir() && (entry.Name() == ".symlink2file" || path == refRoot) {
+				return filepath.SkipDir
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			candidates := bySize[info.Size()]
+			if len(candidates) == 0 {
+				return nil
+			}
+			checksum, err := fileChecksum(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %q: %w", path, err)
+			}
+
+			for _, reference := range candidates {
+				if _, ok := refChecksums[reference]; !ok {
+					refChecksums[reference], _ = fileChecksum(reference)
+				}
+				if refChecksums[reference] != checksum {
+					continue
+				}
+				if refInfo, err := os.Stat(reference); err == nil && os.SameFile(info, refInfo) {
+					return nil // Hard link to the reference, nothing to reclaim
+				}
+
+				linkDest := reference
+				if *relative {
+					if relDest, err := filepath.Rel(filepath.Dir(path), reference); err == nil {
+						linkDest = relDest
+					}
+				}
+				if *dryRun {
+					fmt.Printf("Would replace %s with a symlink to %s\n", path, linkDest)
+					replaced++
+					reclaimed += info.Size()
+					return nil
+				}
+				if opts.interactive && !opts.prompt.answerAll {
+					ok, err := confirm(opts, path, fmt.Sprintf("Replace %s with a symlink to %s?", path, linkDest))
+					if err != nil || !ok {
+						return err
+					}
+				}
+				// The file may have changed since it was checksummed
+				if current, err := fileChecksum(path); err != nil || current != checksum {
+					fmt.Println("File changed while processing, skipping:", path)
+					return nil
+				}
+				if err := replaceFileWithSymlink(path, linkDest, info); err != nil {
+					return fmt.Errorf("failed to replace %q with a symlink: %w", path, err)
+				}
+				coloredPrintf(greenColor, "Replaced file with symlink: "+resetColor+"%s -> %s\n", path, linkDest)
+				replaced++
+				reclaimed += info.Size()
+				return nil
+			}
+			return nil
+		})
+		if errors.Is(err, errQuit) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		coloredPrintf(greenColor, "Dry run: %d files would be replaced, reclaiming %s.\n", replaced, formatBytes(reclaimed))
+	} else {
+		coloredPrintf(greenColor, "Delinking complete. Replaced %d files, reclaimed %s.\n", replaced, formatBytes(reclaimed))
+	}
+	return nil
+}
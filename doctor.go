@@ -0,0 +1,274 @@
+package main
+
+// Diagnostics of the filesystem of a directory (doctor) and timing of the copy methods (bench)
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Check the filesystem of a directory (type, free space, supported operations) with scratch files,
+// and print how the conversion of its symlinks will be done
+func doctor(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: symlink2file doctor <directory>")
+	}
+	dir, err := filepath.Abs(args[0])
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return err
+	}
+	// The type and free space of filesystems are only reported on Linux
+	stat, statErr := statFS(dir)
+	if statErr != nil && !errors.Is(statErr, errors.ErrUnsupported) {
+		return fmt.Errorf("failed to get the filesystem of %s: %w", dir, statErr)
+	}
+	row := func(name, value string) { fmt.Printf("  %-22s %s\n", name+":", value) }
+	check := func(name string, ok bool) {
+		if ok {
+			row(name, greenColor+"yes"+resetColor)
+		} else {
+			row(name, redColor+"no"+resetColor)
+		}
+	}
+
+	coloredPrintf(headerColor, "Filesystem of %s\n", displayPath(dir))
+	fsType := "unknown"
+	if mount := findMount(dir); mount != nil {
+		fsType = mount.fsType
+		row("Mount point", fmt.Sprintf("%s (%s)", displayPath(mount.mountPoint), displayPath(mount.source)))
+	}
+	if statErr != nil {
+		row("Type", fsType)
+		row("Free space", "not reported on this system")
+	} else {
+		row("Type", fmt.Sprintf("%s (magic 0x%x)", fsType, stat.magic))
+		check("Writable mount", !stat.readOnly)
+		row("Free space", fmt.Sprintf("%s available of %s", formatBytes(stat.available), formatBytes(stat.total)))
+		if stat.files > 0 {
+			row("Free inodes", fmt.Sprintf("%d of %d", stat.freeFiles, stat.files))
+		} else {
+			row("Free inodes", "not reported (allocated dynamically)")
+		}
+	}
+
+	coloredPrintf(headerColor, "Operations\n")
+	probe, err := os.CreateTemp(dir, ".symlink2file-doctor-*")
+	check("Create files", err == nil)
+	if err != nil {
+		fmt.Printf("  Other operations not checked: %v\n", err)
+		return fmt.Errorf("symlinks cannot be converted in %s", dir)
+	}
+	probe.WriteString("symlink2file")
+	probe.Close()
+	probePath := probe.Name()
+	defer os.Remove(probePath)
+
+	caps := probeDirectory(dir)
+	check("Rename", caps.rename)
+	check("Create symlinks", caps.symlinks)
+	check("Case-sensitive names", !caps.caseInsensitive)
+	hardlinks := os.Link(probePath, probePath+"-link") == nil
+	if hardlinks {
+		os.Remove(probePath + "-link")
+	}
+	check("Hard links", hardlinks)
+	reflinks := false
+	if source, err := os.Open(probePath); err == nil {
+		if clone, err := os.Create(probePath + "-clone"); err == nil {
+			reflinks = reflink(clone, source) == nil
+			clone.Close()
+			os.Remove(probePath + "-clone")
+		}
+		source.Close()
+	}
+	check("Reflinks", reflinks)
+	xattrErr := setXattr(probePath, "user.symlink2file.probe", []byte("1"))
+	check("Extended attributes", xattrErr == nil)
+	_, aclErr := getXattr(probePath, "system.posix_acl_access")
+	acls := aclErr == nil || errors.Is(aclErr, errNoXattr)
+	check("POSIX ACLs", acls)
+
+	coloredPrintf(headerColor, "Copy strategies\n")
+	if caps.rename {
+		row("Replacement", "atomic (copies are written to temporary files and renamed over the symlinks)")
+	} else {
+		row("Replacement", "in place (the symlinks are removed, and the copies written under their names)")
+	}
+	if caps.symlinks {
+		row("Backups", "the replaced symlinks are kept as backups")
+	} else {
+		row("Backups", "none (the replaced symlinks cannot be backed up)")
+	}
+	if reflinks {
+		row("Data", "copies share the blocks of their targets on the same filesystem (copy_file_range)")
+	} else {
+		row("Data", "full copies")
+	}
+	switch {
+	case reflinks:
+		row("--copy-cache", "reflinks of the cached copies")
+	case hardlinks:
+		row("--copy-cache", "hard links to the cached copies (reflinks unsupported)")
+	default:
+		row("--copy-cache", "unavailable (neither reflinks nor hard links)")
+	}
+	if hardlinks {
+		row("--link-mode hardlink", "available (within this filesystem)")
+		row("--dedup-store", "available (store on this filesystem)")
+	} else {
+		row("--link-mode hardlink", "unavailable")
+		row("--dedup-store", "unavailable")
+	}
+	switch {
+	case xattrErr == nil && acls:
+		row("--preserve xattr", "extended attributes and ACLs are copied")
+	case xattrErr == nil:
+		row("--preserve xattr", "extended attributes are copied (no ACLs)")
+	default:
+		row("--preserve xattr", "extended attributes cannot be set")
+	}
+
+	switch stat.magic {
+	case nfsMagic:
+		fmt.Println("Notice: NFS, --nfs-safe is enabled automatically")
+	case cifsMagic, smb2Magic:
+		fmt.Println("Notice: CIFS/SMB, file modes and times that cannot be set are reported as warnings")
+	case overlayMagic:
+		fmt.Println("Notice: overlayfs, copies of files from the lower layers take additional space in the upper layer")
+	}
+	if statErr != nil || !trustedFilesystems[stat.magic] {
+		fmt.Println("Notice: filesystem not known to symlink2file, renames and symlinks are probed again in each directory during the runs")
+	}
+	return nil
+}
+
+// Measure the throughput of the ways to copy a file on the filesystem of a directory, with scratch files
+// (plain reads and writes, copy_file_range as used by the conversions, and reflinks), and suggest the options to use
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizeValue := flags.String("size", "256M", "Size of the test file (e.g. 64M, 1G)")
+	count := flags.Int("count", 10, "Number of copies timed with each method")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: symlink2file bench [--size 256M] [--count 10] <directory>")
+	}
+	size, err := parseSize(*sizeValue)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid value for --size: %s", *sizeValue)
+	}
+	if *count <= 0 {
+		return fmt.Errorf("invalid value for --count: %d", *count)
+	}
+	dir := flags.Arg(0)
+	// Without statfs, a lack of space shows up as a failure to write the test file
+	stat, err := statFS(dir)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	if free := stat.available; err == nil && free < 2*size {
+		return fmt.Errorf("not enough free space in %s for the test: %s needed, %s available", dir, formatBytes(2*size), formatBytes(free))
+	}
+
+	workDir, err := os.MkdirTemp(dir, ".symlink2file-bench-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	sourcePath := filepath.Join(workDir, "source")
+	source, err := os.Create(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	// Random content, so that compressing or deduplicating filesystems do not skew the results
+	block := make([]byte, 1<<20)
+	rand.Read(block)
+	for written := int64(0); written < size; written += int64(len(block)) {
+		if _, err := source.Write(block[:min(int64(len(block)), size-written)]); err != nil {
+			return fmt.Errorf("failed to write the test file: %w", err)
+		}
+	}
+	if err := source.Sync(); err != nil {
+		return err
+	}
+
+	// Each copy is synced to disk, as the page cache would otherwise hide the cost of writing
+	methods := []struct {
+		name string
+		copy func(dest, source *os.File) error
+	}{
+		{"io.Copy (read/write)", func(dest, source *os.File) error {
+			// Hiding the file types prevents io.Copy from using copy_file_range
+			_, err := io.CopyBuffer(struct{ io.Writer }{dest}, struct{ io.Reader }{source}, block)
+			return err
+		}},
+		{"copy_file_range", func(dest, source *os.File) error {
+			_, err := io.Copy(dest, source)
+			return err
+		}},
+		{"reflink", func(dest, source *os.File) error {
+			return reflink(dest, source)
+		}},
+	}
+	speeds := make(map[string]float64)
+	coloredPrintf(headerColor, "%-22s %8s %12s %12s\n", "METHOD", "COPIES", "AVERAGE", "BEST")
+	for _, method := range methods {
+		var total, best time.Duration
+		var failure error
+		for i := 0; i < *count && failure == nil; i++ {
+			destPath := filepath.Join(workDir, "copy")
+			dest, err := os.Create(destPath)
+			if err != nil {
+				return err
+			}
+			source.Seek(0, io.SeekStart)
+			start := time.Now()
+			failure = method.copy(dest, source)
+			if failure == nil {
+				failure = dest.Sync()
+			}
+			elapsed := time.Since(start)
+			dest.Close()
+			os.Remove(destPath)
+			total += elapsed
+			if best == 0 || elapsed < best {
+				best = elapsed
+			}
+		}
+		if failure != nil {
+			fmt.Printf("%-22s %8s %12s %12s  (%v)\n", method.name, "-", "unsupported", "-", failure)
+			continue
+		}
+		average := total / time.Duration(*count)
+		speeds[method.name] = float64(size) / average.Seconds()
+		fmt.Printf("%-22s %8d %10s/s %10s/s\n", method.name, *count,
+			formatBytes(int64(speeds[method.name])), formatBytes(int64(float64(size)/best.Seconds())))
+	}
+
+	coloredPrintf(headerColor, "Recommendations\n")
+	fmt.Println("  Each conversion copies its file with copy_file_range; --jobs runs several copies at a time (measured here one at a time)")
+	if speed := speeds["copy_file_range"]; speed > 0 {
+		fmt.Printf("  Copying 100 GiB of targets takes about %s\n", time.Duration(float64(100<<30)/speed*float64(time.Second)).Round(time.Second))
+		if readWrite := speeds["io.Copy (read/write)"]; readWrite > 1.2*speed {
+			fmt.Println("  copy_file_range is slower than reads and writes here (e.g. a FUSE or network filesystem emulating it);")
+			fmt.Println("    --link-mode hardlink avoids copying the targets on the same filesystem")
+		}
+	}
+	if _, ok := speeds["reflink"]; ok {
+		fmt.Println("  Reflinks are supported: targets on this filesystem are copied without writing their data,")
+		fmt.Println("    and --copy-cache on this filesystem reuses copies across runs as reflinks")
+	} else {
+		fmt.Println("  Reflinks are not supported: every copy writes its data in full;")
+		fmt.Println("    --dedup-store on this filesystem makes identical copies hard links to a single file")
+	}
+	return nil
+}
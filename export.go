@@ -0,0 +1,311 @@
+package main
+
+// Copies of the roots with the symlinks materialized: to a directory (-output-dir) or to an archive (export)
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Entry of a tree being exported
+type exportItem struct {
+	path     string      // Location in the processed tree
+	relPath  string      // Location in the exported tree (slash-separated)
+	kind     string      // 'dir', 'file' (regular file or materialized symlink) or 'symlink' (kept as a symlink)
+	source   string      // File to read the content from (the resolved target for materialized symlinks)
+	linkDest string      // Destination of a kept symlink
+	info     fs.FileInfo // Metadata of the directory or of the source file
+}
+
+// Walk everything under the roots for the exporters, applying the per-directory config files
+// Symlinks to regular files are passed as files with their target as the source; excluded symlinks,
+// symlinks to directories and broken symlinks (unless they would be deleted) are kept as symlinks.
+// With several roots, each one is exported into a directory named after it
+func walkExport(opts *options, visit func(item exportItem) error) error {
+	for _, root := range opts.roots {
+		prefix := ""
+		if len(opts.roots) > 1 {
+			prefix = filepath.Base(root)
+		}
+		dirOptions := map[string]*options{filepath.Dir(root): opts}
+		err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error accessing path %q: %w", path, err)
+			}
+			if entry.IsDir() && (entry.Name() == ".symlink2file" || (opts.noRecurse && path != root)) {
+				return filepath.SkipDir
+			}
+			relPath, _ := filepath.Rel(root, path)
+			if path != root && filterExcludes(opts.filters, relPath, entry.IsDir()) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			item := exportItem{path: path, relPath: filepath.ToSlash(filepath.Join(prefix, relPath)), source: path}
+
+			if entry.IsDir() {
+				localOpts, err := loadDirConfig(path, dirOptions[filepath.Dir(path)])
+				if err != nil {
+					return err
+				}
+				if localOpts.skip {
+					return filepath.SkipDir
+				}
+				dirOptions[path] = localOpts
+				if item.info, err = entry.Info(); err != nil {
+					return err
+				}
+				item.kind = "dir"
+				return visit(item)
+			}
+
+			localOpts := dirOptions[filepath.Dir(path)]
+			if entry.Type()&os.ModeSymlink != 0 {
+				if item.linkDest, err = os.Readlink(path); err != nil {
+					return fmt.Errorf("failed to read symlink %q: %w", path, err)
+				}
+				item.kind = "symlink"
+				for _, pattern := range localOpts.exclude {
+					if ok, _ := filepath.Match(pattern, entry.Name()); ok {
+						return visit(item)
+					}
+				}
+				resolvedPath, err := evalSymlinksNormalized(path, localOpts.maxLinkDepth)
+				if err != nil {
+					if localOpts.brokenSymlinks != "keep" && localOpts.brokenSymlinks != "report" {
+						fmt.Fprintln(output, "Broken symlink, not exported:", displayPath(path))
+						recordAction(opts, "skipped", path, item.linkDest, 0)
+						return nil
+					}
+					return visit(item)
+				}
+				info, err := os.Stat(resolvedPath)
+				if err != nil {
+					return fmt.Errorf("error getting file info for %q: %w", resolvedPath, err)
+				}
+				if info.Mode().IsRegular() {
+					item.kind, item.source, item.info = "file", resolvedPath, info
+				}
+				return visit(item)
+			}
+
+			if !entry.Type().IsRegular() {
+				fmt.Fprintln(output, "Not a regular file, not exported:", displayPath(path))
+				recordAction(opts, "skipped", path, "", 0)
+				return nil
+			}
+			if item.info, err = entry.Info(); err != nil {
+				return err
+			}
+			item.kind = "file"
+			return visit(item)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build a copy of the roots in the output directory, with the symlinks to files materialized
+// The roots themselves are not modified
+func runExport(opts *options) error {
+	if entries, err := os.ReadDir(opts.outputDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("output directory %q is not empty", opts.outputDir)
+	}
+	if err := os.MkdirAll(opts.outputDir, 0o755); err != nil {
+		return err
+	}
+
+	// Directory times are set once their content is complete
+	var dirs []exportItem
+	err := walkExport(opts, func(item exportItem) error {
+		destPath := filepath.Join(opts.outputDir, filepath.FromSlash(item.relPath))
+		switch item.kind {
+		case "dir":
+			dirs = append(dirs, item)
+			return os.MkdirAll(destPath, item.info.Mode().Perm()|0o700)
+		case "symlink":
+			if err := os.Symlink(item.linkDest, destPath); err != nil {
+				return err
+			}
+			recordAction(opts, "linked", item.path, item.linkDest, 0)
+			return nil
+		}
+
+		if err := copyFile(item.source, destPath, item.info); err != nil {
+			return fmt.Errorf("failed to copy %q: %w", item.source, err)
+		}
+		if item.source != item.path {
+			fmt.Fprintf(output, "Materialized symlink: %s -> %s\n", displayPath(item.relPath), displayPath(item.source))
+			recordAction(opts, "converted", item.path, item.source, item.info.Size())
+		} else {
+			recordAction(opts, "copied", item.path, "", item.info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		destPath := filepath.Join(opts.outputDir, filepath.FromSlash(dirs[i].relPath))
+		os.Chmod(destPath, dirs[i].info.Mode().Perm())
+		os.Chtimes(destPath, dirs[i].info.ModTime(), dirs[i].info.ModTime())
+	}
+
+	coloredPrintf(greenColor, "Export complete. Copied %d files (%d materialized symlinks, %s) into %s.\n",
+		opts.stats.actions["copied"]+opts.stats.actions["converted"], opts.stats.actions["converted"],
+		formatBytes(opts.stats.bytes), opts.outputDir)
+	return nil
+}
+
+// Stream an archive of the given directories to stdout, with the content of the symlinks to files embedded as regular files
+func exportArchive(args []string) error {
+	opts := newOptions()
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "tar", "Archive format: 'tar' or 'zip'")
+	compression := flags.String("compression", "deflate", "Compression of the zip entries: 'deflate' or 'store'")
+	flags.StringVar(&opts.brokenSymlinks, "broken-symlinks", "keep", "Broken symlinks are stored as symlinks with 'keep', or left out with 'delete'")
+	flags.BoolVar(&opts.noRecurse, "no-recurse", false, "Export only the specified directory, skip subdirectories")
+	flags.Parse(args)
+	if *format != "tar" && *format != "zip" {
+		return fmt.Errorf("invalid format %q: must be 'tar' or 'zip'", *format)
+	}
+	zipMethods := map[string]uint16{"deflate": zip.Deflate, "store": zip.Store}
+	zipMethod, ok := zipMethods[*compression]
+	if !ok {
+		return fmt.Errorf("invalid compression %q: must be 'deflate' or 'store'", *compression)
+	}
+	if opts.brokenSymlinks != "keep" && opts.brokenSymlinks != "delete" {
+		return fmt.Errorf("invalid value for -broken-symlinks: %s. Must be 'keep' or 'delete'", opts.brokenSymlinks)
+	}
+
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		opts.roots = append(opts.roots, root)
+	}
+
+	// The archive is written to stdout
+	output = os.Stderr
+	buffered := bufio.NewWriter(os.Stdout)
+
+	// Add the header of an entry and return the writer receiving its content
+	var addEntry func(item exportItem) (io.Writer, error)
+	var closeArchive func() error
+	if *format == "zip" {
+		archive := zip.NewWriter(buffered)
+		addEntry = func(item exportItem) (io.Writer, error) {
+			header, err := zip.FileInfoHeader(item.info)
+			if err != nil {
+				return nil, err
+			}
+			header.Name = item.relPath
+			if item.kind == "dir" {
+				header.Name += "/"
+			} else if item.kind == "file" {
+				header.Method = zipMethod
+			}
+			return archive.CreateHeader(header)
+		}
+		closeArchive = archive.Close
+	} else {
+		archive := tar.NewWriter(buffered)
+		addEntry = func(item exportItem) (io.Writer, error) {
+			header, err := tar.FileInfoHeader(item.info, item.linkDest)
+			if err != nil {
+				return nil, err
+			}
+			header.Name = item.relPath
+			if item.kind == "dir" {
+				header.Name += "/"
+			}
+			return archive, archive.WriteHeader(header)
+		}
+		closeArchive = archive.Close
+	}
+
+	err := walkExport(opts, func(item exportItem) error {
+		if item.relPath == "." {
+			return nil
+		}
+		if item.kind == "symlink" {
+			info, err := os.Lstat(item.path)
+			if err != nil {
+				return err
+			}
+			item.info = info
+		}
+		entry, err := addEntry(item)
+		if err != nil {
+			return err
+		}
+
+		switch item.kind {
+		case "symlink":
+			// Zip stores the destination of a symlink as its content
+			if *format == "zip" {
+				_, err = io.WriteString(entry, item.linkDest)
+			}
+			return err
+		case "file":
+			file, err := os.Open(item.source)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.CopyN(entry, file, item.info.Size()); err != nil {
+				return fmt.Errorf("failed to archive %q: %w", item.source, err)
+			}
+			if item.source != item.path {
+				fmt.Fprintf(output, "Materialized symlink: %s -> %s\n", displayPath(item.relPath), displayPath(item.source))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := closeArchive(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// Copy a file with its mode and modification time, sharing the data blocks (reflink) when the filesystem allows it
+func copyFile(source, dest string, info fs.FileInfo) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	outputFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if reflink(outputFile, input) != nil {
+		if _, err := io.Copy(outputFile, input); err != nil {
+			return err
+		}
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
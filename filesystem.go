@@ -0,0 +1,426 @@
+package main
+
+// Filesystem detection and capabilities: mounts, overlays, snapshots, open files and stale handles
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Filesystem types reported by statfs (the field is signed on 32-bit platforms: compare as uint32(stat.Type))
+const (
+	btrfsMagic   uint32 = 0x9123683e
+	zfsMagic     uint32 = 0x2fc12fc1
+	overlayMagic uint32 = 0x794c7630
+	nfsMagic     uint32 = 0x6969
+	cifsMagic    uint32 = 0xff534d42
+	smb2Magic    uint32 = 0xfe534d42
+)
+
+// How long a scan of the files open for writing is reused
+const openFilesMaxAge = 10 * time.Second
+
+// Check if a file is open for writing by a process (as far as /proc shows, i.e. all processes when run as root)
+// The open files of all processes are scanned at once, and the scan is refreshed when it gets older than openFilesMaxAge
+func openForWriting(opts *options, path string) bool {
+	if opts.stats.openFiles == nil || time.Since(opts.stats.openScanned) > openFilesMaxAge {
+		opts.stats.openFiles = scanOpenFiles()
+		opts.stats.openScanned = time.Now()
+	}
+	return opts.stats.openFiles[path]
+}
+
+// List the files opened for writing by the processes, from their file descriptors and access modes in /proc
+func scanOpenFiles() map[string]bool {
+	files := make(map[string]bool)
+	fdDirs, _ := filepath.Glob("/proc/[0-9]*/fd")
+	for _, fdDir := range fdDirs {
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // The process exited, or belongs to another user
+		}
+		for _, entry := range entries {
+			target, err := os.Readlink(filepath.Join(fdDir, entry.Name()))
+			if err != nil || !filepath.IsAbs(target) {
+				continue // Pipes, sockets and other anonymous files
+			}
+			fdInfo, err := os.ReadFile(filepath.Join(filepath.Dir(fdDir), "fdinfo", entry.Name()))
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(fdInfo), "\n") {
+				if value, ok := strings.CutPrefix(line, "flags:"); ok {
+					flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 64)
+					if err == nil && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+						files[target] = true
+					}
+					break
+				}
+			}
+		}
+	}
+	return files
+}
+
+// Type, state and free space of a filesystem (see statFS)
+type fsStat struct {
+	magic     uint32 // Filesystem type, as reported by statfs
+	readOnly  bool   // Mounted read-only
+	available int64  // Bytes available to unprivileged users
+	total     int64  // Size in bytes
+	files     uint64 // Number of inodes
+	freeFiles uint64 // Number of free inodes
+}
+
+// Filesystem type (statfs magic) of a directory, detected once per device (0 if unknown), with a notice
+// the first time a device on NFS or CIFS/SMB is seen, as the conversions there are made differently
+func filesystemType(opts *options, dir string) uint32 {
+	info, err := statLong(dir)
+	if err != nil {
+		return 0
+	}
+	dev, _, ok := fileID(info)
+	if magic, seen := opts.stats.fsTypes[dev]; ok && seen {
+		return magic
+	}
+	stat, err := statFS(dir)
+	if err != nil {
+		return 0
+	}
+	if ok {
+		opts.stats.fsTypes[dev] = stat.magic
+	}
+	switch {
+	case stat.magic == nfsMagic && !opts.nfsSafe:
+		fmt.Fprintf(output, "Notice: %s is on NFS, enabling --nfs-safe there\n", dir)
+	case stat.magic == cifsMagic || stat.magic == smb2Magic:
+		fmt.Fprintf(output, "Notice: %s is on CIFS/SMB; file modes and times that cannot be set there are reported as warnings\n", dir)
+	}
+	return stat.magic
+}
+
+// Check if the copies in a directory are synced and retried on stale file handles: with -nfs-safe, or on NFS
+func useNFSSafe(opts *options, dir string) bool {
+	return opts.nfsSafe || filesystemType(opts, dir) == nfsMagic
+}
+
+// Check if a directory is on CIFS/SMB, where failures to set the mode and times of copies are warnings
+func onCIFS(opts *options, dir string) bool {
+	magic := filesystemType(opts, dir)
+	return magic == cifsMagic || magic == smb2Magic
+}
+
+// Filesystems known to support all the operations the conversion relies on (not probed)
+var trustedFilesystems = map[uint32]bool{
+	0xef53:       true, // ext2/3/4
+	0x58465342:   true, // XFS
+	0x01021994:   true, // tmpfs
+	btrfsMagic:   true,
+	zfsMagic:     true,
+	overlayMagic: true,
+	nfsMagic:     true,
+}
+
+// Operations supported by the filesystem of a directory
+type fsCapabilities struct {
+	rename          bool // Files can be renamed over each other (atomic replacement of the symlinks)
+	symlinks        bool // Symlinks can be created (needed for the backups)
+	caseInsensitive bool // Names differing only in case refer to the same entry
+}
+
+// Get the operations supported in a directory: assumed on well-known filesystems, probed with
+// scratch files on the others (e.g. FUSE); the result is cached per directory, and missing operations are reported once
+func directoryCapabilities(opts *options, dir string) *fsCapabilities {
+	if caps, ok := opts.stats.capabilities[dir]; ok {
+		return caps
+	}
+	caps := &fsCapabilities{rename: true, symlinks: true}
+	if stat, err := statFS(dir); errors.Is(err, errors.ErrUnsupported) || err == nil && !trustedFilesystems[stat.magic] {
+		caps = probeDirectory(dir)
+		if caps.caseInsensitive && !opts.stats.caseNotice {
+			fmt.Fprintf(output, "Notice: %s is on a case-insensitive filesystem; backups colliding with names differing in case are renamed\n", dir)
+			opts.stats.caseNotice = true
+		}
+		if !caps.rename {
+			coloredPrintf(redColor, "Warning: files cannot be renamed in %s; symlinks are replaced by writing the copies in place\n", dir)
+		}
+		if !caps.symlinks {
+			coloredPrintf(redColor, "Warning: symlinks cannot be created in %s; the replaced symlinks are not backed up\n", dir)
+		}
+	}
+	opts.stats.capabilities[dir] = caps
+	return caps
+}
+
+// Check if files can be renamed and symlinks created in a directory, and if names are case-sensitive
+func probeDirectory(dir string) *fsCapabilities {
+	caps := &fsCapabilities{rename: true, symlinks: true}
+	probe, err := os.CreateTemp(dir, ".symlink2file-probe-*")
+	if err != nil {
+		return caps // Unwritable directories fail later with a clear error
+	}
+	probe.Close()
+	probePath := probe.Name()
+	if _, err := os.Lstat(filepath.Join(dir, strings.ToUpper(filepath.Base(probePath)))); err == nil {
+		caps.caseInsensitive = true
+	}
+	caps.rename = os.Rename(probePath, probePath+"-renamed") == nil
+	if caps.rename {
+		probePath += "-renamed"
+	}
+	os.Remove(probePath)
+	caps.symlinks = os.Symlink(filepath.Base(probePath), probePath+"-link") == nil
+	if caps.symlinks {
+		os.Remove(probePath + "-link")
+	}
+	return caps
+}
+
+// Mount containing a directory, from /proc/self/mountinfo
+type mountEntry struct {
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// Find the mount containing a directory (the one with the longest mount point)
+func findMount(dir string) *mountEntry {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	var mount *mountEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+		mountPoint := unescapeMountinfo(fields[4])
+		if !underAnyRoot(dir, []string{mountPoint}) || (mount != nil && len(mountPoint) < len(mount.mountPoint)) {
+			continue
+		}
+		mount = &mountEntry{mountPoint: mountPoint, fsType: fields[separator+1], source: unescapeMountinfo(fields[separator+2])}
+	}
+	return mount
+}
+
+// Decode a field of /proc/self/mountinfo, where the kernel writes spaces, tabs, newlines, backslashes
+// (and commas in the options) as octal escapes, e.g. \040 for a space
+func unescapeMountinfo(field string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if code, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(field[i])
+	}
+	return unescaped.String()
+}
+
+// Overlayfs mount containing a processed directory
+type overlayMount struct {
+	mountPoint string
+	upperDir   string // Writable layer (empty if unknown)
+}
+
+// Detect if a directory is on overlayfs, and find the mount point and upper layer in /proc/self/mountinfo
+func findOverlay(dir string) *overlayMount {
+	if stat, err := statFS(dir); err != nil || stat.magic != overlayMagic {
+		return nil
+	}
+	mount := &overlayMount{}
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return mount
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// Format: ID PARENT MAJOR:MINOR ROOT MOUNT-POINT OPTIONS [OPTIONAL...] - TYPE SOURCE SUPER-OPTIONS
+		fields := strings.Fields(line)
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+3 >= len(fields) || fields[separator+1] != "overlay" {
+			continue
+		}
+		mountPoint := unescapeMountinfo(fields[4])
+		if !underAnyRoot(dir, []string{mountPoint}) || len(mountPoint) < len(mount.mountPoint) {
+			continue
+		}
+		mount.mountPoint, mount.upperDir = mountPoint, ""
+		for _, option := range strings.Split(fields[separator+3], ",") {
+			if value, ok := strings.CutPrefix(option, "upperdir="); ok {
+				mount.upperDir = unescapeMountinfo(value)
+			}
+		}
+	}
+	return mount
+}
+
+// Check if a file of the overlay comes from a lower layer (it is not present in the upper layer)
+func (mount *overlayMount) inLowerLayer(path string) bool {
+	if mount.upperDir == "" || !underAnyRoot(path, []string{mount.mountPoint}) {
+		return false
+	}
+	relPath, err := filepath.Rel(mount.mountPoint, path)
+	if err != nil {
+		return false
+	}
+	_, err = os.Lstat(filepath.Join(mount.upperDir, relPath))
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// Check if a path is an overlayfs whiteout (a character device 0:0 marking a deleted file, visible in the upper layer)
+func overlayWhiteout(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	device, ok := deviceNumber(info)
+	return ok && device == 0
+}
+
+// Check if a directory of an overlayfs layer is opaque (hides the content of the lower layers)
+func overlayOpaque(dir string) bool {
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if value, err := getXattr(dir, name); err == nil && string(value) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a read-only snapshot of the btrfs subvolume or ZFS dataset containing each root (once per subvolume/dataset)
+// Returns the names of the snapshots
+func createSnapshots(roots []string) ([]string, error) {
+	timestamp := time.Now().Format("20060102-150405")
+	var snapshots []string
+	done := make(map[string]bool)
+	for _, root := range roots {
+		stat, err := statFS(root)
+		if err != nil {
+			return snapshots, fmt.Errorf("failed to get filesystem of %q: %w", root, err)
+		}
+
+		var source, snapshot string
+		var command *exec.Cmd
+		switch stat.magic {
+		case btrfsMagic:
+			subvolume, err := btrfsSubvolume(root)
+			if err != nil {
+				return snapshots, err
+			}
+			source = subvolume
+			snapshot = strings.TrimSuffix(subvolume, "/") + ".symlink2file-" + timestamp
+			if subvolume == "/" {
+				snapshot = "/.symlink2file-" + timestamp
+			}
+			command = exec.Command("btrfs", "subvolume", "snapshot", "-r", subvolume, snapshot)
+		case zfsMagic:
+			out, err := exec.Command("zfs", "list", "-H", "-o", "name", root).Output()
+			if err != nil {
+				return snapshots, fmt.Errorf("failed to find the ZFS dataset of %q: %w", root, err)
+			}
+			source = strings.TrimSpace(string(out))
+			snapshot = source + "@symlink2file-" + timestamp
+			command = exec.Command("zfs", "snapshot", snapshot)
+		default:
+			return snapshots, fmt.Errorf("%q is not on a btrfs or ZFS filesystem", root)
+		}
+
+		if done[source] {
+			continue
+		}
+		if out, err := command.CombinedOutput(); err != nil {
+			return snapshots, fmt.Errorf("failed to snapshot %q: %v: %s", source, err, strings.TrimSpace(string(out)))
+		}
+		done[source] = true
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// Find the root of the btrfs subvolume containing a directory (subvolume roots have the inode number 256)
+func btrfsSubvolume(dir string) (string, error) {
+	for {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return "", err
+		}
+		if _, ino, ok := fileID(info); ok && ino == 256 {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no btrfs subvolume found for %q", dir)
+		}
+		dir = parent
+	}
+}
+
+// Check if two files reside on the same device
+func sameDevice(a, b os.FileInfo) bool {
+	devA, _, okA := fileID(a)
+	devB, _, okB := fileID(b)
+	return !okA || !okB || devA == devB
+}
+
+// Check if a path is one of the roots or lies below one of them
+func underAnyRoot(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the entries of a directory cannot be changed: its filesystem is mounted read-only, or it is immutable
+func readOnlyDirectory(dir string) bool {
+	if stat, err := statFS(dir); err == nil && stat.readOnly {
+		return true
+	}
+	return immutable(dir)
+}
+
+// Leave a symlink in a read-only or immutable directory alone, to be listed at the end
+func skipReadOnly(opts *options, path, resolvedPath string) {
+	fmt.Fprintf(output, "Symlink left alone (read-only directory): %s\n", displayPath(path))
+	opts.stats.readOnly = append(opts.stats.readOnly, path)
+	recordAction(opts, "skipped", path, resolvedPath, 0)
+}
+
+// Attempts of an operation failing with a stale NFS file handle
+const staleAttempts = 3
+
+// Run an operation; if enabled, retry it (after a short pause) while it fails with a stale NFS file handle
+func retryStale(enabled bool, operation func() error) error {
+	err := operation()
+	for attempt := 1; enabled && attempt < staleAttempts && errors.Is(err, syscall.ESTALE); attempt++ {
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		err = operation()
+	}
+	return err
+}
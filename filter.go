@@ -0,0 +1,399 @@
+package main
+
+// Selection of the paths to process: filter rules (-filter), .dockerignore files (-docker-context) and .symlink2file.yaml files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Include/exclude rule of --filter (rsync semantics)
+type filterRule struct {
+	include bool
+	dirOnly bool           // Pattern ending with '/' matches only directories
+	pattern *regexp.Regexp // Matched against the slash-separated path relative to the root
+}
+
+// Parse a filter rule: '+ PATTERN' / 'include PATTERN', '- PATTERN' / 'exclude PATTERN', or '. FILE' / 'merge FILE'
+// (whose rules are read from FILE, one per line). Relative merge files are resolved against baseDir
+func parseFilterRule(rule, baseDir string) ([]filterRule, error) {
+	kind, pattern, ok := strings.Cut(strings.TrimSpace(rule), " ")
+	pattern = strings.TrimSpace(pattern)
+	if !ok || pattern == "" {
+		return nil, fmt.Errorf("invalid filter rule %q", rule)
+	}
+
+	switch kind {
+	case ".", "merge":
+		if !filepath.IsAbs(pattern) && baseDir != "" {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		data, err := os.ReadFile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read filter file: %w", err)
+		}
+		var rules []filterRule
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+			merged, err := parseFilterRule(line, filepath.Dir(pattern))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", pattern, err)
+			}
+			rules = append(rules, merged...)
+		}
+		return rules, nil
+	case "+", "include", "-", "exclude":
+	default:
+		return nil, fmt.Errorf("invalid filter rule %q: must start with '+', '-', 'include', 'exclude', '.' or 'merge'", rule)
+	}
+
+	filter := filterRule{include: kind == "+" || kind == "include"}
+	if strings.HasSuffix(pattern, "/") {
+		filter.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	// Anchored patterns match from the root, others match the end of the path (e.g. a file name)
+	expression := "(^|/)"
+	if strings.HasPrefix(pattern, "/") {
+		expression = "^"
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression += ".*"
+			i++
+		case pattern[i] == '*':
+			expression += "[^/]*"
+		case pattern[i] == '?':
+			expression += "[^/]"
+		case pattern[i] == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid filter pattern %q: unterminated '['", pattern)
+			}
+			expression += pattern[i : i+end+1]
+			i += end
+		default:
+			expression += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+	compiled, err := regexp.Compile(expression + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+	}
+	filter.pattern = compiled
+	return []filterRule{filter}, nil
+}
+
+// Check if a path (relative to the root) is excluded by the filter rules; the first matching rule wins
+func filterExcludes(rules []filterRule, relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(relPath) {
+			return !rule.include
+		}
+	}
+	return false
+}
+
+// Tell why a resolvable symlink should not be converted in the current mode, or return an empty string
+func leaveAlone(path, resolvedPath string, opts *options) string {
+	if len(opts.allowed) > 0 {
+		// With -resolve once, the immediate target may be a link leading elsewhere
+		finalPath, err := evalSymlinksLong(resolvedPath)
+		if err != nil || !underAnyRoot(finalPath, opts.allowed) {
+			opts.stats.refused = append(opts.stats.refused, path)
+			return "target outside the allowed directories"
+		}
+	}
+	if overlayWhiteout(resolvedPath) {
+		return "target is an overlayfs whiteout"
+	}
+	if opts.preset == "nextflow" && (strings.HasPrefix(filepath.Base(path), ".command.") || filepath.Base(path) == ".exitcode") {
+		return "Nextflow task file"
+	}
+	if opts.crossFSOnly {
+		// The link is compared with its directory, as the filesystem of a symlink is that of the directory holding it
+		dirInfo, dirErr := statLong(filepath.Dir(path))
+		targetInfo, targetErr := statLong(resolvedPath)
+		if dirErr == nil && targetErr == nil && sameDevice(dirInfo, targetInfo) {
+			return "target on the same filesystem"
+		}
+	}
+	if opts.maxFileSize > 0 {
+		if info, err := statLong(resolvedPath); err == nil && info.Size() > opts.maxFileSize {
+			opts.stats.tooLarge = append(opts.stats.tooLarge, path)
+			return "target larger than " + formatBytes(opts.maxFileSize)
+		}
+	}
+	if opts.skipOpen && openForWriting(opts, resolvedPath) {
+		opts.stats.inUse = append(opts.stats.inUse, path)
+		return "target open for writing"
+	}
+	if opts.sameFSOnly {
+		dirInfo, dirErr := statLong(filepath.Dir(path))
+		targetInfo, targetErr := statLong(resolvedPath)
+		if dirErr == nil && targetErr == nil && !sameDevice(dirInfo, targetInfo) {
+			opts.stats.crossFS = append(opts.stats.crossFS, path)
+			return "target on another filesystem"
+		}
+	}
+	if opts.preset == "conda" {
+		// Links within the environment (bin/python -> python3.11, libfoo.so -> libfoo.so.1) stay consistent as links;
+		// the immediate destination counts, as the next link of a chain leaving the environment is materialized itself
+		linkDest, _ := readlinkLong(path)
+		if !filepath.IsAbs(linkDest) {
+			linkDest = filepath.Join(filepath.Dir(path), linkDest)
+		}
+		root, err := filepath.EvalSymlinks(opts.targetDir)
+		if underAnyRoot(linkDest, []string{opts.targetDir}) || (err == nil && underAnyRoot(resolvedPath, []string{root})) {
+			return "link within the environment"
+		}
+	}
+	if opts.preset == "nix" {
+		if !underAnyRoot(resolvedPath, opts.storeDirs) {
+			return "target outside the store"
+		}
+		if info, err := statLong(resolvedPath); err == nil && info.IsDir() {
+			return "symlink to a store directory"
+		}
+	}
+	if opts.dockerContext {
+		// Relative links within the context are sent to the Docker daemon as they are and keep working
+		linkDest, _ := readlinkLong(path)
+		root, err := filepath.EvalSymlinks(opts.targetDir)
+		if err == nil && !filepath.IsAbs(linkDest) && underAnyRoot(resolvedPath, []string{root}) {
+			return "relative link within the build context"
+		}
+	}
+	return ""
+}
+
+// Patterns of a .dockerignore file
+type dockerIgnore struct {
+	rules []dockerIgnoreRule
+}
+
+type dockerIgnoreRule struct {
+	pattern []string // Slash-separated segments; '**' matches any number of segments
+	exclude bool     // Rule starting with '!' (re-includes the matching paths)
+}
+
+// Load the .dockerignore file of a build context (a missing file ignores nothing)
+func loadDockerIgnore(dir string) (*dockerIgnore, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ".dockerignore"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &dockerIgnore{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ignore := &dockerIgnore{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := dockerIgnoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.exclude = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.Trim(filepath.ToSlash(filepath.Clean(line)), "/")
+		rule.pattern = strings.Split(line, "/")
+		for _, segment := range rule.pattern {
+			if _, err := filepath.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("invalid .dockerignore pattern %q: %w", line, err)
+			}
+		}
+		ignore.rules = append(ignore.rules, rule)
+	}
+	return ignore, nil
+}
+
+// Check if a path relative to the context is ignored (the last matching rule wins; a match on a parent directory counts)
+func (ignore *dockerIgnore) matches(relPath string) bool {
+	segments := strings.Split(filepath.ToSlash(relPath), "/")
+	ignored := false
+	for _, rule := range ignore.rules {
+		for n := 1; n <= len(segments); n++ {
+			if matchSegments(rule.pattern, segments[:n]) {
+				ignored = !rule.exclude
+				break
+			}
+		}
+	}
+	return ignored
+}
+
+// Whether any rule re-includes paths (then ignored directories must still be walked)
+func (ignore *dockerIgnore) hasExceptions() bool {
+	for _, rule := range ignore.rules {
+		if rule.exclude {
+			return true
+		}
+	}
+	return false
+}
+
+// Match path segments against pattern segments, where '**' matches zero or more segments
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// Name of the per-directory config file
+const dirConfigName = ".symlink2file.yaml"
+
+// Apply the config file of a directory (if present) on top of the options inherited from its parent
+// The file is a small YAML document, e.g.:
+//
+//	broken-symlinks: keep
+//	no-backup: true
+//	exclude: ["*.bam", "*.bai"]
+//	skip: false
+//
+// Exclusion patterns are added to the inherited ones, other settings replace them
+func loadDirConfig(dir string, parent *options) (*options, error) {
+	file, err := openLongPath(filepath.Join(dir, dirConfigName), os.O_RDONLY)
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return parent, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file in %q: %w", dir, err)
+	}
+
+	values, err := parseSimpleYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", filepath.Join(dir, dirConfigName), err)
+	}
+
+	local := *parent
+	local.exclude = append([]string(nil), parent.exclude...)
+	for key, value := range values {
+		switch key {
+		case "broken-symlinks":
+			if len(value) != 1 || !validBrokenAction(value[0]) {
+				return nil, fmt.Errorf("invalid broken-symlinks in %q: must be one of: %s", dir, strings.Join(brokenActions, ", "))
+			}
+			local.brokenSymlinks = value[0]
+		case "backup-broken":
+			if len(value) != 1 || (value[0] != "yes" && value[0] != "no") {
+				return nil, fmt.Errorf("invalid backup-broken in %q: must be 'yes' or 'no'", dir)
+			}
+			local.backupBroken = value[0]
+		case "no-backup", "skip":
+			if len(value) != 1 {
+				return nil, fmt.Errorf("invalid %s in %q: expected a single value", key, dir)
+			}
+			flagValue, err := strconv.ParseBool(value[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in %q: %w", key, dir, err)
+			}
+			if key == "skip" {
+				local.skip = flagValue
+			} else {
+				local.noBackup = flagValue
+			}
+		case "exclude":
+			for _, pattern := range value {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid exclude pattern %q in %q: %w", pattern, dir, err)
+				}
+			}
+			local.exclude = append(local.exclude, value...)
+		default:
+			return nil, fmt.Errorf("unknown setting %q in %q", key, dir)
+		}
+	}
+	return &local, nil
+}
+
+// Parse the subset of YAML used by the config files: "key: value" pairs,
+// where lists are written either inline ("[a, b]") or as "- item" lines below the key
+func parseSimpleYAML(data []byte) (map[string][]string, error) {
+	unquote := func(value string) string {
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			return value[1 : len(value)-1]
+		}
+		return value
+	}
+
+	values := make(map[string][]string)
+	var listKey string
+	for lineNumber, line := range strings.Split(string(data), "\n") {
+		if index := strings.Index(line, " #"); index >= 0 {
+			line = line[:index]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", lineNumber+1)
+			}
+			values[listKey] = append(values[listKey], unquote(item))
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", lineNumber+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		listKey = ""
+		switch {
+		case value == "":
+			listKey = key
+			values[key] = nil
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			values[key] = nil
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = unquote(item); item != "" {
+					values[key] = append(values[key], item)
+				}
+			}
+		default:
+			values[key] = []string{unquote(value)}
+		}
+	}
+	return values, nil
+}
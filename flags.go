@@ -0,0 +1,682 @@
+package main
+
+// Command-line flags, their environment variables and the checks of option combinations
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse command-line flags and return their values
+func parseFlags() *options {
+	opts := newOptions()
+
+	// Flags
+	flag.StringVar(&opts.action, "action", "convert", "What to do with the symlinks: 'convert' (replace with files), 'absolutize' or 'relativize' (rewrite the links)")
+	var retargets stringList
+	flag.Var(&retargets, "retarget", "Rewrite link destinations starting with a prefix, as 'OLD=NEW' (can be repeated; implies -action retarget)")
+	var filters stringList
+	flag.Var(&filters, "filter", "Include/exclude rule with rsync semantics, e.g. '- *.tmp', '+ data/**', 'merge FILE' (can be repeated; the first matching rule wins)")
+	flag.StringVar(&opts.relativeRoot, "relative-root", "", "With -action relativize, only symlinks with targets under this directory are made relative (default: the processed directory)")
+	flag.BoolVar(&opts.noBackup, "no-backup", false, "Skip creating backups of replaced symlinks")
+	flag.StringVar(&opts.backupBroken, "backup-broken", "yes", "Back up broken symlinks before deleting or replacing them: 'yes' or 'no' (independent of -no-backup)")
+	flag.StringVar(&opts.brokenSymlinks, "broken-symlinks", "keep", "Action for broken symlinks: 'keep', 'delete', 'trash', 'placeholder', 'report', or 'repair'")
+	flag.BoolVar(&opts.suggestTargets, "suggest-targets", false, "Suggest likely intended targets for the kept broken symlinks (renamed or differently cased siblings, one directory up)")
+	var searchRoots stringList
+	flag.Var(&searchRoots, "search-root", "With -broken-symlinks repair, directory searched for files with the name of the missing target (can be repeated)")
+	flag.StringVar(&opts.repairMode, "repair-mode", "retarget", "With -broken-symlinks repair, 'retarget' the symlink to the found file or 'materialize' a copy of it")
+	flag.StringVar(&opts.repairManifest, "repair-manifest", "", "With -broken-symlinks repair, TSV file of missing targets with their size and SHA-256 (target, size, checksum)")
+	flag.StringVar(&opts.brokenReport, "broken-report", "", "With -broken-symlinks report, file listing the broken symlinks and their targets")
+	flag.StringVar(&opts.quarantineDir, "quarantine-dir", "", "With -broken-symlinks trash, move broken symlinks here (one subdirectory per run) instead of the XDG trash")
+	flag.BoolVar(&opts.noRecurse, "no-recurse", false, "Process only the specified directory, skip subdirectories")
+	flag.IntVar(&opts.maxLinkDepth, "max-link-depth", 40, "Maximum number of symlinks followed to resolve a chain (longer chains are skipped)")
+	flag.StringVar(&opts.resolve, "resolve", "full", "How far symlinks are dereferenced: 'full' (final target) or 'once' (a symlink to a symlink becomes a copy of that symlink)")
+	flag.StringVar(&opts.loops, "loops", "keep", "Action for symlink loops: 'keep', 'delete', or 'report' (to the -broken-report file)")
+	flag.BoolVar(&opts.verbose, "verbose", false, "Print more details (e.g. every hop of symlink chains)")
+	flag.BoolVar(&opts.verbose, "v", false, "Print more details (shorthand)")
+	flag.DurationVar(&opts.statsInterval, "stats-interval", 0, "Print a status line (symlinks processed, bytes copied, throughput, errors) this often, e.g. 5m")
+	flag.DurationVar(&opts.heartbeat, "heartbeat", 0, "Print a line whenever nothing was printed for this long (e.g. 5m, for CI systems stopping silent jobs)")
+	flag.BoolVar(&opts.interactive, "interactive", false, "Prompt before modifying each symlink")
+	flag.BoolVar(&opts.interactive, "i", false, "Prompt before modifying each symlink (shorthand)")
+	flag.BoolVar(&opts.tui, "tui", false, "Review and select symlinks in a full-screen interface before converting")
+	flag.BoolVar(&opts.daemon, "daemon", false, "Keep running and rescan the directories periodically")
+	flag.DurationVar(&opts.interval, "interval", time.Hour, "Time between rescans in the daemon mode")
+	flag.BoolVar(&opts.logSyslog, "syslog", false, "Send the daemon logs to syslog")
+	var cronEntries stringList
+	flag.Var(&cronEntries, "cron", "Schedule of a directory in the daemon mode as 'DIR=CRON-EXPRESSION' (can be repeated)")
+	flag.StringVar(&opts.healthAddr, "health-addr", "", "Serve the daemon health status over HTTP on this address (e.g. ':8080')")
+	runAs := flag.String("run-as", "", "When started as root, switch to this 'USER' or 'USER:GROUP' once the logs and listeners are set up")
+	flag.StringVar(&opts.preHook, "pre-hook", "", "Shell command to run before processing (processing is aborted if it fails)")
+	flag.StringVar(&opts.postHook, "post-hook", "", "Shell command to run after processing")
+	flag.StringVar(&opts.fileHook, "file-hook", "", "Shell command to run after each replaced symlink ($SYMLINK2FILE_PATH, $SYMLINK2FILE_TARGET)")
+	flag.StringVar(&opts.decider, "decider", "", "Command deciding per symlink (JSON on stdin, 'convert', 'skip' or 'delete' on stdout)")
+	flag.BoolVar(&opts.check, "check", false, "Only report the symlinks found (nothing is modified); exit with status 1 if there are any")
+	flag.BoolVar(&opts.audit, "audit", false, "Only print a categorized inventory of the symlinks with counts and sizes (nothing is modified)")
+	flag.BoolVar(&opts.diff, "diff", false, "Only print the planned changes in a unified-diff-like format (nothing is modified)")
+	flag.StringVar(&opts.checkFormat, "format", "text", "Format of the -check report: 'text' or 'github' (GitHub Actions annotations)")
+	flag.StringVar(&opts.preset, "preset", "", "Settings for a known directory layout: 'nextflow', 'snakemake' (work directories), 'nix' (store links) or 'conda' (environments)")
+	flag.StringVar(&opts.copyCache, "copy-cache", "", "Keep the copies in this directory by checksum, and reuse them as reflinks (or hard links) in later runs instead of copying")
+	flag.StringVar(&opts.dedupStore, "dedup-store", "", "Hard-link all copies of identical content to a single file in this directory (on the filesystem of the directories)")
+	flag.StringVar(&opts.linkMode, "link-mode", "", "How symlinks are materialized: 'copy' or 'hardlink' (to the target, falling back to a copy); default: copy (hardlink with -preset conda)")
+	var storeDirs stringList
+	var restrictTargets stringList
+	flag.Var(&restrictTargets, "restrict-targets", "Refuse to copy symlinks whose resolved targets are outside this directory (can be repeated)")
+	flag.Var(&storeDirs, "store-dir", "With -preset nix, store directory whose symlinks are converted (can be repeated; default: /nix/store and /gnu/store)")
+	flag.BoolVar(&opts.crossFSOnly, "cross-fs-only", false, "Convert only the symlinks whose targets are on a different filesystem than the link")
+	flag.StringVar(&opts.specialFiles, "special-files", "skip", "Symlinks to FIFOs and device nodes: 'skip', 'recreate' (the node, devices need privileges) or 'error'")
+	chmodSpec := flag.String("chmod", "", "Mode of the new files instead of the mode of the target, in octal (0644) or symbolic form (u+rw,go-w)")
+	flag.BoolVar(&opts.respectUmask, "respect-umask", false, "Give the new files the mode of the target without the bits of the umask, instead of an exact copy")
+	flag.BoolVar(&opts.stripSpecial, "strip-special-bits", false, "Clear the setuid, setgid and sticky bits of the new files")
+	flag.BoolVar(&opts.unquarantine, "strip-quarantine", false, "Remove the com.apple.quarantine attribute from the new files (macOS only)")
+	secure := flag.Bool("secure", false, "Safer settings for untrusted trees (implies -strip-special-bits)")
+	preserve := flag.String("preserve", "mode,timestamps", "Attributes of the targets given to the new files: 'mode', 'timestamps', 'ownership', 'xattr', 'links', 'sparse' or 'all' (comma-separated)")
+	archive := flag.Bool("archive", false, "Preserve everything (same as -preserve all): owner, extended attributes and ACLs, holes of sparse files, hard links (between symlinks to the same target) and times")
+	flag.BoolVar(archive, "a", false, "Preserve everything (shorthand)")
+	flag.StringVar(&opts.times, "times", "target", "Times of the new files: 'target' (modification time of the target), 'link' (times of the symlink itself) or 'now'")
+	maxFileSize := flag.String("max-file-size", "", "Leave the symlinks to files larger than this, e.g. '10G', and list them at the end")
+	maxTotalBytes := flag.String("max-total-bytes", "", "Convert at most this much data in a run, e.g. '500G'; the remaining symlinks are deferred to the next run")
+	minFreeSpace := flag.String("min-free-space", "", "Keep at least this much free space on the filesystems of the symlinks, e.g. '50G' (checked before each copy)")
+	flag.StringVar(&opts.lowSpace, "low-space", "abort", "When a copy would go below -min-free-space: 'abort' (stop copying) or 'pause' (wait for free space)")
+	flag.BoolVar(&opts.force, "force", false, "Process the directories even if their filesystem is mounted read-only (the symlinks are left alone and listed)")
+	flag.BoolVar(&opts.skipOpen, "skip-open", false, "Leave the symlinks whose targets are open for writing by another process, and list them at the end")
+	flag.BoolVar(&opts.sandbox, "sandbox", false, "Restrict the process with Landlock (or unveil on OpenBSD) so that nothing outside the directories (and the trash, quarantine or report) can be modified")
+	flag.BoolVar(&opts.sameFSOnly, "same-fs-only", false, "Leave the symlinks whose targets are on a different filesystem than the link, and list them at the end")
+	flag.BoolVar(&opts.nfsSafe, "nfs-safe", false, "Sync copies before renaming them and retry stale NFS file handles (enabled automatically on NFS)")
+	flag.BoolVar(&opts.dockerContext, "docker-context", false, "Prepare a Docker build context: respect .dockerignore and convert only the symlinks leading outside the context")
+	flag.StringVar(&opts.outputDir, "output-dir", "", "Leave the directories untouched and build a copy of them here, with the symlinks materialized")
+	flag.BoolVar(&opts.snapshotBefore, "snapshot-before", false, "Create a read-only snapshot of the btrfs subvolume or ZFS dataset of each directory before modifying anything")
+	flag.BoolVar(&opts.noHistory, "no-history", false, "Do not record the run in the history ($XDG_DATA_HOME/symlink2file/history)")
+	flag.BoolVar(&opts.verifyAfter, "verify-after", false, "After processing, check that each converted file matches the size and checksum of its target")
+	flag.StringVar(&opts.filesFrom, "files-from", "", "Process the symlinks listed in this file ('-' for stdin) instead of walking directories")
+	flag.StringVar(&opts.order, "order", "walk", "Order of the conversions: 'walk' (as the symlinks are found), or after scanning all of them 'sorted' (by path), 'largest-first' or 'smallest-first' (by target size)")
+	flag.IntVar(&opts.jobs, "jobs", 1, "Number of symlinks converted at the same time (their copies run in parallel)")
+	flag.IntVar(&opts.perDirLimit, "per-dir-limit", 0, "With -jobs, maximum number of conversions in progress at the same time in a directory (0: no limit)")
+	flag.BoolVar(&opts.nullData, "0", false, "Paths in --files-from and --print-converted are NUL-separated (implies --print-converted)")
+	flag.BoolVar(&opts.printConverted, "print-converted", false, "Print the paths of the converted files to stdout (messages go to stderr)")
+	flag.StringVar(&opts.outputFormat, "output", "text", "Format of the per-path output: 'text' or 'tsv' (action, path, target, bytes; messages go to stderr)")
+	flag.StringVar(&opts.statusFile, "status-file", "", "Write the state of the run to this JSON file, and its outcome on exit (status, counts, first error), for workflow engines")
+	flag.StringVar(&outputNormalization, "normalize-output", "none", "Unicode normalization of the printed paths: 'none' (as on disk), 'nfc' or 'nfd', to compare outputs of Linux and macOS")
+	flag.StringVar(&opts.summary, "summary", "text", "Format of the final summary: 'text', or 'json' or 'yaml' (a document on stdout; messages go to stderr)")
+	flag.StringVar(&opts.serveAddr, "serve", "", "Run an HTTP API server on this address (e.g. ':8080', on the loopback interface if no host is given) for the given directories")
+	showVersion := flag.Bool("version", false, "Show version information")
+
+	// Usage message
+	flag.Usage = printUsage
+
+	// The completion scripts and the man page are generated from the flags defined above
+	if len(os.Args) > 1 && (os.Args[1] == "completion" || os.Args[1] == "man") {
+		generate := completion
+		if os.Args[1] == "man" {
+			generate = manPage
+		}
+		if err := generate(os.Args[2:], flag.CommandLine); err != nil {
+			coloredPrintf(redColor, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// 'explain PATH' takes the options of a conversion run
+	explain := len(os.Args) > 1 && os.Args[1] == "explain"
+	if explain {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	flag.Parse()
+	applyEnvironment(flag.CommandLine)
+
+	// Handle version flag
+	if *showVersion {
+		fmt.Printf("symlink2file %s\n", version)
+		os.Exit(0)
+	}
+
+	// Validate broken-symlinks flag
+	if len(retargets) > 0 {
+		if opts.action != "convert" && opts.action != "retarget" {
+			fmt.Printf(redColor+"Option -retarget cannot be combined with -action %s\n"+resetColor, opts.action)
+			os.Exit(1)
+		}
+		opts.action = "retarget"
+	}
+	for _, entry := range retargets {
+		separator := strings.Index(entry, "=")
+		if separator <= 0 || separator == len(entry)-1 {
+			fmt.Printf(redColor+"Invalid value for -retarget: %s. Must be 'OLD=NEW'\n"+resetColor, entry)
+			os.Exit(1)
+		}
+		opts.retargets = append(opts.retargets, prefixMapping{
+			from: filepath.Clean(entry[:separator]),
+			to:   filepath.Clean(entry[separator+1:]),
+		})
+	}
+	if opts.action == "retarget" && len(opts.retargets) == 0 {
+		fmt.Printf(redColor + "Option -action retarget requires at least one -retarget OLD=NEW\n" + resetColor)
+		os.Exit(1)
+	}
+	if opts.action != "convert" && opts.action != "absolutize" && opts.action != "relativize" && opts.action != "retarget" {
+		fmt.Printf(redColor+"Invalid value for -action: %s. Must be 'convert', 'absolutize', 'relativize', or 'retarget'\n"+resetColor, opts.action)
+		os.Exit(1)
+	}
+	if opts.relativeRoot != "" {
+		absRoot, err := filepath.Abs(opts.relativeRoot)
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.relativeRoot = absRoot
+	}
+	if opts.maxLinkDepth < 1 {
+		fmt.Printf(redColor+"Invalid value for -max-link-depth: %d. Must be at least 1\n"+resetColor, opts.maxLinkDepth)
+		os.Exit(1)
+	}
+	if opts.order != "walk" && opts.order != "sorted" && opts.order != "largest-first" && opts.order != "smallest-first" {
+		fmt.Printf(redColor+"Invalid value for -order: %s. Must be 'walk', 'sorted', 'largest-first' or 'smallest-first'\n"+resetColor, opts.order)
+		os.Exit(1)
+	}
+	if outputNormalization != "none" && outputNormalization != "nfc" && outputNormalization != "nfd" {
+		fmt.Printf(redColor+"Invalid value for -normalize-output: %s. Must be 'none', 'nfc' or 'nfd'\n"+resetColor, outputNormalization)
+		os.Exit(1)
+	}
+	if opts.jobs < 1 {
+		fmt.Printf(redColor+"Invalid value for -jobs: %d. Must be at least 1\n"+resetColor, opts.jobs)
+		os.Exit(1)
+	}
+	if opts.perDirLimit < 0 {
+		fmt.Printf(redColor+"Invalid value for -per-dir-limit: %d. Must not be negative\n"+resetColor, opts.perDirLimit)
+		os.Exit(1)
+	}
+	if opts.resolve != "full" && opts.resolve != "once" {
+		fmt.Printf(redColor+"Invalid value for -resolve: %s. Must be 'full' or 'once'\n"+resetColor, opts.resolve)
+		os.Exit(1)
+	}
+	if opts.loops != "keep" && opts.loops != "delete" && opts.loops != "report" {
+		fmt.Printf(redColor+"Invalid value for -loops: %s. Must be 'keep', 'delete', or 'report'\n"+resetColor, opts.loops)
+		os.Exit(1)
+	}
+	if opts.loops == "report" && opts.brokenReport == "" {
+		fmt.Printf(redColor + "Option -loops report requires -broken-report\n" + resetColor)
+		os.Exit(1)
+	}
+	if opts.backupBroken != "yes" && opts.backupBroken != "no" {
+		fmt.Printf(redColor+"Invalid value for -backup-broken: %s. Must be 'yes' or 'no'\n"+resetColor, opts.backupBroken)
+		os.Exit(1)
+	}
+	if !validBrokenAction(opts.brokenSymlinks) {
+		fmt.Printf(redColor+"Invalid value for -broken-symlinks: %s. Must be one of: %s\n"+resetColor, opts.brokenSymlinks, strings.Join(brokenActions, ", "))
+		os.Exit(1)
+	}
+	if opts.repairMode != "retarget" && opts.repairMode != "materialize" {
+		fmt.Printf(redColor+"Invalid value for -repair-mode: %s. Must be 'retarget' or 'materialize'\n"+resetColor, opts.repairMode)
+		os.Exit(1)
+	}
+	for _, root := range searchRoots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.searchRoots = append(opts.searchRoots, absRoot)
+	}
+	for _, dir := range restrictTargets {
+		// Targets are compared once fully resolved, so are the allowed directories
+		absDir, err := filepath.Abs(dir)
+		if err == nil {
+			absDir, err = filepath.EvalSymlinks(absDir)
+		}
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -restrict-targets: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.allowed = append(opts.allowed, absDir)
+	}
+	if opts.brokenSymlinks == "repair" && len(opts.searchRoots) == 0 {
+		fmt.Printf(redColor + "Option -broken-symlinks repair requires at least one -search-root\n" + resetColor)
+		os.Exit(1)
+	}
+	if opts.brokenSymlinks == "report" && opts.brokenReport == "" {
+		fmt.Printf(redColor + "Option -broken-symlinks report requires -broken-report FILE\n" + resetColor)
+		os.Exit(1)
+	}
+	if opts.quarantineDir != "" {
+		quarantineDir, err := filepath.Abs(opts.quarantineDir)
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.quarantineDir = quarantineDir
+	}
+	if opts.interval <= 0 {
+		fmt.Printf(redColor+"Invalid value for -interval: %s. Must be positive\n"+resetColor, opts.interval)
+		os.Exit(1)
+	}
+	if opts.statsInterval < 0 {
+		fmt.Printf(redColor+"Invalid value for -stats-interval: %s. Must not be negative\n"+resetColor, opts.statsInterval)
+		os.Exit(1)
+	}
+	if opts.heartbeat < 0 {
+		fmt.Printf(redColor+"Invalid value for -heartbeat: %s. Must not be negative\n"+resetColor, opts.heartbeat)
+		os.Exit(1)
+	}
+
+	// Parse the schedules of individual roots (these roots do not need to be listed as arguments)
+	if len(cronEntries) > 0 && !opts.daemon {
+		fmt.Printf(redColor + "Option -cron can only be used with -daemon\n" + resetColor)
+		os.Exit(1)
+	}
+	opts.cronSchedules = make(map[string]*cronSchedule)
+	var cronRoots []string
+	for _, entry := range cronEntries {
+		separator := strings.LastIndex(entry, "=")
+		if separator <= 0 {
+			fmt.Printf(redColor+"Invalid value for -cron: %s. Must be 'DIR=CRON-EXPRESSION'\n"+resetColor, entry)
+			os.Exit(1)
+		}
+		root, err := filepath.Abs(entry[:separator])
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		schedule, err := parseCron(entry[separator+1:])
+		if err != nil {
+			fmt.Printf(redColor+"Invalid cron expression for %s: %v\n"+resetColor, root, err)
+			os.Exit(1)
+		}
+		opts.cronSchedules[root] = schedule
+		cronRoots = append(cronRoots, root)
+	}
+
+	if opts.serveAddr != "" && flag.NArg() == 0 {
+		fmt.Printf(redColor + "Option -serve requires at least one directory (only directories under them can be converted)\n" + resetColor)
+		os.Exit(1)
+	}
+
+	if opts.filesFrom != "" && flag.NArg() > 0 {
+		fmt.Printf(redColor + "Directories cannot be given together with -files-from\n" + resetColor)
+		os.Exit(1)
+	}
+
+	if opts.outputFormat != "text" && opts.outputFormat != "tsv" {
+		fmt.Printf(redColor+"Invalid value for -output: %s. Must be 'text' or 'tsv'\n"+resetColor, opts.outputFormat)
+		os.Exit(1)
+	}
+	if opts.summary != "text" && opts.summary != "json" && opts.summary != "yaml" {
+		fmt.Printf(redColor+"Invalid value for -summary: %s. Must be 'text', 'json' or 'yaml'\n"+resetColor, opts.summary)
+		os.Exit(1)
+	}
+	if opts.checkFormat != "text" && opts.checkFormat != "github" {
+		fmt.Printf(redColor+"Invalid value for -format: %s. Must be 'text' or 'github'\n"+resetColor, opts.checkFormat)
+		os.Exit(1)
+	}
+	for _, rule := range filters {
+		rules, err := parseFilterRule(rule, "")
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -filter: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.filters = append(opts.filters, rules...)
+	}
+	if opts.preset != "" && opts.preset != "nextflow" && opts.preset != "snakemake" && opts.preset != "nix" && opts.preset != "conda" {
+		fmt.Printf(redColor+"Invalid value for -preset: %s. Must be 'nextflow', 'snakemake', 'nix', or 'conda'\n"+resetColor, opts.preset)
+		os.Exit(1)
+	}
+	if opts.specialFiles != "skip" && opts.specialFiles != "recreate" && opts.specialFiles != "error" {
+		fmt.Printf(redColor+"Invalid value for -special-files: %s. Must be 'skip', 'recreate' or 'error'\n"+resetColor, opts.specialFiles)
+		os.Exit(1)
+	}
+	if *chmodSpec != "" {
+		clauses, err := parseModeClauses(*chmodSpec)
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -chmod: %s. Must be an octal mode such as '0644' or symbolic such as 'u+rw,go-w'\n"+resetColor, *chmodSpec)
+			os.Exit(1)
+		}
+		opts.chmod = clauses
+	}
+	if opts.unquarantine && runtime.GOOS != "darwin" {
+		fmt.Printf(redColor + "Option -strip-quarantine is only available on macOS\n" + resetColor)
+		os.Exit(1)
+	}
+	if *secure {
+		opts.stripSpecial = true
+	}
+	if *archive {
+		*preserve = "all"
+	}
+	if err := parsePreserve(*preserve, opts); err != nil {
+		fmt.Printf(redColor+"Invalid value for -preserve: %v. Must be a list of 'mode', 'timestamps', 'ownership', 'xattr', 'links', 'sparse' or 'all'\n"+resetColor, err)
+		os.Exit(1)
+	}
+	if opts.respectUmask || !opts.preserveMode {
+		opts.umask = currentUmask()
+	}
+	if opts.times != "target" && opts.times != "link" && opts.times != "now" {
+		fmt.Printf(redColor+"Invalid value for -times: %s. Must be 'target', 'link' or 'now'\n"+resetColor, opts.times)
+		os.Exit(1)
+	}
+	// Hard links share the mode and times of their target, so the conda default falls back to copies
+	// when these are changed, and an explicit -link-mode hardlink is refused
+	overrides := attributeOverrides(opts)
+	if opts.linkMode == "" {
+		opts.linkMode = "copy"
+		if opts.preset == "conda" && len(overrides) == 0 {
+			opts.linkMode = "hardlink"
+		}
+	}
+	if opts.linkMode == "hardlink" && len(overrides) > 0 {
+		fmt.Printf(redColor+"Option -link-mode hardlink cannot be combined with %s (hard links keep the mode and times of their target)\n"+resetColor,
+			strings.Join(overrides, ", "))
+		os.Exit(1)
+	}
+	if *maxFileSize != "" {
+		size, err := parseSize(*maxFileSize)
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -max-file-size: %s. Must be a size such as '500M' or '50G'\n"+resetColor, *maxFileSize)
+			os.Exit(1)
+		}
+		opts.maxFileSize = size
+	}
+	if *maxTotalBytes != "" {
+		size, err := parseSize(*maxTotalBytes)
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -max-total-bytes: %s. Must be a size such as '500M' or '50G'\n"+resetColor, *maxTotalBytes)
+			os.Exit(1)
+		}
+		opts.maxTotalBytes = size
+	}
+	if *minFreeSpace != "" {
+		size, err := parseSize(*minFreeSpace)
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -min-free-space: %s. Must be a size such as '500M' or '50G'\n"+resetColor, *minFreeSpace)
+			os.Exit(1)
+		}
+		opts.minFreeSpace = size
+	}
+	if opts.lowSpace != "abort" && opts.lowSpace != "pause" {
+		fmt.Printf(redColor+"Invalid value for -low-space: %s. Must be 'abort' or 'pause'\n"+resetColor, opts.lowSpace)
+		os.Exit(1)
+	}
+	if opts.linkMode != "copy" && opts.linkMode != "hardlink" {
+		fmt.Printf(redColor+"Invalid value for -link-mode: %s. Must be 'copy' or 'hardlink'\n"+resetColor, opts.linkMode)
+		os.Exit(1)
+	}
+	if len(storeDirs) > 0 && opts.preset != "nix" {
+		fmt.Printf(redColor + "Option -store-dir can only be used with -preset nix\n" + resetColor)
+		os.Exit(1)
+	}
+	if opts.preset == "nix" {
+		opts.storeDirs = []string{"/nix/store", "/gnu/store"}
+		if len(storeDirs) > 0 {
+			opts.storeDirs = nil
+			for _, dir := range storeDirs {
+				opts.storeDirs = append(opts.storeDirs, filepath.Clean(dir))
+			}
+		}
+	}
+
+	// Options that cannot be used together, or (with options listed in with) cannot be combined with any of those
+	type usedOption struct {
+		name string
+		set  bool
+	}
+	var (
+		copyCache    = usedOption{"-copy-cache", opts.copyCache != ""}
+		dedupStore   = usedOption{"-dedup-store", opts.dedupStore != ""}
+		interactive  = usedOption{"-interactive", opts.interactive}
+		tui          = usedOption{"-tui", opts.tui}
+		daemon       = usedOption{"-daemon", opts.daemon}
+		serve        = usedOption{"-serve", opts.serveAddr != ""}
+		filesFrom    = usedOption{"-files-from", opts.filesFrom != ""}
+		check        = usedOption{"-check", opts.check}
+		audit        = usedOption{"-audit", opts.audit}
+		diff         = usedOption{"-diff", opts.diff}
+		outputDir    = usedOption{"-output-dir", opts.outputDir != ""}
+		crossFSOnly  = usedOption{"-cross-fs-only", opts.crossFSOnly}
+		sameFSOnly   = usedOption{"-same-fs-only", opts.sameFSOnly}
+		jobs         = usedOption{"-jobs", opts.jobs > 1}
+		cron         = usedOption{"-cron", len(cronRoots) > 0}
+		action       = usedOption{"-action", opts.action != "convert"}
+		sandbox      = usedOption{"-sandbox", opts.sandbox}
+		printPaths   = usedOption{"-print-converted (or -0)", opts.printConverted}
+		outputFormat = usedOption{"-output", opts.outputFormat != "text"}
+	)
+	for _, conflict := range []struct {
+		options []usedOption
+		with    []usedOption
+	}{
+		{options: []usedOption{copyCache, dedupStore}},
+		{options: []usedOption{interactive, tui}},
+		{options: []usedOption{jobs}, with: []usedOption{interactive, tui}},
+		{options: []usedOption{daemon}, with: []usedOption{interactive, tui}},
+		{options: []usedOption{serve}, with: []usedOption{daemon, interactive, tui}},
+		{options: []usedOption{filesFrom}, with: []usedOption{daemon, tui, cron, serve}},
+		{options: []usedOption{audit, check, diff}},
+		{options: []usedOption{check, audit, diff}, with: []usedOption{daemon, interactive, tui, serve, filesFrom}},
+		{options: []usedOption{crossFSOnly, sameFSOnly}},
+		{options: []usedOption{outputDir}, with: []usedOption{check, audit, diff, daemon, interactive, tui, serve, filesFrom, action}},
+		{options: []usedOption{sandbox}, with: []usedOption{daemon, serve, outputDir, filesFrom}},
+		{options: []usedOption{printPaths, outputFormat}},
+	} {
+		var names, withNames []string
+		used, usedWith := 0, 0
+		for _, option := range conflict.options {
+			names = append(names, option.name)
+			if option.set {
+				used++
+			}
+		}
+		for _, option := range conflict.with {
+			withNames = append(withNames, option.name)
+			if option.set {
+				usedWith++
+			}
+		}
+		switch {
+		case conflict.with == nil && used > 1:
+			fmt.Printf(redColor+"Options %s cannot be used together\n"+resetColor, joinNames(names, "and"))
+		case conflict.with != nil && used > 0 && usedWith > 0:
+			noun := "Option"
+			if len(names) > 1 {
+				noun = "Options"
+			}
+			fmt.Printf(redColor+"%s %s cannot be combined with %s\n"+resetColor, noun, joinNames(names, "and"), joinNames(withNames, "or"))
+		default:
+			continue
+		}
+		os.Exit(1)
+	}
+	if opts.copyCache != "" {
+		copyCache, err := filepath.Abs(opts.copyCache)
+		if err == nil {
+			err = os.MkdirAll(copyCache, 0755)
+		}
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -copy-cache: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.copyCache = copyCache
+	}
+	if opts.dedupStore != "" {
+		dedupStore, err := filepath.Abs(opts.dedupStore)
+		if err == nil {
+			err = os.MkdirAll(dedupStore, 0755)
+		}
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -dedup-store: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.dedupStore = dedupStore
+	}
+
+	if *runAs != "" {
+		if os.Geteuid() != 0 {
+			fmt.Printf(redColor + "Option -run-as requires starting as root\n" + resetColor)
+			os.Exit(1)
+		}
+		creds, err := parseRunAs(*runAs)
+		if err != nil {
+			fmt.Printf(redColor+"Invalid value for -run-as: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		opts.runAs = creds
+	}
+
+	// With the results on stdout, the messages go to stderr
+	if opts.nullData {
+		opts.printConverted = true
+	}
+	if opts.printConverted || opts.outputFormat != "text" || opts.summary != "text" {
+		output = os.Stderr
+	}
+
+	// Target directories default to the current one
+	args := flag.Args()
+	if explain {
+		if len(args) != 1 || opts.check || opts.audit || opts.diff || opts.daemon || opts.tui || opts.serveAddr != "" ||
+			opts.filesFrom != "" || opts.outputDir != "" || len(cronRoots) > 0 {
+			fmt.Printf(redColor + "Usage: symlink2file explain [options] <path>\n" + resetColor)
+			os.Exit(1)
+		}
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		// The path is explained as part of a run on the current directory, or else on its own directory
+		opts.explain = path
+		args = []string{"."}
+		if workDir, err := os.Getwd(); err != nil || !underAnyRoot(filepath.Dir(path), []string{workDir}) {
+			args = []string{filepath.Dir(path)}
+		}
+	}
+	if len(args) == 0 && len(cronRoots) == 0 && opts.serveAddr == "" && opts.filesFrom == "" {
+		args = []string{"."}
+	}
+
+	// Expand glob patterns (for shells that do not, or when the expanded list would be too long)
+	args, err := expandGlobs(args)
+	if err != nil {
+		fmt.Printf(redColor+"%v\n"+resetColor, err)
+		os.Exit(1)
+	}
+
+	// Convert to absolute paths
+	for _, arg := range args {
+		targetDir, err := filepath.Abs(arg)
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		if opts.cronSchedules[targetDir] == nil {
+			opts.roots = append(opts.roots, targetDir)
+		}
+	}
+	opts.roots = append(opts.roots, cronRoots...)
+
+	if opts.outputDir != "" {
+		outputDir, err := filepath.Abs(opts.outputDir)
+		if err != nil {
+			fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
+			os.Exit(1)
+		}
+		if underAnyRoot(outputDir, opts.roots) {
+			fmt.Printf(redColor + "The -output-dir cannot be inside a processed directory\n" + resetColor)
+			os.Exit(1)
+		}
+		opts.outputDir = outputDir
+	}
+
+	return opts
+}
+
+// Join option names as in a sentence, e.g. "-a, -b or -c" with the conjunction "or"
+func joinNames(names []string, conjunction string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " " + conjunction + " " + names[len(names)-1]
+}
+
+// Expand the arguments containing glob patterns into the matching directories
+// Arguments without patterns are kept as they are
+func expandGlobs(args []string) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		var dirs []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				dirs = append(dirs, match)
+			}
+		}
+		if len(dirs) == 0 {
+			return nil, fmt.Errorf("no directories match %q", arg)
+		}
+		expanded = append(expanded, dirs...)
+	}
+	return expanded, nil
+}
+
+// Prefix of the environment variables overriding the flag defaults
+const envPrefix = "SYMLINK2FILE_"
+
+// Set the flags that were not given on the command line from SYMLINK2FILE_* environment variables
+// (e.g., SYMLINK2FILE_NO_BACKUP=true for -no-backup), so command-line flags take precedence
+func applyEnvironment(flags *flag.FlagSet) {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || len(f.Name) == 1 || f.Name == "version" {
+			return
+		}
+		envName := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			fmt.Printf(redColor+"Invalid value for %s: %v\n"+resetColor, envName, err)
+			os.Exit(1)
+		}
+	})
+}
+
+// Parse a size in bytes with an optional binary unit suffix (e.g., 512K, 10G, 1.5T)
+func parseSize(value string) (int64, error) {
+	text := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	multiplier := 1.0
+	if n := len(text); n > 0 {
+		if unit := strings.IndexByte("KMGT", text[n-1]); unit >= 0 {
+			multiplier = float64(int64(1) << (10 * (unit + 1)))
+			text = text[:n-1]
+		}
+	}
+	size, err := strconv.ParseFloat(text, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * multiplier), nil
+}
+
+// Flag accepting multiple values (the flag can be repeated)
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,65 @@
+#!/usr/bin/env python3
+"""Generate norm_tables.go: the Unicode data of the canonical normalization forms (NFC and NFD) used by norm.go.
+
+The Go standard library has no normalization tables, and symlink2file does not depend on golang.org/x/text,
+so the tables are taken from the unicodedata module of Python (its Unicode version is recorded in the output).
+Run with `go generate` (or `python3 gen_norm_tables.py | gofmt > norm_tables.go`).
+"""
+
+import sys
+import unicodedata
+
+HANGUL_FIRST, HANGUL_LAST = 0xAC00, 0xD7A3  # Hangul syllables are decomposed algorithmically (see norm.go)
+
+
+def canonical(code):
+    """Canonical decomposition mapping of a code point, or None (compatibility mappings are tagged with <...>)"""
+    mapping = unicodedata.decomposition(chr(code))
+    if not mapping or mapping.startswith("<"):
+        return None
+    return [int(part, 16) for part in mapping.split()]
+
+
+def escape(codes):
+    return "".join("\\U%08X" % code if code > 0xFFFF else "\\u%04X" % code for code in codes)
+
+
+def main():
+    decompositions, classes, compositions = [], [], []
+    for code in range(0x110000):
+        if 0xD800 <= code <= 0xDFFF or HANGUL_FIRST <= code <= HANGUL_LAST:
+            continue
+        char = chr(code)
+        if unicodedata.combining(char):
+            classes.append((code, unicodedata.combining(char)))
+        mapping = canonical(code)
+        if mapping is None:
+            continue
+        decompositions.append((code, [ord(c) for c in unicodedata.normalize("NFD", char)]))
+        # Primary composites: pairs recomposed by NFC (not singletons, non-starters or composition exclusions)
+        if len(mapping) == 2 and unicodedata.normalize("NFC", char) == char:
+            compositions.append((mapping, code))
+
+    out = sys.stdout
+    out.write("// Code generated by gen_norm_tables.py from the Unicode %s data of Python's unicodedata; DO NOT EDIT.\n\n"
+              % unicodedata.unidata_version)
+    out.write("package main\n\n")
+    out.write("// Full canonical decompositions (NFD) of the code points having one, except the Hangul syllables\n")
+    out.write("var canonicalDecompositions = map[rune]string{\n")
+    for code, codes in decompositions:
+        out.write('\t0x%04X: "%s",\n' % (code, escape(codes)))
+    out.write("}\n\n")
+    out.write("// Canonical combining classes of the code points not in class 0\n")
+    out.write("var combiningClasses = map[rune]uint8{\n")
+    for code, value in classes:
+        out.write("\t0x%04X: %d,\n" % (code, value))
+    out.write("}\n\n")
+    out.write("// Primary composites by the pair of code points they are recomposed from, except the Hangul syllables\n")
+    out.write("var canonicalCompositions = map[[2]rune]rune{\n")
+    for (first, second), code in compositions:
+        out.write("\t{0x%04X, 0x%04X}: 0x%04X,\n" % (first, second, code))
+    out.write("}\n")
+
+
+if __name__ == "__main__":
+    main()
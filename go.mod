@@ -0,0 +1,3 @@
+module github.com/vmikk/symlink2file
+
+go 1.21
@@ -0,0 +1,300 @@
+package main
+
+// History of the runs and their undo (history, undo)
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Run recorded in the history, under $XDG_DATA_HOME/symlink2file/history: a summary (ID.json),
+// written when the run ends, and the per-path results (ID.tsv, as with -output tsv), written as the run goes
+type historyRun struct {
+	ID       string         `json:"id"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Args     []string       `json:"args"`
+	Roots    []string       `json:"roots"`
+	Status   string         `json:"status"` // success, partial (some paths could not be read or converted) or failure
+	Actions  map[string]int `json:"actions"`
+	Bytes    int64          `json:"bytes"`
+	Failures []string       `json:"failures,omitempty"`
+
+	summary *os.File
+	paths   *os.File
+}
+
+// Data directory of the user ($XDG_DATA_HOME, or ~/.local/share)
+func dataHome() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// Directory of the run history
+func historyDir() (string, error) {
+	dir, err := dataHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "symlink2file", "history"), nil
+}
+
+// Create the files of a new run in the history (before the sandbox or -run-as, which could prevent it)
+// The run ID is its start time, with a suffix if several runs started within the same second
+func startHistory(opts *options) (*historyRun, error) {
+	dir, err := historyDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	run := &historyRun{Started: opts.stats.started, Args: os.Args[1:], Roots: opts.roots}
+	for n := 1; ; n++ {
+		run.ID = opts.stats.started.Format("20060102-150405")
+		if n > 1 {
+			run.ID += "-" + strconv.Itoa(n)
+		}
+		run.summary, err = os.OpenFile(filepath.Join(dir, run.ID+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if run.paths, err = os.OpenFile(filepath.Join(dir, run.ID+".tsv"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		run.summary.Close()
+		return nil, err
+	}
+	return run, nil
+}
+
+// Write the summary of a run to the history
+func (run *historyRun) finish(opts *options, status string, failures []string) error {
+	run.Finished = time.Now()
+	run.Status = status
+	run.Actions = opts.stats.actions
+	run.Bytes = opts.stats.bytes
+	run.Failures = failures
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err == nil {
+		_, err = run.summary.Write(append(data, '\n'))
+	}
+	if closeErr := run.summary.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := run.paths.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read the runs recorded in the history, oldest first
+// Runs without a summary (still running, or interrupted) have the status 'unfinished'
+func loadHistory() ([]*historyRun, error) {
+	dir, err := historyDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var runs []*historyRun
+	for _, file := range files {
+		run := &historyRun{ID: strings.TrimSuffix(filepath.Base(file), ".json"), Status: "unfinished"}
+		if data, err := os.ReadFile(file); err == nil && len(data) > 0 {
+			if err := json.Unmarshal(data, run); err != nil {
+				return nil, fmt.Errorf("invalid history record %s: %w", file, err)
+			}
+		} else if len(run.ID) >= 15 {
+			run.Started, _ = time.ParseInLocation("20060102-150405", run.ID[:15], time.Local)
+		}
+		runs = append(runs, run)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs, nil
+}
+
+// Find a run of the history by its ID, or the most recent one for 'last'
+func findHistoryRun(id string) (*historyRun, error) {
+	runs, err := loadHistory()
+	if err != nil {
+		return nil, err
+	}
+	if id == "last" && len(runs) > 0 {
+		return runs[len(runs)-1], nil
+	}
+	for _, run := range runs {
+		if run.ID == id {
+			return run, nil
+		}
+	}
+	return nil, fmt.Errorf("no run %q in the history", id)
+}
+
+// List the runs of the history, or print the results of one of them:
+//   - history             one line per run (start time, status, converted symlinks, bytes copied, directories)
+//   - history show <id>   the summary of the run (on stderr) and the result of each path (tab-separated, on stdout)
+func history(args []string) error {
+	if len(args) == 0 {
+		runs, err := loadHistory()
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			fmt.Println("No runs recorded yet")
+			return nil
+		}
+		coloredPrintf(headerColor, "%-20s %-19s %-10s %9s %10s  %s\n", "ID", "STARTED", "STATUS", "CONVERTED", "COPIED", "DIRECTORIES")
+		for _, run := range runs {
+			fmt.Printf("%-20s %-19s %-10s %9d %10s  %s\n", run.ID, run.Started.Local().Format("2006-01-02 15:04:05"), run.Status,
+				run.Actions["converted"], formatBytes(run.Bytes), displayPath(strings.Join(run.Roots, ", ")))
+		}
+		return nil
+	}
+	if args[0] != "show" || len(args) != 2 {
+		return errors.New("usage: symlink2file history [show <id|last>]")
+	}
+
+	run, err := findHistoryRun(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Run %s: %s\n", run.ID, run.Status)
+	fmt.Fprintf(os.Stderr, "  Started:     %s\n", run.Started.Local().Format(time.RFC3339))
+	if !run.Finished.IsZero() {
+		fmt.Fprintf(os.Stderr, "  Finished:    %s (%s)\n", run.Finished.Local().Format(time.RFC3339), run.Finished.Sub(run.Started).Round(time.Millisecond))
+	}
+	fmt.Fprintf(os.Stderr, "  Arguments:   %s\n", displayPath(strings.Join(run.Args, " ")))
+	actions := make([]string, 0, len(run.Actions))
+	for action, count := range run.Actions {
+		actions = append(actions, fmt.Sprintf("%s %d", action, count))
+	}
+	sort.Strings(actions)
+	fmt.Fprintf(os.Stderr, "  Actions:     %s (%s copied)\n", strings.Join(actions, ", "), formatBytes(run.Bytes))
+	for _, failure := range run.Failures {
+		fmt.Fprintf(os.Stderr, "  Failure:     %s\n", failure)
+	}
+
+	dir, err := historyDir()
+	if err != nil {
+		return err
+	}
+	paths, err := os.Open(filepath.Join(dir, run.ID+".tsv"))
+	if err != nil {
+		return err
+	}
+	defer paths.Close()
+	_, err = io.Copy(os.Stdout, paths)
+	return err
+}
+
+// Revert the conversions of a run of the history: each converted path becomes the symlink it was again,
+// from its backup if it is still there (with its original owner and times), or recreated from the recorded destination
+// Paths changed since the run (no longer the converted file, or modified afterwards) are left alone and listed
+func undo(args []string) error {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	runID := flags.String("run", "", "ID of the run to revert, or 'last' for the most recent one (required)")
+	dryRun := flags.Bool("dry-run", false, "Only print the symlinks that would be restored")
+	flags.Parse(args)
+	if *runID == "" || flags.NArg() > 0 {
+		return errors.New("usage: symlink2file undo --run <id|last> [--dry-run]")
+	}
+	run, err := findHistoryRun(*runID)
+	if err != nil {
+		return err
+	}
+	dir, err := historyDir()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, run.ID+".tsv"))
+	if err != nil {
+		return err
+	}
+
+	// The conversions are reverted in the reverse order
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	restored := 0
+	var leftAlone []string
+	for i := len(lines) - 1; i >= 0; i-- {
+		fields := strings.Split(lines[i], "\t")
+		if len(fields) < 6 || fields[0] != "converted" || fields[4] == "" {
+			continue
+		}
+		path, linkDest, backupPath := unescapeTSV(fields[1]), unescapeTSV(fields[4]), unescapeTSV(fields[5])
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+
+		info, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			leftAlone = append(leftAlone, displayPath(path)+" ("+err.Error()+")")
+			continue
+		case info.Mode()&os.ModeSymlink != 0 || info.IsDir():
+			leftAlone = append(leftAlone, displayPath(path)+" (no longer the converted file)")
+			continue
+		case info.Mode().IsRegular() && (info.Size() != size || (!run.Finished.IsZero() && info.ModTime().After(run.Finished))):
+			leftAlone = append(leftAlone, displayPath(path)+" (modified since the run)")
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("Would restore %s -> %s\n", displayPath(path), displayPath(linkDest))
+			restored++
+			continue
+		}
+
+		// The symlink takes the place of the file atomically
+		source := backupPath
+		if dest, err := os.Readlink(backupPath); backupPath == "" || err != nil || dest != linkDest {
+			source = filepath.Join(filepath.Dir(path), fmt.Sprintf(".tmp-%d-%s", os.Getpid(), filepath.Base(path)))
+			if err := os.Symlink(linkDest, source); err != nil {
+				leftAlone = append(leftAlone, displayPath(path)+" ("+err.Error()+")")
+				continue
+			}
+		}
+		if err := os.Rename(source, path); err != nil {
+			if source != backupPath {
+				os.Remove(source)
+			}
+			leftAlone = append(leftAlone, displayPath(path)+" ("+err.Error()+")")
+			continue
+		}
+		if source == backupPath {
+			os.Remove(filepath.Dir(backupPath)) // Only if no other backup is left
+		}
+		fmt.Fprintln(output, "Symlink restored:", displayPath(path))
+		restored++
+	}
+
+	verb := "restored"
+	if *dryRun {
+		verb = "would be restored"
+	}
+	coloredPrintf(greenColor, "Undo of run %s: %d symlinks %s.\n", run.ID, restored, verb)
+	if len(leftAlone) > 0 {
+		coloredPrintf(redColor, "%d converted paths were left alone:\n", len(leftAlone))
+		for _, path := range leftAlone {
+			fmt.Fprintln(output, "  "+path)
+		}
+		return fmt.Errorf("%d paths could not be restored", len(leftAlone))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+// External programs called during a run: the hooks (-pre-hook, -post-hook, -file-hook) and the decider (-decider)
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Run a user-provided shell command with additional environment variables
+// The output of the command is passed through to the terminal
+func runHook(command string, env ...string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %q: %w", command, err)
+	}
+	return nil
+}
+
+// Symlink description sent to the decider command
+type deciderInput struct {
+	Path   string `json:"path"`
+	Target string `json:"target"` // Resolved target, or the link text for broken symlinks
+	Size   int64  `json:"size"`   // Size of the target (0 for broken symlinks)
+	Broken bool   `json:"broken"`
+}
+
+// Ask the external decider command what to do with a symlink
+// The command receives a JSON object on stdin and must print 'convert', 'skip', or 'delete'
+func runDecider(command, path, resolvedPath string, broken bool) (string, error) {
+	input := deciderInput{Path: path, Target: resolvedPath, Broken: broken}
+	if broken {
+		input.Target, _ = readlinkLong(path)
+	} else if info, err := statLong(resolvedPath); err == nil {
+		input.Size = info.Size()
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	switch decision := strings.TrimSpace(string(out)); decision {
+	case "convert", "skip", "delete":
+		return decision, nil
+	default:
+		return "", fmt.Errorf("unexpected decision %q (expected 'convert', 'skip' or 'delete')", decision)
+	}
+}
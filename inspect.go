@@ -0,0 +1,404 @@
+package main
+
+// Read-only modes: -check, -diff, -audit and the explain subcommand
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Report every symlink under the roots without modifying anything
+// Returns the number of symlinks found
+func runCheck(opts *options) (int, error) {
+	workDir, err := os.Getwd()
+	if err != nil {
+		return 0, err
+	}
+
+	found := 0
+	for _, root := range opts.roots {
+		opts.targetDir = root
+		err := walkOrdered(opts, 1, func(path string, opts *options) error {
+			found++
+			target, _ := os.Readlink(path)
+			relPath, err := filepath.Rel(workDir, path)
+			if err != nil {
+				relPath = path
+			}
+
+			if opts.checkFormat == "github" {
+				fmt.Printf("::error file=%s,title=Symlink found::%s is a symlink to %s\n",
+					escapeGitHubProperty(relPath), escapeGitHubData(relPath), escapeGitHubData(target))
+			} else {
+				coloredPrintf(redColor, "Symlink found: "+resetColor+"%s -> %s\n", relPath, target)
+			}
+			return nil
+		})
+		if err != nil {
+			return found, err
+		}
+	}
+
+	if opts.checkFormat != "github" {
+		if found > 0 {
+			coloredPrintf(redColor, "Found %d symlinks.\n", found)
+		} else {
+			coloredPrintf(greenColor, "No symlinks found.\n")
+		}
+	}
+	return found, nil
+}
+
+// Print how the tree would change, without modifying anything:
+// removed entries are prefixed with '-', created entries with '+' (paths are relative to the root)
+func runDiff(opts *options) error {
+	for _, root := range opts.roots {
+		opts.targetDir = root
+		fmt.Printf("--- %s (current)\n+++ %s (planned)\n", root, root)
+		err := walkOrdered(opts, 1, func(path string, opts *options) error {
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				relPath = path
+			}
+			linkDest, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %q: %w", path, err)
+			}
+			backupPath := filepath.Join(filepath.Dir(relPath), ".symlink2file", filepath.Base(relPath))
+
+			info, err := os.Stat(path)
+			if err != nil && (opts.brokenSymlinks == "keep" || opts.brokenSymlinks == "report") {
+				return nil
+			}
+			if err == nil && !info.Mode().IsRegular() {
+				fmt.Printf("! symlink %s -> %s (target is not a regular file)\n", relPath, linkDest)
+				return nil
+			}
+
+			fmt.Printf("- symlink %s -> %s\n", relPath, linkDest)
+			if err == nil {
+				fmt.Printf("+ file    %s (%s)\n", relPath, formatBytes(info.Size()))
+			} else if opts.brokenSymlinks == "placeholder" {
+				fmt.Printf("+ file    %s (placeholder)\n", relPath)
+			}
+			if err != nil && opts.brokenSymlinks == "trash" {
+				fmt.Printf("  (moved to trash)\n")
+			} else if err != nil && opts.brokenSymlinks == "repair" {
+				fmt.Printf("  (repaired if a single candidate is found under the search roots)\n")
+			} else if (err == nil && !opts.noBackup) || (err != nil && opts.backupBroken == "yes") {
+				fmt.Printf("+ symlink %s -> %s\n", backupPath, linkDest)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print what a conversion run would do with a single path and why, without modifying anything:
+// the symlink chain, the rule deciding its fate (filters, configs, broken and loop handling, checks on the target),
+// then for a conversion the copy strategy, the backup and the bytes written
+// The checks follow the order of walkSymlinks and processPath; the root is the first directory given to them
+func runExplain(opts *options) error {
+	path, root := opts.explain, opts.roots[0]
+	opts.targetDir = root
+	row := func(name, format string, a ...any) {
+		fmt.Printf("  %-10s %s\n", name+":", fmt.Sprintf(format, a...))
+	}
+	decision := func(format string, a ...any) error {
+		coloredPrintf(greenColor, "  Decision:  "+resetColor+format+"\n", a...)
+		return nil
+	}
+
+	coloredPrintf(headerColor, "%s\n", path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return decision("left as it is (not a symlink)")
+	}
+	linkDest, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	row("Symlink", "-> %s", linkDest)
+	row("Root", "%s", displayPath(root))
+
+	// Walk: filters, .dockerignore, skipped directories and per-directory configs, from the root down to the symlink
+	relPath, _ := filepath.Rel(root, path)
+	segments := strings.Split(relPath, string(filepath.Separator))
+	var ignore *dockerIgnore
+	if opts.dockerContext {
+		if ignore, err = loadDockerIgnore(root); err != nil {
+			return err
+		}
+	}
+	localOpts, dir := opts, root
+	for i, segment := range segments {
+		rel := filepath.Join(segments[:i+1]...)
+		isDir := i < len(segments)-1
+		if len(opts.filters) > 0 && filterExcludes(opts.filters, rel, isDir) {
+			return decision("left alone (excluded by --filter: %s)", rel)
+		}
+		if ignore != nil && ignore.matches(rel) && (!isDir || !ignore.hasExceptions()) {
+			return decision("left alone (ignored by .dockerignore: %s)", rel)
+		}
+		if !isDir {
+			break
+		}
+		if segment == ".symlink2file" {
+			return decision("left alone (backup of a replaced symlink)")
+		}
+		if opts.noRecurse {
+			return decision("left alone (in a subdirectory, with --no-recurse)")
+		}
+		if opts.preset == "snakemake" && segment == ".snakemake" {
+			return decision("left alone (Snakemake metadata directory)")
+		}
+		if localOpts, err = loadDirConfig(dir, localOpts); err != nil {
+			return err
+		}
+		if localOpts.skip {
+			return decision("left alone (skipped by the config file of %s)", displayPath(dir))
+		}
+		dir = filepath.Join(dir, segment)
+	}
+	if localOpts, err = loadDirConfig(dir, localOpts); err != nil {
+		return err
+	}
+	if localOpts.skip {
+		return decision("left alone (skipped by the config file of %s)", displayPath(dir))
+	}
+	for _, pattern := range localOpts.exclude {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return decision("left alone (excluded by the pattern %q of a config file)", pattern)
+		}
+	}
+	opts = localOpts
+	if opts.action != "convert" {
+		return decision("link rewritten in place with --action %s (no data copied)", opts.action)
+	}
+
+	// Chain of links, and what happens to broken symlinks and loops
+	hops, chainErr := linkChain(path, opts.maxLinkDepth)
+	if len(hops) > 1 {
+		row("Chain", "%s -> %s (%d links)", displayPath(path), displayPath(strings.Join(hops, " -> ")), len(hops))
+	}
+	switch {
+	case opts.resolve == "once" && len(hops) > 1 && !errors.Is(chainErr, syscall.ELOOP):
+		return decision("replaced with a copy of the next link, %s (--resolve once)", displayPath(hops[0]))
+	case errors.Is(chainErr, errLinkDepth):
+		return decision("left alone (chain longer than %d links, see --max-link-depth)", opts.maxLinkDepth)
+	case errors.Is(chainErr, syscall.ELOOP):
+		if opts.loops == "delete" {
+			return decision("symlink loop, removed (--loops delete)")
+		}
+		return decision("symlink loop, kept (--loops %s)", opts.loops)
+	}
+	resolvedPath, err := evalSymlinksNormalized(path, opts.maxLinkDepth)
+	if err != nil {
+		row("Target", "%s (missing)", displayPath(hops[len(hops)-1]))
+		switch opts.brokenSymlinks {
+		case "delete":
+			return decision("broken symlink, removed (--broken-symlinks delete)")
+		case "trash":
+			return decision("broken symlink, moved to the trash (--broken-symlinks trash)")
+		case "placeholder":
+			return decision("broken symlink, replaced with a placeholder file (--broken-symlinks placeholder)")
+		case "repair":
+			candidate, err := findRepairCandidate(opts, linkDest)
+			if err != nil {
+				return err
+			}
+			if candidate == "" {
+				return decision("broken symlink, kept (no single repair candidate under the search roots)")
+			}
+			return decision("broken symlink, repaired from %s (--repair-mode %s)", displayPath(candidate), opts.repairMode)
+		}
+		return decision("broken symlink, kept (--broken-symlinks %s)", opts.brokenSymlinks)
+	}
+	targetInfo, err := os.Stat(resolvedPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case targetInfo.IsDir():
+		row("Target", "%s (directory)", displayPath(resolvedPath))
+		return decision("reported as an error (only symlinks to regular files can be converted)")
+	case targetInfo.Mode()&(os.ModeNamedPipe|os.ModeDevice|os.ModeSocket) != 0:
+		row("Target", "%s (%s)", displayPath(resolvedPath), targetInfo.Mode().Type())
+		switch opts.specialFiles {
+		case "recreate":
+			return decision("replaced with a new %s (--special-files recreate)", targetInfo.Mode().Type())
+		case "error":
+			return decision("reported as an error (--special-files error)")
+		}
+		return decision("left alone (--special-files skip)")
+	}
+	row("Target", "%s (regular file, %s)", displayPath(resolvedPath), formatBytes(targetInfo.Size()))
+
+	// Checks on the target and the directory of the symlink
+	if reason := leaveAlone(path, resolvedPath, opts); reason != "" {
+		return decision("left alone (%s)", reason)
+	}
+	if readOnlyDirectory(filepath.Dir(path)) {
+		return decision("left alone (read-only directory)")
+	}
+	if err := checkWritable(filepath.Dir(path)); err != nil {
+		return decision("fails (the directory is not writable: %v)", err)
+	}
+	if opts.maxTotalBytes > 0 && targetInfo.Size() > opts.maxTotalBytes {
+		return decision("deferred (larger than --max-total-bytes %s)", formatBytes(opts.maxTotalBytes))
+	}
+	if opts.decider != "" {
+		row("Decider", "%s is asked first (not run by explain)", opts.decider)
+	}
+	if opts.interactive {
+		row("Prompt", "confirmation asked before the replacement (-i)")
+	}
+
+	// How the copy is made
+	size := targetInfo.Size()
+	if allocated, ok := allocatedSize(targetInfo); ok && opts.preserveSparse && allocated < size {
+		size = allocated // Holes are not written
+	}
+	dirInfo, _ := os.Stat(filepath.Dir(path))
+	caps := probeDirectory(filepath.Dir(path))
+	var strategy string
+	switch {
+	case opts.linkMode == "hardlink" && !opts.verifyAfter && dirInfo != nil && sameDevice(dirInfo, targetInfo):
+		strategy, size = "hard link to the target (--link-mode hardlink)", 0
+	case checksumStore(opts) != "" && !opts.verifyAfter:
+		entry, err := cacheEntry(checksumStore(opts), resolvedPath)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(entry); err == nil {
+			strategy, size = fmt.Sprintf("reflink or hard link of the cached copy %s", displayPath(entry)), 0
+			if opts.dedupStore != "" {
+				strategy = fmt.Sprintf("hard link to the stored copy %s", displayPath(entry))
+			}
+		} else {
+			strategy = fmt.Sprintf("copy of the target, then added to the cache as %s", displayPath(entry))
+		}
+	case caps.rename:
+		strategy = "copy written to a temporary file, renamed over the symlink"
+	default:
+		strategy = "copy written in place of the symlink (renames unsupported here)"
+	}
+	if opts.linkMode == "hardlink" && strings.HasPrefix(strategy, "copy") {
+		strategy += " (a hard link is impossible across filesystems)"
+	}
+	if opts.verifyAfter {
+		strategy += ", verified by checksum after the run"
+	}
+	row("Strategy", "%s", strategy)
+
+	backup := !opts.noBackup && caps.symlinks
+	switch {
+	case opts.noBackup:
+		row("Backup", "none (--no-backup)")
+	case !backup:
+		row("Backup", "none (symlinks cannot be created in this directory)")
+	default:
+		backupPath := filepath.Join(filepath.Dir(path), ".symlink2file", filepath.Base(path))
+		if _, err := os.Lstat(backupPath); err == nil {
+			row("Backup", "%s~N (the name is taken by an earlier backup)", displayPath(backupPath))
+		} else {
+			row("Backup", "%s -> %s", displayPath(backupPath), linkDest)
+		}
+	}
+	row("Bytes", "%s", formatBytes(size))
+	if opts.minFreeSpace > 0 {
+		if stat, err := statFS(filepath.Dir(path)); err == nil && stat.available-size < opts.minFreeSpace {
+			return decision("waits for free space (--min-free-space %s, --low-space %s)", formatBytes(opts.minFreeSpace), opts.lowSpace)
+		}
+	}
+	return decision("converted to a regular file with the content of %s", displayPath(resolvedPath))
+}
+
+// Category of the audit inventory
+type auditCategory struct {
+	name  string
+	count int
+	bytes int64
+}
+
+// Print an inventory of the symlinks under the roots, grouped by what they point to, without modifying anything
+// Symlinks pointing to regular files are additionally counted as cross-device (target on another filesystem)
+// and external (target outside of the processed directories) where applicable
+func runAudit(opts *options) error {
+	categories := map[string]*auditCategory{}
+	order := []string{"file", "broken", "directory", "loop", "special", "cross-device", "external"}
+	descriptions := map[string]string{
+		"file":         "Healthy (regular file targets)",
+		"broken":       "Broken (missing targets)",
+		"directory":    "Directory targets",
+		"loop":         "Symlink loops",
+		"special":      "Special file targets (FIFOs, devices, sockets)",
+		"cross-device": "  of which on another filesystem",
+		"external":     "  of which outside the processed directories",
+	}
+	for _, name := range order {
+		categories[name] = &auditCategory{name: name}
+	}
+	add := func(name string, size int64) {
+		categories[name].count++
+		categories[name].bytes += size
+	}
+
+	total := 0
+	for _, root := range opts.roots {
+		opts.targetDir = root
+		err := walkSymlinks(opts, func(path string, opts *options) error {
+			total++
+			info, err := os.Stat(path)
+			switch {
+			case errors.Is(err, syscall.ELOOP):
+				add("loop", 0)
+				return nil
+			case err != nil:
+				add("broken", 0)
+				return nil
+			case info.IsDir():
+				add("directory", 0)
+				return nil
+			case !info.Mode().IsRegular():
+				add("special", 0)
+				return nil
+			}
+			add("file", info.Size())
+
+			if linkDir, err := os.Stat(filepath.Dir(path)); err == nil && !sameDevice(linkDir, info) {
+				add("cross-device", info.Size())
+			}
+			if resolvedPath, err := filepath.EvalSymlinks(path); err == nil && !underAnyRoot(resolvedPath, opts.roots) {
+				add("external", info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	coloredPrintf(headerColor, "Symlink inventory of %s\n\n", strings.Join(opts.roots, ", "))
+	fmt.Printf("%-50s %10s %12s\n", "Category", "Count", "Size")
+	for _, name := range order {
+		category := categories[name]
+		size := "-"
+		if name == "file" || name == "cross-device" || name == "external" {
+			size = formatBytes(category.bytes)
+		}
+		fmt.Printf("%-50s %10d %12s\n", descriptions[name], category.count, size)
+	}
+	fmt.Printf("%-50s %10d\n", "Total", total)
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+// Unicode normalization of file names: macOS creates names in NFD (decomposed accents), Linux keeps the bytes
+// written by programs (mostly NFC), so a symlink made on one side can name its target differently from the
+// directory entry made on the other. The tables are in norm_tables.go
+
+//go:generate sh -c "python3 gen_norm_tables.py | gofmt > norm_tables.go"
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Hangul syllables, decomposed into leading consonants, vowels and trailing consonants algorithmically
+const (
+	hangulBase   = 0xAC00
+	hangulCount  = 11172
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+)
+
+// Check if a string only holds ASCII, which is the same in every normalization form
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Canonical decomposition (NFD) of a string, with the combining marks in canonical order
+func toNFD(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		if index := r - hangulBase; index >= 0 && index < hangulCount {
+			runes = append(runes, hangulLBase+index/hangulNCount, hangulVBase+index%hangulNCount/hangulTCount)
+			if trailing := index % hangulTCount; trailing != 0 {
+				runes = append(runes, hangulTBase+trailing)
+			}
+		} else if decomposition, ok := canonicalDecompositions[r]; ok {
+			runes = append(runes, []rune(decomposition)...)
+		} else {
+			runes = append(runes, r)
+		}
+	}
+	// Sort each run of combining marks by combining class (stable, so marks of the same class keep their order)
+	for start := 0; start < len(runes); {
+		if combiningClasses[runes[start]] == 0 {
+			start++
+			continue
+		}
+		end := start + 1
+		for end < len(runes) && combiningClasses[runes[end]] != 0 {
+			end++
+		}
+		marks := runes[start:end]
+		sort.SliceStable(marks, func(i, j int) bool { return combiningClasses[marks[i]] < combiningClasses[marks[j]] })
+		start = end
+	}
+	return string(runes)
+}
+
+// Canonical composition (NFC) of a string: its decomposition, with the marks recomposed with their base characters
+func toNFC(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	runes := []rune(toNFD(s))
+	starter := -1 // Index of the last starter a following mark can be composed with
+	var lastClass uint8
+	composed := runes[:0]
+	for _, r := range runes {
+		class := combiningClasses[r]
+		if starter >= 0 && (lastClass < class || lastClass == 0 && len(composed) == starter+1) {
+			if primary, ok := composePair(composed[starter], r); ok {
+				composed[starter] = primary
+				continue
+			}
+		}
+		if class == 0 {
+			starter = len(composed)
+		}
+		lastClass = class
+		composed = append(composed, r)
+	}
+	return string(composed)
+}
+
+// Primary composite of two code points, if any
+func composePair(first, second rune) (rune, bool) {
+	if first >= hangulLBase && first < hangulLBase+hangulLCount && second >= hangulVBase && second < hangulVBase+hangulVCount {
+		return hangulBase + ((first-hangulLBase)*hangulVCount+second-hangulVBase)*hangulTCount, true
+	}
+	if index := first - hangulBase; index >= 0 && index < hangulCount && index%hangulTCount == 0 &&
+		second > hangulTBase && second < hangulTBase+hangulTCount {
+		return first + second - hangulTBase, true
+	}
+	primary, ok := canonicalCompositions[[2]rune{first, second}]
+	return primary, ok
+}
+
+// Normalize a string to a normalization form: 'nfc', 'nfd', or 'none' (unchanged)
+func normalizeForm(s, form string) string {
+	switch form {
+	case "nfc":
+		return toNFC(s)
+	case "nfd":
+		return toNFD(s)
+	}
+	return s
+}
+
+// Resolve a path like filepath.EvalSymlinks, also accepting names that differ from the directory entries only in
+// Unicode normalization (see resolveNormalized)
+func evalSymlinksNormalized(path string, maxDepth int) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if normalized, ok := resolveNormalized(path, maxDepth); ok {
+			return normalized, nil
+		}
+	}
+	return resolved, err
+}
+
+// Resolve a path that does not exist as it is, but with names that differ from the directory entries only in
+// Unicode normalization (e.g. link text written on Linux in NFC for a file created on macOS in NFD): the first
+// missing name is looked up among the entries of its directory by its NFC form, or the first symlink that cannot
+// be resolved is replaced by its destination, until the path resolves (at most maxDepth symlinks are followed)
+func resolveNormalized(path string, maxDepth int) (string, bool) {
+	current, links := path, 0
+	for steps := strings.Count(path, string(filepath.Separator)) + maxDepth; steps > 0; steps-- {
+		next, followed, ok := renormalizeStep(current)
+		if !ok {
+			return "", false
+		}
+		if followed {
+			if links++; links > maxDepth {
+				return "", false
+			}
+		}
+		resolved, err := filepath.EvalSymlinks(next)
+		if err == nil {
+			return resolved, true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", false
+		}
+		current = next
+	}
+	return "", false
+}
+
+// Rewrite a path that does not exist one step towards a path that does (see evalSymlinksNormalized):
+// the first missing name is replaced by the directory entry with the same NFC form, or the first symlink that
+// cannot be resolved is replaced by its destination (followed is then true). The directories on the way are
+// resolved, so that the '..' of relative destinations are applied to their real paths
+func renormalizeStep(path string) (next string, followed, ok bool) {
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) {
+		return "", false, false
+	}
+	volume := filepath.VolumeName(path)
+	dir := volume + string(filepath.Separator)
+	names := strings.Split(strings.TrimPrefix(path[len(volume):], string(filepath.Separator)), string(filepath.Separator))
+	for i, name := range names {
+		rest := names[i+1:]
+		current := filepath.Join(dir, name)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			match, found := normalizedEntry(dir, name)
+			if !found {
+				return "", false, false
+			}
+			return filepath.Join(append([]string{dir, match}, rest...)...), false, true
+		} else if err != nil {
+			return "", false, false
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			dir = current
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			dir = resolved
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", false, false
+		}
+		dest, err := os.Readlink(current)
+		if err != nil {
+			return "", false, false
+		}
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(dir, dest)
+		}
+		return filepath.Join(append([]string{dest}, rest...)...), true, true
+	}
+	return "", false, false // The path exists
+}
+
+// Find the entry of a directory whose name differs from name only in Unicode normalization
+func normalizedEntry(dir, name string) (string, bool) {
+	if isASCII(name) {
+		return "", false
+	}
+	wanted := toNFC(name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		if entry.Name() != name && toNFC(entry.Name()) == wanted {
+			return entry.Name(), true
+		}
+	}
+	return "", false
+}
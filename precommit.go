@@ -0,0 +1,61 @@
+package main
+
+// Hook for the pre-commit framework (pre-commit)
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+// Hook for the pre-commit framework: report the given files that are symlinks
+// With --fix, the symlinks are replaced with regular files (without backups, the originals are in git).
+// Returns the exit status: 1 if any symlink was found (pre-commit then asks to review and re-stage), 0 otherwise
+func preCommit(args []string) int {
+	flags := flag.NewFlagSet("pre-commit", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "Replace the symlinks with regular files")
+	flags.Parse(args)
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		coloredPrintf(redColor, "Error: %v\n", err)
+		return 2
+	}
+	opts := newOptions()
+	opts.targetDir = workDir
+	opts.noBackup = true
+	processedSymlinks := make(map[string]bool)
+
+	found := 0
+	status := 0
+	for _, file := range flags.Args() {
+		info, err := os.Lstat(file)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		found++
+		target, _ := os.Readlink(file)
+		if !*fix {
+			coloredPrintf(redColor, "Symlink found: "+resetColor+"%s -> %s\n", file, target)
+			continue
+		}
+
+		path, err := filepath.Abs(file)
+		if err == nil {
+			err = processPath(path, opts, processedSymlinks)
+		}
+		if err != nil {
+			coloredPrintf(redColor, "Error: %v\n", err)
+			status = 2
+		} else if !processedSymlinks[path] {
+			coloredPrintf(redColor, "Broken symlink, not converted: "+resetColor+"%s -> %s\n", file, target)
+		} else {
+			coloredPrintf(greenColor, "Converted symlink to file: "+resetColor+"%s\n", file)
+		}
+	}
+
+	if found > 0 && status == 0 {
+		status = 1
+	}
+	return status
+}
@@ -0,0 +1,48 @@
+package main
+
+// Presets for workflow managers (-preset), with the task summary of Nextflow work directories
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Converted symlinks of a Nextflow task directory
+type taskStat struct {
+	symlinks int
+	bytes    int64
+}
+
+// Nextflow task directory of a path ('ab/cdef...' for work/ab/cdef.../file, the task hash being split 2+30), or an empty string
+func nextflowTask(path string) string {
+	isHex := func(text string, length int) bool {
+		if len(text) != length {
+			return false
+		}
+		_, err := hex.DecodeString(text)
+		return err == nil
+	}
+	parts := strings.Split(filepath.ToSlash(filepath.Dir(path)), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if isHex(parts[i], 2) && isHex(parts[i+1], 30) {
+			return parts[i] + "/" + parts[i+1]
+		}
+	}
+	return ""
+}
+
+// Print the number of converted symlinks and their size per Nextflow task directory
+func printTaskSummary(tasks map[string]*taskStat) {
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	coloredPrintf(headerColor, "Converted symlinks per task directory:\n")
+	for _, name := range names {
+		fmt.Fprintf(output, "  %s: %d symlinks, %s\n", name, tasks[name].symlinks, formatBytes(tasks[name].bytes))
+	}
+}
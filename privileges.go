@@ -0,0 +1,126 @@
+package main
+
+// Privilege dropping (-run-as) and the paths opened to the sandbox (-sandbox)
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// User and groups the process switches to with -run-as
+type credentials struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int
+}
+
+// Parse a -run-as value, 'USER' or 'USER:GROUP' (names or numeric IDs)
+// Without a group, the primary and supplementary groups of the user are used
+func parseRunAs(value string) (*credentials, error) {
+	userName, groupName, hasGroup := strings.Cut(value, ":")
+	account, err := user.Lookup(userName)
+	if err != nil {
+		if account, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	creds := &credentials{name: value}
+	creds.uid, _ = strconv.Atoi(account.Uid)
+	creds.gid, _ = strconv.Atoi(account.Gid)
+	if hasGroup {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			if group, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		creds.gid, _ = strconv.Atoi(group.Gid)
+		creds.groups = []int{creds.gid}
+		return creds, nil
+	}
+	groupIds, err := account.GroupIds()
+	if err != nil {
+		groupIds = []string{account.Gid}
+	}
+	for _, id := range groupIds {
+		if gid, err := strconv.Atoi(id); err == nil {
+			creds.groups = append(creds.groups, gid)
+		}
+	}
+	return creds, nil
+}
+
+// Directories and files the sandbox leaves writable (see enterSandbox): the roots, the copy cache or dedup store,
+// the history and the trash, and the report of broken symlinks and the status file
+// Paths outside the roots must exist before the restriction, as they cannot be created later
+func sandboxPaths(opts *options) (dirs, files []string, err error) {
+	dirs = append(dirs, opts.roots...)
+	for _, store := range []string{opts.copyCache, opts.dedupStore} {
+		if store != "" {
+			dirs = append(dirs, store)
+		}
+	}
+	if !opts.noHistory {
+		if dir, err := historyDir(); err == nil && os.MkdirAll(dir, 0700) == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	if opts.brokenSymlinks == "trash" {
+		trashDir := opts.quarantineDir
+		if trashDir == "" {
+			dataDir, err := dataHome()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to locate the trash: %w", err)
+			}
+			trashDir = filepath.Join(dataDir, "Trash")
+		}
+		if err := os.MkdirAll(trashDir, 0700); err != nil {
+			return nil, nil, fmt.Errorf("failed to create trash directory: %w", err)
+		}
+		dirs = append(dirs, trashDir)
+	}
+	if opts.brokenReport != "" && (opts.brokenSymlinks == "report" || opts.loops == "report") {
+		file, err := os.Create(opts.brokenReport)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create broken symlinks report: %w", err)
+		}
+		file.Close()
+		files = append(files, opts.brokenReport)
+	}
+	if opts.statusFile != "" {
+		// Rewritten once the process is in the sandbox (see main), so an earlier outcome is kept for now
+		file, err := os.OpenFile(opts.statusFile, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create the status file: %w", err)
+		}
+		file.Close()
+		files = append(files, opts.statusFile)
+	}
+	return dirs, files, nil
+}
+
+// Switch to the -run-as user and groups once the files, listeners and snapshots needing root are set up
+// The report of broken symlinks is created beforehand and handed over to the user, as it is only written later
+func dropPrivileges(opts *options) error {
+	if opts.runAs == nil {
+		return nil
+	}
+	if opts.brokenReport != "" && (opts.brokenSymlinks == "report" || opts.loops == "report") {
+		file, err := os.OpenFile(opts.brokenReport, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create broken symlinks report: %w", err)
+		}
+		err = file.Chown(opts.runAs.uid, opts.runAs.gid)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to hand the broken symlinks report over to %s: %w", opts.runAs.name, err)
+		}
+	}
+
+	return switchUser(opts.runAs.uid, opts.runAs.gid, opts.runAs.groups)
+}
@@ -0,0 +1,154 @@
+package main
+
+// Progress output of long runs: statistics (-stats-interval) and the heartbeat (-heartbeat)
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Print a status line at every interval until the returned function is called (e.g. for the logs of batch jobs,
+// where no progress bar is shown): the symlinks processed, the data copied and its rate since the previous line,
+// and the locations that could not be read
+func printStats(opts *options, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var lastBytes int64
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			opts.stats.mu.Lock()
+			processed := 0
+			for _, count := range opts.stats.actions {
+				processed += count
+			}
+			converted, bytes, failures := opts.stats.actions["converted"], opts.stats.bytes, len(opts.stats.inaccessible)
+			opts.stats.mu.Unlock()
+			fmt.Fprintf(output, "Status: %d symlinks processed (%d converted), %s copied, %s/s, %d errors, %s elapsed\n",
+				processed, converted, formatBytes(bytes), formatBytes(int64(float64(bytes-lastBytes)/interval.Seconds())),
+				failures, time.Since(opts.stats.started).Round(time.Second))
+			lastBytes = bytes
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// Writer recording the time of its last write (to tell how long a run has been silent)
+type activityWriter struct {
+	w    io.Writer
+	last atomic.Int64 // Time of the last write, in Unix nanoseconds
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	a.last.Store(time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// Print a minimal line whenever nothing else was printed for the given interval (e.g. during the copy of a huge file),
+// so that CI systems do not stop the job for lack of output, until the returned function is called
+func startHeartbeat(opts *options, interval time.Duration) (stop func()) {
+	writer := &activityWriter{w: output}
+	writer.last.Store(time.Now().UnixNano())
+	output = writer
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-done:
+				return
+			}
+			silent := time.Since(time.Unix(0, writer.last.Load()))
+			if silent >= interval {
+				opts.stats.mu.Lock()
+				current := opts.stats.current
+				opts.stats.mu.Unlock()
+				line := fmt.Sprintf("Heartbeat: still running after %s", time.Since(opts.stats.started).Round(time.Second))
+				if current != "" {
+					line += ", processing " + displayPath(current)
+				}
+				fmt.Fprintln(writer, line)
+				silent = 0
+			}
+			timer.Reset(interval - silent)
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		output = writer.w
+	}
+}
+
+// Time over which the throughput is averaged for the progress line (older copies count less and less)
+const throughputWindow = 5 * time.Second
+
+// Progress of the conversions toward totals known from a scan
+type progressMeter struct {
+	totalFiles, doneFiles int
+	totalBytes, doneBytes int64
+	started, updated      time.Time
+	rate                  float64 // Throughput in bytes per second, as an exponential moving average
+}
+
+func newProgressMeter() *progressMeter {
+	now := time.Now()
+	return &progressMeter{started: now, updated: now}
+}
+
+// Count processed files and their size, and update the throughput
+func (p *progressMeter) add(files int, bytes int64) {
+	now := time.Now()
+	if elapsed := now.Sub(p.updated).Seconds(); elapsed > 0 {
+		sample := float64(bytes) / elapsed
+		if p.doneFiles == 0 {
+			p.rate = sample
+		} else {
+			p.rate += (1 - math.Exp(-elapsed/throughputWindow.Seconds())) * (sample - p.rate)
+		}
+	}
+	p.doneFiles += files
+	p.doneBytes += bytes
+	p.updated = now
+}
+
+// Estimate the time remaining from the throughput (or from the time per file if there is no data to copy),
+// counting down between updates; negative if unknown
+func (p *progressMeter) remaining() time.Duration {
+	var remaining time.Duration
+	switch {
+	case p.totalBytes > 0 && p.rate > 0:
+		remaining = time.Duration(float64(p.totalBytes-p.doneBytes) / p.rate * float64(time.Second))
+	case p.totalBytes == 0 && p.doneFiles > 0:
+		remaining = p.updated.Sub(p.started) / time.Duration(p.doneFiles) * time.Duration(p.totalFiles-p.doneFiles)
+	default:
+		return -1
+	}
+	return max(remaining-time.Since(p.updated), 0)
+}
+
+// Progress line, e.g. "12/300 files, 1.2 GiB of 4.5 GiB, 85.3 MiB/s, about 40s left"
+func (p *progressMeter) String() string {
+	line := fmt.Sprintf("%d/%d files, %s of %s, %s/s", p.doneFiles, p.totalFiles,
+		formatBytes(p.doneBytes), formatBytes(p.totalBytes), formatBytes(int64(p.rate)))
+	if remaining := p.remaining(); remaining >= 0 {
+		line += fmt.Sprintf(", about %s left", remaining.Round(time.Second))
+	}
+	return line
+}
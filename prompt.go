@@ -0,0 +1,116 @@
+package main
+
+// Interactive confirmation of the conversions (-interactive)
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Answers of the interactive mode that apply to more than the current symlink
+type promptState struct {
+	answerAll     bool           // The user answered "all", no more prompts
+	approvalRules []approvalRule // Pattern-based answers
+}
+
+// Answer given in the interactive mode for all symlinks matching a pattern
+type approvalRule struct {
+	pattern string // Glob pattern; a trailing slash matches everything under a directory
+	approve bool
+}
+
+// Check if the rule applies to a path relative to the target directory
+// Patterns without a slash are matched against the file name (or any directory name, for directory patterns),
+// patterns with a slash are matched against the relative path (or its leading directories)
+func (r approvalRule) matches(relPath string) bool {
+	if dirPattern, isDir := strings.CutSuffix(r.pattern, "/"); isDir {
+		parts := strings.Split(filepath.Dir(relPath), string(filepath.Separator))
+		for i := range parts {
+			candidate := parts[i]
+			if strings.Contains(dirPattern, "/") {
+				candidate = filepath.Join(parts[:i+1]...)
+			}
+			if ok, _ := filepath.Match(dirPattern, candidate); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	candidate := filepath.Base(relPath)
+	if strings.Contains(r.pattern, "/") {
+		candidate = relPath
+	}
+	ok, _ := filepath.Match(r.pattern, candidate)
+	return ok
+}
+
+// Returned when the user stops an interactive session
+var errQuit = errors.New("quit requested by user")
+
+// Reader for the answers in the interactive mode
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// Ask the user a yes/no question on the terminal
+// Answering "all" disables further prompts, "quit" stops processing (errQuit is returned).
+// Answering "yes PATTERN" or "no PATTERN" records a rule that also answers for all further matching symlinks
+func confirm(opts *options, path, question string) (bool, error) {
+	relPath, err := filepath.Rel(opts.targetDir, path)
+	if err != nil {
+		relPath = path
+	}
+	for _, rule := range opts.prompt.approvalRules {
+		if rule.matches(relPath) {
+			return rule.approve, nil
+		}
+	}
+
+	for {
+		fmt.Printf("%s%s%s [y]es/[n]o/[a]ll/[q]uit, or y/n PATTERN: ", headerColor, question, resetColor)
+		answer, err := stdinReader.ReadString('\n')
+		if err != nil && answer == "" {
+			if err == io.EOF {
+				return false, errQuit
+			}
+			return false, fmt.Errorf("error reading answer: %w", err)
+		}
+
+		answer, pattern, _ := strings.Cut(strings.TrimSpace(answer), " ")
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			rule := approvalRule{pattern: pattern}
+			switch strings.ToLower(answer) {
+			case "y", "yes":
+				rule.approve = true
+			case "n", "no":
+			default:
+				continue
+			}
+			if _, err := filepath.Match(strings.TrimSuffix(pattern, "/"), ""); err != nil {
+				coloredPrintf(redColor, "Invalid pattern %q: %v\n", pattern, err)
+				continue
+			}
+			opts.prompt.approvalRules = append(opts.prompt.approvalRules, rule)
+			if rule.matches(relPath) {
+				return rule.approve, nil
+			}
+			continue
+		}
+
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no", "":
+			return false, nil
+		case "a", "all":
+			opts.prompt.answerAll = true
+			return true, nil
+		case "q", "quit":
+			return false, errQuit
+		}
+	}
+}
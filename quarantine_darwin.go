@@ -0,0 +1,27 @@
+package main
+
+// Removal of the macOS quarantine attribute from the new files (-strip-quarantine)
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Extended attribute set on downloaded files (and inherited by copies made by quarantined applications),
+// which makes Gatekeeper prompt before running them
+const quarantineXattr = "com.apple.quarantine"
+
+// Remove the quarantine attribute of a new file (files without it are left as they are)
+// Failures are printed as warnings, as the copy itself is complete
+func stripQuarantine(file *os.File, symlinkPath string) {
+	namePtr, err := syscall.BytePtrFromString(quarantineXattr)
+	if err != nil {
+		return
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FREMOVEXATTR, file.Fd(), uintptr(unsafe.Pointer(namePtr)), 0)
+	if errno != 0 && !errors.Is(errno, syscall.ENOATTR) {
+		coloredPrintf(redColor, "Warning: the quarantine attribute of %s could not be removed (%v)\n", symlinkPath, errno)
+	}
+}
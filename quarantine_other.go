@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package main
+
+import "os"
+
+// The quarantine attribute only exists on macOS (-strip-quarantine is refused elsewhere, see parseFlags)
+func stripQuarantine(file *os.File, symlinkPath string) {}
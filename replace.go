@@ -0,0 +1,382 @@
+package main
+
+// Replacement of a symlink by a regular file, atomically when the filesystem allows it
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Replace a symlink with a regular file
+// It also replicates the original file's metadata (modification times and permissions) to the new file.
+// If checksum is not nil, the copied data is also written to it
+// In the NFS-safe mode, the copy is synced to the server before the rename, and stale file handles are retried
+// On CIFS/SMB, failures to set the mode and times of the copy are printed as warnings instead of aborting the run
+//
+// The directory of the symlink is held open, and the symlink, the temporary file and the rename are all relative to it,
+// so that replacing the directory or the symlink while the copy runs (on shared directories) cannot redirect the writes:
+// the target is opened without following symlinks, and the symlink is replaced atomically only if it is still the same one
+func replaceSymlinkWithFile(symlinkPath, targetFilePath string, checksum hash.Hash, opts *options) (int64, error) {
+	if !directoryCapabilities(opts, filepath.Dir(symlinkPath)).rename {
+		return replaceSymlinkInPlace(symlinkPath, targetFilePath, checksum, opts)
+	}
+
+	// Open the target file for reading (its path is fully resolved, so a symlink in its place is an attack or a race)
+	var inputFile *os.File
+	err := retryStale(useNFSSafe(opts, filepath.Dir(targetFilePath)), func() (err error) {
+		inputFile, err = openLongPath(targetFilePath, os.O_RDONLY|oNofollow)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error opening target file %q: %w", targetFilePath, err)
+	}
+	defer inputFile.Close()
+	return replaceSymlinkWithOpenFile(symlinkPath, targetFilePath, inputFile, checksum, opts)
+}
+
+// Replace a symlink with a copy of an open target (see replaceSymlinkWithFile); targetFilePath only names it in messages
+func replaceSymlinkWithOpenFile(symlinkPath, targetFilePath string, inputFile *os.File, checksum hash.Hash, opts *options) (int64, error) {
+	dir := filepath.Dir(symlinkPath)
+	nfsSafe, cifs := useNFSSafe(opts, dir), onCIFS(opts, dir)
+	parent, name, linkIno, err := openSymlinkDir(opts, symlinkPath)
+	if err != nil {
+		return 0, err
+	}
+	defer parent.Close()
+
+	// Create a temporary file in the same directory
+	tempFile, tempName, err := parent.createTemp()
+	if err != nil {
+		return 0, fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	// Ensure cleanup in case of errors
+	renamed := false
+	defer func() {
+		tempFile.Close()
+		if !renamed {
+			parent.remove(tempName)
+		}
+	}()
+
+	// Get the original file's metadata to replicate it (from the opened file, which is the one copied)
+	originalFileInfo, err := inputFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error getting file info for %q: %w", targetFilePath, err)
+	}
+	if !originalFileInfo.Mode().IsRegular() {
+		return 0, fmt.Errorf("target %q is not a regular file", targetFilePath)
+	}
+	if len(opts.allowed) > 0 {
+		// A directory on the way could have been swapped for a symlink since the target was checked
+		opened, err := openedPath(inputFile)
+		if err != nil || !underAnyRoot(opened, opts.allowed) {
+			return 0, fmt.Errorf("target %q is outside the -restrict-targets directories", targetFilePath)
+		}
+	}
+	atime, mtime := newFileTimes(opts, symlinkPath, originalFileInfo)
+	mode := newFileMode(opts, originalFileInfo.Mode())
+
+	// Copy the content to the temporary file
+	size, err := copyFileData(opts, tempFile, inputFile, originalFileInfo.Size(), checksum)
+	if err != nil {
+		return 0, fmt.Errorf("error copying data to temporary file: %w", err)
+	}
+
+	// Set the file metadata to match the original file (on the open files, not through their paths)
+	if err := copyAttributes(opts, inputFile, tempFile, symlinkPath, originalFileInfo); err != nil {
+		return 0, err
+	}
+	if err := tempFile.Chmod(mode); err != nil {
+		if !cifs {
+			return 0, fmt.Errorf("error setting file mode: %w", err)
+		}
+		coloredPrintf(redColor, "Warning: could not set the mode of %s: %v\n", symlinkPath, err)
+	}
+	copyCapabilities(inputFile, tempFile, symlinkPath)
+	if opts.unquarantine {
+		stripQuarantine(tempFile, symlinkPath)
+	}
+
+	// Flush the data to the server, so that write errors (e.g. quota) are reported here and
+	// other clients opening the file after the rename see its full content
+	if nfsSafe {
+		relock := releaseWork(opts)
+		err := tempFile.Sync()
+		relock()
+		if err != nil {
+			return 0, fmt.Errorf("error syncing temporary file: %w", err)
+		}
+	}
+
+	// Close the temporary file before moving it
+	if err := tempFile.Close(); err != nil {
+		return 0, fmt.Errorf("error closing temporary file: %w", err)
+	}
+
+	// Replace the symlink with the temporary file, if the symlink was not replaced in the meantime
+	// (union filesystems can place the temporary file on another device than the symlink; it is then copied again over there)
+	err = retryStale(nfsSafe, func() error { return renameOverSymlink(parent, tempName, symlinkPath, linkIno) })
+	if errors.Is(err, syscall.EXDEV) {
+		err = moveAcrossDevices(opts, parent, tempName, symlinkPath, linkIno, mode, originalFileInfo)
+	} else if err == nil {
+		renamed = true
+	}
+	if errors.Is(err, errSymlinkChanged) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error moving temporary file to final location: %w", err)
+	}
+
+	// Set the file times after the move
+	if err := parent.setTimes(name, atime, mtime); err != nil {
+		if !cifs {
+			return 0, fmt.Errorf("error setting file times: %w", err)
+		}
+		coloredPrintf(redColor, "Warning: could not set the times of %s: %v\n", symlinkPath, err)
+	}
+
+	return size, nil
+}
+
+// Error returned when a symlink was replaced by something else since it was checked (wrapped with its path)
+var errSymlinkChanged = errors.New("was changed during the conversion, left as it is")
+
+// Open the directory of a symlink, to replace the symlink relative to it, and get the inode of the symlink;
+// fails with errSymlinkChanged if it is no longer the symlink checked by processPath
+func openSymlinkDir(opts *options, symlinkPath string) (parent *dirHandle, name string, linkIno uint64, err error) {
+	dir, name := filepath.Dir(symlinkPath), filepath.Base(symlinkPath)
+	parent, err = openDirHandle(dir)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("error opening directory %q: %w", dir, err)
+	}
+	linkIno, isSymlink, err := parent.lstat(name)
+	checked, ok := opts.stats.linkInodes[symlinkPath]
+	if err != nil || !isSymlink || ok && checked != linkIno {
+		parent.Close()
+		return nil, "", 0, fmt.Errorf("symlink %q %w", symlinkPath, errSymlinkChanged)
+	}
+	return parent, name, linkIno, nil
+}
+
+// Remove a symlink, if it is still the one checked by processPath
+func removeCheckedSymlink(path string, opts *options) error {
+	parent, name, _, err := openSymlinkDir(opts, path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	return parent.remove(name)
+}
+
+// Create a new entry in a directory under a temporary name with create (another name is tried if it is taken)
+func createTempEntry(create func(name string) error) (string, error) {
+	for attempt := 0; ; attempt++ {
+		name := fmt.Sprintf(".tmp-%d-%d", os.Getpid(), time.Now().UnixNano())
+		err := create(name)
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, fs.ErrExist) || attempt == 100 {
+			return "", err
+		}
+	}
+}
+
+// Rename a new entry of a directory over a symlink, if the symlink is still the one opened by openSymlinkDir
+func renameOverSymlink(parent *dirHandle, tempName, symlinkPath string, linkIno uint64) error {
+	name := filepath.Base(symlinkPath)
+	if ino, isSymlink, err := parent.lstat(name); err != nil || !isSymlink || ino != linkIno {
+		return fmt.Errorf("symlink %q %w", symlinkPath, errSymlinkChanged)
+	}
+	return parent.rename(tempName, name)
+}
+
+// Move a copy over a symlink it cannot be renamed onto (EXDEV, on union filesystems placing new files on another
+// branch than the symlink): the symlink is removed and the copy is copied again to a new file created at its name,
+// which is on the device of the symlink; if this second copy fails, the symlink is put back
+func moveAcrossDevices(opts *options, parent *dirHandle, tempName, symlinkPath string, linkIno uint64, mode os.FileMode, info os.FileInfo) error {
+	input, err := parent.open(tempName)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	return overwriteSymlink(parent, symlinkPath, linkIno, mode, func(file *os.File) error {
+		_, err := io.Copy(file, input)
+		if err == nil {
+			err = copyAttributes(opts, input, file, file.Name(), info)
+		}
+		if err == nil {
+			err = file.Chmod(mode)
+		}
+		if err == nil {
+			copyCapabilities(input, file, file.Name())
+			err = file.Sync()
+		}
+		return err
+	})
+}
+
+// Replace a symlink with a new file written by write, without renaming: the symlink is removed if it is still
+// the same one (linkIno), and the file is created at its name; if writing fails, the symlink is recreated
+func overwriteSymlink(parent *dirHandle, symlinkPath string, linkIno uint64, mode os.FileMode, write func(*os.File) error) error {
+	name := filepath.Base(symlinkPath)
+	linkDest, err := parent.readlink(name)
+	if err != nil {
+		return err
+	}
+	if ino, isSymlink, err := parent.lstat(name); err != nil || !isSymlink || ino != linkIno {
+		return fmt.Errorf("symlink %q %w", symlinkPath, errSymlinkChanged)
+	}
+	if err := parent.remove(name); err != nil {
+		return err
+	}
+	file, err := parent.create(name, mode)
+	if err == nil {
+		err = write(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			parent.remove(name)
+		}
+	}
+	if err != nil {
+		if linkErr := parent.symlink(linkDest, name); linkErr != nil {
+			return fmt.Errorf("%w (and the symlink could not be restored: %v)", err, linkErr)
+		}
+	}
+	return err
+}
+
+// Reader of an endless run of zero bytes (the holes of sparse files, for the checksums)
+type zeroReader struct{}
+
+func (zeroReader) Read(buffer []byte) (int, error) {
+	clear(buffer)
+	return len(buffer), nil
+}
+
+// Copy the content of a file, skipping its holes with -preserve sparse (the copy is left sparse)
+// Filesystems unable to report the holes are copied in full
+func copyFileData(opts *options, dest, source *os.File, size int64, checksum hash.Hash) (int64, error) {
+	defer releaseWork(opts)()
+	var writer io.Writer = dest
+	if checksum != nil {
+		writer = io.MultiWriter(dest, checksum)
+	}
+	if !opts.preserveSparse || !sparseSeek {
+		return io.Copy(writer, source)
+	}
+	if _, err := source.Seek(0, seekData); errors.Is(err, syscall.EINVAL) {
+		source.Seek(0, io.SeekStart)
+		return io.Copy(writer, source)
+	}
+
+	var offset int64
+	for offset < size {
+		data, err := source.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			data = size // Only a hole is left
+		} else if err != nil {
+			return 0, err
+		}
+		if checksum != nil {
+			io.CopyN(checksum, zeroReader{}, data-offset)
+		}
+		if data >= size {
+			break
+		}
+		hole, err := source.Seek(data, seekHole)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := source.Seek(data, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := dest.Seek(data, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(writer, source, hole-data); err != nil {
+			return 0, err
+		}
+		offset = hole
+	}
+	// A trailing hole is only a change of the size
+	if err := dest.Truncate(size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Replace a symlink with a regular file written directly at its location, on filesystems that cannot rename
+// files into place (the symlink is removed first, so an interrupted copy leaves a partial file)
+func replaceSymlinkInPlace(symlinkPath, targetFilePath string, checksum hash.Hash, opts *options) (int64, error) {
+	// The target is opened as in replaceSymlinkWithFile (not following a symlink in its place)
+	inputFile, err := openLongPath(targetFilePath, os.O_RDONLY|oNofollow)
+	if err != nil {
+		return 0, fmt.Errorf("error opening target file %q: %w", targetFilePath, err)
+	}
+	defer inputFile.Close()
+	originalFileInfo, err := inputFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error getting file info for %q: %w", targetFilePath, err)
+	}
+	if !originalFileInfo.Mode().IsRegular() {
+		return 0, fmt.Errorf("target %q is not a regular file", targetFilePath)
+	}
+	if len(opts.allowed) > 0 {
+		opened, err := openedPath(inputFile)
+		if err != nil || !underAnyRoot(opened, opts.allowed) {
+			return 0, fmt.Errorf("target %q is outside the -restrict-targets directories", targetFilePath)
+		}
+	}
+	atime, mtime := newFileTimes(opts, symlinkPath, originalFileInfo)
+	mode := newFileMode(opts, originalFileInfo.Mode())
+	cifs := onCIFS(opts, filepath.Dir(symlinkPath))
+	parent, name, linkIno, err := openSymlinkDir(opts, symlinkPath)
+	if err != nil {
+		return 0, err
+	}
+	defer parent.Close()
+
+	var size int64
+	err = overwriteSymlink(parent, symlinkPath, linkIno, mode, func(file *os.File) error {
+		if size, err = copyFileData(opts, file, inputFile, originalFileInfo.Size(), checksum); err != nil {
+			return fmt.Errorf("error writing file %q: %w", symlinkPath, err)
+		}
+		if err := copyAttributes(opts, inputFile, file, symlinkPath, originalFileInfo); err != nil {
+			return err
+		}
+		if err := file.Chmod(mode); err != nil {
+			if !cifs {
+				return fmt.Errorf("error setting file mode: %w", err)
+			}
+			coloredPrintf(redColor, "Warning: could not set the mode of %s: %v\n", symlinkPath, err)
+		}
+		copyCapabilities(inputFile, file, symlinkPath)
+		if opts.unquarantine {
+			stripQuarantine(file, symlinkPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := parent.setTimes(name, atime, mtime); err != nil {
+		if !cifs {
+			return 0, fmt.Errorf("error setting file times: %w", err)
+		}
+		coloredPrintf(redColor, "Warning: could not set the times of %s: %v\n", symlinkPath, err)
+	}
+	return size, nil
+}
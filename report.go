@@ -0,0 +1,370 @@
+package main
+
+// Reports of a run: the summary (-summary), the status file (-status-file) and the per-path output (-output)
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// Outcome of a run: success, partial (some paths could not be read or converted) or failure
+func runStatus(opts *options, runErr error) string {
+	switch {
+	case runErr != nil:
+		return "failure"
+	case len(opts.stats.inaccessible) > 0 || opts.stats.outOfSpace:
+		return "partial"
+	}
+	return "success"
+}
+
+// State of a run written to the -status-file, for workflow engines inspecting files rather than the output
+type statusReport struct {
+	Status     string         `json:"status"` // running, success, partial (some paths could not be read or converted) or failure
+	Roots      []string       `json:"roots"`
+	Processed  int            `json:"processed"`
+	Actions    map[string]int `json:"actions"`
+	Bytes      int64          `json:"bytes"`
+	Errors     int            `json:"errors"` // Locations that could not be read
+	FirstError string         `json:"first_error,omitempty"`
+	Started    time.Time      `json:"started"`
+	Finished   *time.Time     `json:"finished,omitempty"`
+}
+
+// Create the status file and record that the run is going on (the file stays open, so that it can still
+// be rewritten once the privileges are dropped)
+func startStatusFile(opts *options) error {
+	file, err := os.OpenFile(opts.statusFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	opts.stats.statusFile = file
+	return writeStatusFile(file, statusReport{
+		Status:  "running",
+		Roots:   opts.roots,
+		Actions: map[string]int{},
+		Started: opts.stats.started,
+	})
+}
+
+// Record the outcome of the run in the status file (if any) and close it
+func finishStatusFile(opts *options, processed int, runErr error) {
+	file := opts.stats.statusFile
+	if file == nil {
+		return
+	}
+	opts.stats.statusFile = nil
+
+	finished := time.Now()
+	report := statusReport{
+		Status:    runStatus(opts, runErr),
+		Roots:     opts.roots,
+		Processed: processed,
+		Actions:   opts.stats.actions,
+		Bytes:     opts.stats.bytes,
+		Errors:    len(opts.stats.inaccessible),
+		Started:   opts.stats.started,
+		Finished:  &finished,
+	}
+	switch {
+	case runErr != nil:
+		report.FirstError = runErr.Error()
+	case len(opts.stats.inaccessible) > 0:
+		report.FirstError = opts.stats.inaccessible[0]
+	case opts.stats.outOfSpace:
+		report.FirstError = fmt.Sprintf("out of quota or disk space: %d symlinks were not converted", opts.stats.spacePending)
+	}
+	err := writeStatusFile(file, report)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		coloredPrintf(redColor, "Warning: the status file could not be written: %v\n", err)
+	}
+}
+
+// Replace the content of the status file
+func writeStatusFile(file *os.File, report statusReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(append(data, '\n'), 0)
+	return err
+}
+
+// Final summary of a run, printed with -summary json or yaml
+type runSummary struct {
+	Status          string         `json:"status"` // success, partial or failure
+	Error           string         `json:"error,omitempty"`
+	Roots           []string       `json:"roots"`
+	Processed       int            `json:"processed"`
+	Actions         map[string]int `json:"actions"` // Number of paths per action ('converted', 'deleted', ...)
+	Bytes           int64          `json:"bytes"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Chains          int            `json:"chains"`
+	Loops           int            `json:"loops"`
+	LowerCopies     int            `json:"lower_copies,omitempty"`
+	CacheHits       int            `json:"cache_hits,omitempty"`
+	Deferred        int            `json:"deferred,omitempty"` // Symlinks left for the next run by -max-total-bytes
+	DeferredBytes   int64          `json:"deferred_bytes,omitempty"`
+	OutOfSpace      bool           `json:"out_of_space,omitempty"`
+	SpacePending    int            `json:"space_pending,omitempty"` // Symlinks not converted for lack of space
+	SpaceNeeded     int64          `json:"space_needed,omitempty"`
+	Refused         []string       `json:"refused,omitempty"`
+	CrossFilesystem []string       `json:"cross_filesystem,omitempty"`
+	TooLarge        []string       `json:"too_large,omitempty"`
+	InUse           []string       `json:"in_use,omitempty"`
+	ReadOnly        []string       `json:"read_only,omitempty"`
+	Sockets         []string       `json:"sockets,omitempty"`
+	Inaccessible    []string       `json:"inaccessible,omitempty"`
+	Snapshots       []string       `json:"snapshots,omitempty"`
+}
+
+// Collect the results of a run
+func summarize(opts *options, processedSymlinks map[string]bool, runErr error) runSummary {
+	stats := opts.stats
+	summary := runSummary{
+		Status:          runStatus(opts, runErr),
+		Roots:           opts.roots,
+		Processed:       countProcessed(processedSymlinks),
+		Actions:         stats.actions,
+		Bytes:           stats.bytes,
+		DurationSeconds: time.Since(stats.started).Round(time.Millisecond).Seconds(),
+		Chains:          stats.chains,
+		Loops:           stats.loops,
+		LowerCopies:     stats.lowerCopies,
+		CacheHits:       stats.cacheHits,
+		Deferred:        stats.deferred,
+		DeferredBytes:   stats.deferredBytes,
+		OutOfSpace:      stats.outOfSpace,
+		SpacePending:    stats.spacePending,
+		SpaceNeeded:     stats.spaceNeeded,
+		Refused:         stats.refused,
+		CrossFilesystem: stats.crossFS,
+		TooLarge:        stats.tooLarge,
+		InUse:           stats.inUse,
+		ReadOnly:        stats.readOnly,
+		Sockets:         stats.sockets,
+		Inaccessible:    stats.inaccessible,
+		Snapshots:       stats.snapshots,
+	}
+	if runErr != nil {
+		summary.Error = runErr.Error()
+	}
+	return summary
+}
+
+// Print the summary to stdout as a JSON or YAML document
+func printSummary(opts *options, summary runSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if opts.summary == "yaml" {
+		if data, err = jsonToYAML(data); err != nil {
+			return err
+		}
+	} else {
+		data = append(data, '\n')
+	}
+	_, err = results.Write(data)
+	return err
+}
+
+// Convert a JSON document to block-style YAML, keeping the order of the keys
+func jsonToYAML(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := writeYAMLValue(&buf, decoder, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write the next JSON value of the decoder as YAML, after a key or a "-" already written;
+// the entries of objects and arrays go on the following lines, indented by depth
+func writeYAMLValue(buf *bytes.Buffer, decoder *json.Decoder, depth int) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	indent := strings.Repeat("  ", depth)
+	switch token {
+	case json.Delim('{'), json.Delim('['):
+		if !decoder.More() {
+			if token == json.Delim('{') {
+				buf.WriteString(" {}\n")
+			} else {
+				buf.WriteString(" []\n")
+			}
+		} else if depth > 0 {
+			buf.WriteString("\n")
+		}
+		for decoder.More() {
+			if token == json.Delim('[') {
+				buf.WriteString(indent + "-")
+			} else {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				buf.WriteString(indent + key.(string) + ":")
+			}
+			if err := writeYAMLValue(buf, decoder, depth+1); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token() // Closing delimiter
+		return err
+	}
+
+	// Scalars: JSON strings are valid YAML double-quoted strings
+	switch value := token.(type) {
+	case string:
+		text, _ := json.Marshal(value)
+		buf.WriteString(" " + string(text) + "\n")
+	case nil:
+		buf.WriteString(" null\n")
+	default:
+		fmt.Fprintf(buf, " %v\n", value)
+	}
+	return nil
+}
+
+// Count the number of processed symlinks
+func countProcessed(processedSymlinks map[string]bool) int {
+	count := 0
+	for _, processed := range processedSymlinks {
+		if processed {
+			count++
+		}
+	}
+	return count
+}
+
+// Format a size in bytes with binary units (e.g., 1.5 GiB)
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Escape the message of a GitHub Actions workflow command
+func escapeGitHubData(value string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(value)
+}
+
+// Escape a property value of a GitHub Actions workflow command
+func escapeGitHubProperty(value string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(value)
+}
+
+// Report the action taken for a path in the machine-readable outputs
+// Actions are 'converted', 'deleted', 'kept' (broken symlinks), and 'skipped'
+func recordAction(opts *options, action, path, target string, size int64) {
+	recordConversion(opts, action, path, target, size, "", "")
+}
+
+// Report the action taken for a path, with what the history needs to undo a conversion:
+// the original destination of the symlink and its backup (if any)
+func recordConversion(opts *options, action, path, target string, size int64, linkDest, backupPath string) {
+	opts.stats.mu.Lock()
+	defer opts.stats.mu.Unlock()
+	opts.stats.actions[action]++
+	opts.stats.bytes += size
+
+	if opts.printConverted && action == "converted" {
+		printPath(results, path, opts.nullData)
+	}
+	if opts.outputFormat == "tsv" {
+		fmt.Fprintf(results, "%s\t%s\t%s\t%d\n", action, escapeTSV(normalizeForm(path, outputNormalization)),
+			escapeTSV(normalizeForm(target, outputNormalization)), size)
+	}
+	if opts.stats.history != nil {
+		fmt.Fprintf(opts.stats.history.paths, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			action, escapeTSV(path), escapeTSV(target), size, escapeTSV(linkDest), escapeTSV(backupPath))
+	}
+}
+
+// Record a path the walk could not read (permission denied, or path too long), to be listed at the end of the run
+func recordInaccessible(opts *options, path string, err error) {
+	reason := "permission denied"
+	if errors.Is(err, syscall.ENAMETOOLONG) {
+		reason = "path too long"
+	}
+	coloredPrintf(redColor, "Cannot access (%s), skipping: "+resetColor+"%s\n", reason, path)
+	opts.stats.mu.Lock()
+	opts.stats.inaccessible = append(opts.stats.inaccessible, displayPath(path)+" ("+reason+")")
+	opts.stats.mu.Unlock()
+}
+
+// Escape the characters that would break a tab-separated line
+func escapeTSV(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+// Restore the characters escaped by escapeTSV
+func unescapeTSV(value string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 't':
+			unescaped.WriteByte('\t')
+		case 'n':
+			unescaped.WriteByte('\n')
+		case 'r':
+			unescaped.WriteByte('\r')
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+	return unescaped.String()
+}
+
+// Print a path terminated by a newline, or by a NUL character if nullData is set
+func printPath(w io.Writer, path string, nullData bool) {
+	if nullData {
+		fmt.Fprintf(w, "%s\x00", normalizeForm(path, outputNormalization))
+	} else {
+		fmt.Fprintln(w, displayPath(path))
+	}
+}
+
+// Quote a path containing control characters (newlines, terminal escape sequences) for line-oriented output,
+// so that it can neither break the lines nor inject escape sequences; other paths are printed as they are
+// (in the normalization form of -normalize-output)
+func displayPath(path string) string {
+	path = normalizeForm(path, outputNormalization)
+	for _, r := range path {
+		if unicode.IsControl(r) {
+			return strconv.Quote(path)
+		}
+	}
+	return path
+}
@@ -0,0 +1,112 @@
+package main
+
+// Symlinks kept as symlinks: rewriting (-action) and retargeting (-retarget)
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Replacement of a path prefix (-retarget OLD=NEW)
+type prefixMapping struct {
+	from string
+	to   string
+}
+
+// Rewrite a link destination starting with one of the prefixes (the longest matching one wins)
+// Relative destinations are matched by their absolute path; the destination is returned unchanged if nothing matches
+func remapPrefix(path, linkDest string, mappings []prefixMapping) string {
+	absDest := linkDest
+	if !filepath.IsAbs(absDest) {
+		absDest = filepath.Join(filepath.Dir(path), linkDest)
+	}
+	absDest = filepath.Clean(absDest)
+
+	var best *prefixMapping
+	for i, mapping := range mappings {
+		if underAnyRoot(absDest, []string{mapping.from}) && (best == nil || len(mapping.from) > len(best.from)) {
+			best = &mappings[i]
+		}
+	}
+	if best == nil {
+		return linkDest
+	}
+	return best.to + strings.TrimPrefix(absDest, best.from)
+}
+
+// Rewrite the destination of a symlink in place (without copying any data), according to -action
+func rewriteSymlink(path string, opts *options, processedSymlinks map[string]bool) error {
+	linkDest, err := os.Readlink(path)
+	if err != nil {
+		return fmt.Errorf("failed to read symlink %q: %w", path, err)
+	}
+
+	newDest := linkDest
+	switch {
+	case opts.action == "absolutize" && !filepath.IsAbs(linkDest):
+		newDest = filepath.Join(linkDir(path), linkDest)
+	case opts.action == "relativize" && filepath.IsAbs(linkDest):
+		// Only targets under the root are made relative, so that the tree stays relocatable as a whole
+		root := opts.relativeRoot
+		if root == "" {
+			root = opts.targetDir
+		}
+		// Both ends are resolved, as ".." in the new destination climbs out of the directory the symlink is really in
+		if underAnyRoot(filepath.Clean(linkDest), []string{root}) {
+			if relDest, err := filepath.Rel(linkDir(path), filepath.Join(linkDir(linkDest), filepath.Base(linkDest))); err == nil {
+				newDest = relDest
+			}
+		}
+	case opts.action == "retarget":
+		newDest = remapPrefix(path, linkDest, opts.retargets)
+	}
+	if newDest == linkDest {
+		fmt.Fprintln(output, "Symlink unchanged:", displayPath(path))
+		recordAction(opts, "unchanged", path, linkDest, 0)
+		return nil
+	}
+
+	if opts.interactive && !opts.prompt.answerAll {
+		ok, err := confirm(opts, path, fmt.Sprintf("Rewrite symlink %s from %s to %s?", path, linkDest, newDest))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(output, "Skipping symlink:", displayPath(path))
+			recordAction(opts, "skipped", path, linkDest, 0)
+			return nil
+		}
+	}
+	if !opts.noBackup {
+		if _, err := backupSymlink(path, opts, processedSymlinks); err != nil {
+			return fmt.Errorf("failed to backup symlink %q: %w", path, err)
+		}
+	}
+	if err := retargetSymlink(path, newDest, opts); err != nil {
+		return fmt.Errorf("failed to rewrite symlink %q: %w", path, err)
+	}
+	coloredPrintf(greenColor, "Rewrote symlink: "+resetColor+"%s: %s -> %s\n", path, linkDest, newDest)
+	processedSymlinks[path] = true
+	recordAction(opts, "rewritten", path, newDest, 0)
+	return nil
+}
+
+// Point an existing symlink to a new target (atomically, via a temporary symlink)
+func retargetSymlink(path, newTarget string, opts *options) error {
+	parent, _, linkIno, err := openSymlinkDir(opts, path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	tempName, err := createTempEntry(func(name string) error { return parent.symlink(newTarget, name) })
+	if err != nil {
+		return err
+	}
+	if err := renameOverSymlink(parent, tempName, path, linkIno); err != nil {
+		parent.remove(tempName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !openbsd
+
+package main
+
+import "errors"
+
+// The sandbox relies on Landlock (sys_linux.go) or on pledge and unveil (sys_openbsd.go)
+func enterSandbox(opts *options) error {
+	return errors.New("the sandbox relies on Landlock (Linux) or on pledge and unveil (OpenBSD), which this system does not have")
+}
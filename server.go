@@ -0,0 +1,217 @@
+package main
+
+// HTTP API to submit runs and follow them (-serve)
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversion requested through the HTTP API
+type apiRun struct {
+	ID             string     `json:"id"`
+	Dir            string     `json:"dir"`
+	NoBackup       bool       `json:"no_backup"`
+	BrokenSymlinks string     `json:"broken_symlinks"`
+	NoRecurse      bool       `json:"no_recurse"`
+	Status         string     `json:"status"` // queued, running, done, or failed
+	Created        time.Time  `json:"created"`
+	Finished       *time.Time `json:"finished,omitempty"`
+	Processed      int        `json:"processed"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// HTTP API server state
+type apiServer struct {
+	opts    *options
+	mu      sync.Mutex
+	runs    map[string]*apiRun
+	lastID  int
+	started time.Time
+	queue   chan *apiRun
+}
+
+// Serve the HTTP API:
+//   - POST /convert   start a conversion, body: {"dir": ..., "no_backup": ..., "broken_symlinks": ..., "no_recurse": ...}
+//   - GET  /status    server status and run counts
+//   - GET  /runs/{id} state of a single run
+//
+// Runs are executed one at a time in the order of submission
+func runServer(opts *options) error {
+	output = io.Discard
+
+	server := &apiServer{opts: opts, runs: make(map[string]*apiRun), started: time.Now(), queue: make(chan *apiRun, 100)}
+	go server.worker()
+
+	// The requested directories are compared with the roots with their symlinks resolved
+	for i, root := range opts.roots {
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return fmt.Errorf("error resolving %q: %w", root, err)
+		}
+		opts.roots[i] = resolved
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", server.handleConvert)
+	mux.HandleFunc("/status", server.handleStatus)
+	mux.HandleFunc("/runs/", server.handleRun)
+
+	// Without a host, only local clients can connect (the API has no authentication)
+	addr := opts.serveAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := dropPrivileges(opts); err != nil {
+		return err
+	}
+	coloredPrintf(greenColor, "Listening on %s\n", listener.Addr())
+	httpServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return httpServer.Serve(listener)
+}
+
+func (s *apiServer) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	run := &apiRun{BrokenSymlinks: "keep"}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(run); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if !validBrokenAction(run.BrokenSymlinks) {
+		writeJSONError(w, http.StatusBadRequest, "broken_symlinks must be one of: "+strings.Join(brokenActions, ", "))
+		return
+	}
+	if !filepath.IsAbs(run.Dir) {
+		writeJSONError(w, http.StatusBadRequest, "dir must be an absolute path")
+		return
+	}
+	// A symlink in the path could lead outside of the roots
+	resolved, err := filepath.EvalSymlinks(run.Dir)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "dir cannot be resolved: "+err.Error())
+		return
+	}
+	run.Dir = resolved
+	if !s.allowed(run.Dir) {
+		writeJSONError(w, http.StatusForbidden, "dir is outside of the allowed roots")
+		return
+	}
+
+	s.mu.Lock()
+	s.lastID++
+	run.ID = strconv.Itoa(s.lastID)
+	run.Status = "queued"
+	run.Created = time.Now()
+	s.runs[run.ID] = run
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- run:
+	default:
+		s.finish(run, 0, errors.New("too many queued runs"))
+		writeJSONError(w, http.StatusServiceUnavailable, "too many queued runs")
+		return
+	}
+
+	s.writeRun(w, http.StatusAccepted, run)
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int)
+	for _, run := range s.runs {
+		counts[run.Status]++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version": version,
+		"started": s.started,
+		"roots":   s.opts.roots,
+		"runs":    counts,
+	})
+}
+
+func (s *apiServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	run, ok := s.runs[strings.TrimPrefix(r.URL.Path, "/runs/")]
+	s.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "run not found")
+		return
+	}
+	s.writeRun(w, http.StatusOK, run)
+}
+
+// Check if a directory (with its symlinks resolved) is under one of the roots given on the command line
+func (s *apiServer) allowed(dir string) bool {
+	return underAnyRoot(dir, s.opts.roots)
+}
+
+// Execute the queued runs one by one
+func (s *apiServer) worker() {
+	for run := range s.queue {
+		s.mu.Lock()
+		run.Status = "running"
+		opts := *s.opts
+		opts.targetDir = run.Dir
+		opts.noBackup = run.NoBackup
+		opts.brokenSymlinks = run.BrokenSymlinks
+		opts.noRecurse = run.NoRecurse
+		s.mu.Unlock()
+
+		processedSymlinks := make(map[string]bool)
+		err := processSymlinks(&opts, processedSymlinks)
+		s.finish(run, countProcessed(processedSymlinks), err)
+	}
+}
+
+func (s *apiServer) finish(run *apiRun, processed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now()
+	run.Finished = &finished
+	run.Processed = processed
+	run.Status = "done"
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+	}
+}
+
+func (s *apiServer) writeRun(w http.ResponseWriter, status int, run *apiRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(run)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
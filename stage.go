@@ -0,0 +1,136 @@
+package main
+
+// Preparation of directories as inputs of read-only images (stage)
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prepare directories as inputs of read-only images (squashfs, ISO): materialize every symlink to a file (without backups),
+// normalize the ownership, zero the access times and write a manifest of the content
+// Fails if symlinks remain (broken ones, or symlinks to directories), as the image would not be self-contained
+func stage(args []string) error {
+	flags := flag.NewFlagSet("stage", flag.ExitOnError)
+	manifestPath := flags.String("manifest", "", "File receiving the manifest (type, mode, owner, size, SHA-256, path); default: stdout")
+	owner := flags.String("owner", "0:0", "Owner of all entries as 'UID:GID'")
+	flags.Parse(args)
+
+	uidText, gidText, ok := strings.Cut(*owner, ":")
+	uid, uidErr := strconv.Atoi(uidText)
+	gid, gidErr := strconv.Atoi(gidText)
+	if !ok || uidErr != nil || gidErr != nil {
+		return fmt.Errorf("invalid owner %q: must be 'UID:GID'", *owner)
+	}
+
+	opts := newOptions()
+	opts.noBackup = true
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		opts.roots = append(opts.roots, root)
+	}
+
+	manifest := io.Writer(os.Stdout)
+	var manifestAbs string
+	if *manifestPath != "" {
+		file, err := os.Create(*manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to create manifest: %w", err)
+		}
+		defer file.Close()
+		manifest = file
+		manifestAbs, _ = filepath.Abs(*manifestPath)
+	} else {
+		output = os.Stderr
+	}
+
+	// Materialize the symlinks to files
+	processedSymlinks := make(map[string]bool)
+	remaining := 0
+	for _, root := range opts.roots {
+		opts.targetDir = root
+		err := walkSymlinks(opts, func(path string, opts *options) error {
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				coloredPrintf(redColor, "Symlink cannot be materialized: "+resetColor+"%s\n", path)
+				remaining++
+				return nil
+			}
+			return processPath(path, opts, processedSymlinks)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// List every entry, then normalize the metadata
+	// (the times are set last, as reading the files and directories updates their access times)
+	var entries []string
+	var infos []fs.FileInfo
+	for _, root := range opts.roots {
+		err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error accessing path %q: %w", path, err)
+			}
+			if path == manifestAbs {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			entries = append(entries, path)
+			infos = append(infos, info)
+
+			relPath, _ := filepath.Rel(root, path)
+			if len(opts.roots) > 1 {
+				relPath = filepath.Join(filepath.Base(root), relPath)
+			}
+			kind, checksum := "file", "-"
+			switch {
+			case info.IsDir():
+				kind = "dir"
+			case info.Mode()&os.ModeSymlink != 0:
+				kind = "symlink"
+			case info.Mode().IsRegular():
+				if checksum, err = fileChecksum(path); err != nil {
+					return fmt.Errorf("failed to read %q: %w", path, err)
+				}
+			default:
+				kind = "other"
+			}
+			fmt.Fprintf(manifest, "%s\t%04o\t%d:%d\t%d\t%s\t%s\n", kind, info.Mode().Perm(), uid, gid, info.Size(), checksum, escapeTSV(filepath.ToSlash(relPath)))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i, path := range entries {
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("error setting owner of %q: %w", path, err)
+		}
+		if err := lutimes(path, time.Unix(0, 0), infos[i].ModTime()); err != nil {
+			return fmt.Errorf("error setting times of %q: %w", path, err)
+		}
+	}
+
+	if remaining > 0 {
+		return fmt.Errorf("%d symlinks could not be materialized", remaining)
+	}
+	coloredPrintf(greenColor, "Staging complete. Materialized %d symlinks.\n", countProcessed(processedSymlinks))
+	return nil
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Colors for the verbose output
@@ -22,271 +23,704 @@ const (
 	version = "1.0.0" // Program version
 )
 
-func coloredPrintf(color string, format string, a ...interface{}) {
-	fmt.Printf(color+format+resetColor, a...)
-}
-
-// The entry point of the program
-// - parse command-line flags
-// - set up the backup directory,
-// - initiate the process of handling symlinks in the specified target directory
-func main() {
+// Commit and build date, set when building a release:
+// go build -ldflags="-X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" .
+var (
+	commit    string
+	buildDate string
+)
 
-	noBackup, brokenSymlinks, noRecurse, targetDir := parseFlags()
+// Options controlling how symlinks are processed
+type options struct {
+	roots          []string // Absolute paths of all directories to process
+	targetDir      string   // Absolute path of the directory currently processed
+	action         string   // What to do with the symlinks: 'convert' (to files), 'absolutize', 'relativize' or 'retarget' (rewrite links)
+	relativeRoot   string   // With -action relativize, only targets under this directory are made relative (default: the processed directory)
+	noBackup       bool     // Skip creating backups of replaced symlinks
+	backupBroken   string   // Back up broken symlinks before modifying them: 'yes' or 'no' (independent of noBackup)
+	brokenSymlinks string   // Action for broken symlinks: 'keep', 'delete', 'trash', 'placeholder', 'report', or 'repair'
+	quarantineDir  string   // Directory receiving the trashed symlinks instead of the XDG trash
+	brokenReport   string   // File listing the broken symlinks (with -broken-symlinks report)
+	searchRoots    []string // Directories searched for the missing targets (with -broken-symlinks repair)
+	repairMode     string   // How to repair a broken symlink: 'retarget' or 'materialize'
+	repairManifest string   // File with the expected size and checksum of the missing targets
+	suggestTargets bool     // Suggest likely intended targets for the kept broken symlinks
+	noRecurse      bool     // Process only the target directory itself
+	maxLinkDepth   int      // Maximum number of symlinks followed to resolve a chain
+	loops          string   // Action for symlink loops: 'keep', 'delete', or 'report'
+	resolve        string   // How far symlinks are dereferenced: 'full' (final target) or 'once' (immediate target only)
+	verbose        bool     // Print more details (e.g. every hop of symlink chains)
+	interactive    bool     // Ask for confirmation before modifying each symlink
+	tui            bool     // Review the symlinks in a full-screen interface before converting them
+
+	retargets []prefixMapping // With -action retarget, prefixes of the link destinations to replace
+	storeDirs []string        // With -preset nix, only symlinks into these directories are converted
+	allowed   []string        // With -restrict-targets, only symlinks into these directories (fully resolved) are converted
+	filters   []filterRule    // Ordered include/exclude rules (rsync semantics)
+
+	daemon     bool          // Keep running and rescan the roots periodically
+	interval   time.Duration // Time between rescans in the daemon mode
+	logSyslog  bool          // Send the daemon logs to syslog instead of stderr
+	healthAddr string        // Address of the HTTP health endpoint in the daemon mode
+
+	cronSchedules map[string]*cronSchedule // Cron schedules of individual roots in the daemon mode
+
+	serveAddr string // Address of the HTTP API server
+
+	preHook  string // Shell command run before processing
+	postHook string // Shell command run after processing
+	fileHook string // Shell command run after each replaced symlink
+	decider  string // External command deciding what to do with each symlink
+
+	filesFrom string // File with the list of symlinks to process instead of walking directories ('-' for stdin)
+	nullData  bool   // Paths in the input list and in the results are separated by NUL characters
+
+	printConverted bool   // Print the paths of the converted files to stdout
+	outputFormat   string // Format of the per-path action log on stdout: 'text' (messages only) or 'tsv'
+
+	check       bool   // Only report the symlinks found and fail if there are any
+	audit       bool   // Only print a categorized inventory of the symlinks
+	diff        bool   // Only print the planned changes in a unified-diff-like format
+	explain     string // Only print what would happen to this path and why (explain subcommand)
+	checkFormat string // Format of the check report: 'text' or 'github'
+
+	exclude []string // File name patterns of symlinks to leave untouched (set by the per-directory config files)
+	skip    bool     // Leave the whole directory untouched (set by the per-directory config files)
+
+	verifyAfter    bool // Check the converted files against their targets after processing
+	snapshotBefore bool // Create a read-only snapshot (btrfs or ZFS) of the filesystems of the roots before modifying them
+	noHistory      bool // Do not record the run in the history
+
+	outputDir string // Build a materialized copy of the roots here instead of modifying them
+
+	dockerContext bool   // Prepare the roots as Docker build contexts (respect .dockerignore, keep relative links within the context)
+	preset        string // Settings for a known directory layout: 'nextflow', 'snakemake' (work directories), 'nix' (store links) or 'conda' (environments)
+	linkMode      string // How symlinks are materialized: 'copy' or 'hardlink' (to the target, falling back to a copy)
+	copyCache     string // Directory of copies kept across runs by checksum, reused as reflinks (or hard links) instead of copying
+	dedupStore    string // Directory of copies by checksum that all identical copies are hard links to (hard link farm)
+	crossFSOnly   bool   // Convert only the symlinks whose targets are on another filesystem
+	sameFSOnly    bool   // Convert only the symlinks whose targets are on the same filesystem (the others are listed for review)
+	specialFiles  string // Symlinks to FIFOs and device nodes: 'skip', 'recreate' (the node) or 'error'
+	maxFileSize   int64  // Symlinks to larger files (bytes) are left alone and listed (0: no limit)
+	maxTotalBytes int64  // Data converted by a run (bytes), the remaining symlinks are deferred (0: no limit)
+	minFreeSpace  int64  // Free space (bytes) kept on the filesystems of the symlinks (0: no limit)
+	lowSpace      string // When a copy would go below minFreeSpace: 'pause' (wait for space) or 'abort' (stop copying)
+	force         bool   // Process the roots even if their filesystems are mounted read-only
+	skipOpen      bool   // Leave the symlinks whose targets are open for writing by a process (reported at the end)
+	sandbox       bool   // Restrict the process with Landlock (or unveil on OpenBSD) to modifying only the roots (and the trash, quarantine and report)
+
+	runAs *credentials // User and groups the process switches to once the logs, listeners and snapshots are set up (-run-as)
+
+	chmod        []modeClause // Mode changes applied to the new files (-chmod)
+	respectUmask bool         // Clear the bits of the umask from the mode of the target (before -chmod)
+	stripSpecial bool         // Clear the setuid, setgid and sticky bits of the new files (after -chmod)
+	unquarantine bool         // Remove the macOS quarantine attribute from the new files (-strip-quarantine)
+	umask        os.FileMode  // Umask of the process (read at startup)
+	times        string       // Times of the new files: 'target' (modification time of the target), 'link' (times of the symlink) or 'now'
+
+	preserveMode   bool // Give the new files the mode of their targets (otherwise the default mode of new files, by the umask)
+	preserveTimes  bool // With -times target, give the new files the access and modification times of their targets (otherwise the current time)
+	preserveOwner  bool // Give the new files the owner and group of their targets
+	preserveXattrs bool // Copy the extended attributes of the targets (including ACLs and SELinux labels)
+	preserveSparse bool // Keep the holes of sparse targets instead of writing zeros
+	preserveLinks  bool // Symlinks to the same target become hard links to a single copy
+
+	nfsSafe bool // Sync copies before renaming them and retry operations failing with stale NFS file handles (also on NFS, see useNFSSafe)
+
+	statsInterval time.Duration // Print a status line this often during a run (0: never)
+	heartbeat     time.Duration // Print a line whenever nothing was printed for this long (0: never)
+
+	summary string // Format of the final summary: 'text' (messages), or 'json' or 'yaml' (a document on stdout)
+
+	statusFile string // JSON file with the state of the run ('running', then its outcome on exit)
+
+	order string // Order of the conversions: 'walk' (as found), or after scanning 'sorted' (by path), 'largest-first' or 'smallest-first'
+
+	jobs        int // Symlinks converted at the same time (their copies run in parallel)
+	perDirLimit int // Conversions in progress at the same time in a directory, with -jobs (0: no limit)
+
+	prompt *promptState // State of the interactive mode, shared by all directories
+	stats  *runStats    // Results of the run, shared by all directories
+}
 
-	processedSymlinks := make(map[string]bool)
-	if err := processSymlinks(targetDir, noBackup, noRecurse, *brokenSymlinks, processedSymlinks); err != nil {
-		coloredPrintf(redColor, "Error processing symlinks: %v\n", err)
-		os.Exit(1)
-	}
+// Actions for broken symlinks
+var brokenActions = []string{"keep", "delete", "trash", "placeholder", "report", "repair"}
 
-	// Count the number of processed symlinks
-	count := 0
-	for _, processed := range processedSymlinks {
-		if processed {
-			count++
+func validBrokenAction(action string) bool {
+	for _, valid := range brokenActions {
+		if action == valid {
+			return true
 		}
 	}
-
-	coloredPrintf(greenColor, "Symlink replacement complete. Processed %d symlinks.\n", count)
+	return false
 }
 
-// Parse command-line flags and return their values
-func parseFlags() (noBackup *bool, brokenSymlinks *string, noRecurse *bool, targetDir string) {
-
-	// Flags
-	noBackup = flag.Bool("no-backup", false, "Skip creating backups of replaced symlinks")
-	brokenSymlinks = flag.String("broken-symlinks", "keep", "Action for broken symlinks: 'keep' or 'delete'")
-	noRecurse = flag.Bool("no-recurse", false, "Process only the specified directory, skip subdirectories")
-	showVersion := flag.Bool("version", false, "Show version information")
-
-	// Usage message
-	flag.Usage = func() {
-		fmt.Printf(`
-%ssymlink2file%s - converts symbolic links to regular files
+// Create the options with the shared state initialized (flag values are set by the caller)
+func newOptions() *options {
+	return &options{
+		action:         "convert",
+		brokenSymlinks: "keep",
+		backupBroken:   "yes",
+		maxLinkDepth:   40,
+		specialFiles:   "skip",
+		lowSpace:       "abort",
+		times:          "target",
+		preserveMode:   true,
+		preserveTimes:  true,
+		loops:          "keep",
+		resolve:        "full",
+		order:          "walk",
+		jobs:           1,
+		outputFormat:   "text",
+		checkFormat:    "text",
+		summary:        "text",
+		interval:       time.Hour,
+		prompt:         &promptState{},
+		stats: &runStats{
+			started:      time.Now(),
+			actions:      make(map[string]int),
+			copies:       make(map[string]string),
+			tasks:        make(map[string]*taskStat),
+			overlays:     make(map[string]*overlayMount),
+			capabilities: make(map[string]*fsCapabilities),
+			linkInodes:   make(map[string]uint64),
+			fsTypes:      make(map[uint64]uint32),
+		},
+	}
+}
 
-Usage:
-    %ssymlink2file [options] <directory>%s
+// Results of a run
+type runStats struct {
+	mu          sync.Mutex  // Guards the results recorded by both the scan and the conversions (actions, bytes, inaccessible)
+	work        *sync.Mutex // Held by the worker running a conversion with -jobs (nil with a single worker), see releaseWork
+	started     time.Time
+	current     string         // Symlink being processed (reported by the heartbeat)
+	reportFile  *os.File       // Report of the broken symlinks (opened on first use)
+	statusFile  *os.File       // File of -status-file, rewritten when the run ends
+	history     *historyRun    // Record of the run in the history (nil if not recorded)
+	actions     map[string]int // Number of paths per action ('converted', 'deleted', ...)
+	bytes       int64          // Total size of the converted files
+	conversions []conversion   // Converted symlinks (recorded only if they need to be verified)
+	chains      int            // Number of symlinks pointing to another symlink
+	loops       int            // Number of symlinks leading to a loop
+	repairIndex *repairIndex   // Files under the search roots (built on first use)
+
+	copies      map[string]string        // First converted copy of each target (with a preset deduplicating staged files)
+	snapshots   []string                 // Snapshots created before the run
+	overlays    map[string]*overlayMount // Overlayfs mount of each root (nil if not on overlayfs), detected on first walk
+	lowerCopies int                      // Files copied from a lower overlayfs layer into the upper one
+	cacheHits   int                      // Files taken from the copy cache or the dedup store
+	tasks       map[string]*taskStat     // Converted symlinks per Nextflow task directory
+
+	capabilities map[string]*fsCapabilities // Operations supported in each directory (probed on first use)
+	linkInodes   map[string]uint64          // Inode of each symlink being processed when it was checked (see openSymlinkDir)
+	fsTypes      map[uint64]uint32          // Filesystem type of each device holding symlinks (detected on first use)
+	caseNotice   bool                       // A case-insensitive filesystem was reported
+	crossFS      []string                   // Symlinks left alone because their targets are on another filesystem
+	refused      []string                   // Symlinks left alone because their targets are outside -restrict-targets
+	sockets      []string                   // Symlinks left alone because their targets are sockets
+	inUse        []string                   // Symlinks left alone because their targets were open for writing
+	readOnly     []string                   // Symlinks left alone because their directories are read-only or immutable
+	inaccessible []string                   // Paths that could not be read (with the reason), skipped by the walk
+	tooLarge     []string                   // Symlinks left alone because their targets exceed -max-file-size
+	openFiles    map[string]bool            // Files open for writing by any process (with -skip-open)
+	openScanned  time.Time                  // Time of the last scan of the open files
+
+	outOfSpace   bool  // A copy failed with EDQUOT or ENOSPC, or free space fell below -min-free-space: no more copies are attempted
+	spacePending int   // Symlinks left unconverted because of the lack of space
+	spaceNeeded  int64 // Total size of their targets
+	reserved     int64 // Total size of the copies in progress, not recorded in bytes yet (see reserveCopy)
+
+	budgetReached bool  // The -max-total-bytes budget is used up, the remaining symlinks are deferred
+	deferred      int   // Symlinks deferred to the next run
+	deferredBytes int64 // Total size of their targets
+}
 
-Options:
-    %s--no-backup%s        Skip creating backups of replaced symlinks
-    %s--broken-symlinks%s  Action for broken symlinks: 'keep' or 'delete' (default: keep)
-    %s--no-recurse%s       Process only the specified directory, skip subdirectories
-    %s--version%s          Show version information
+// Symlink replaced with a copy of its target
+type conversion struct {
+	path     string
+	target   string
+	size     int64
+	checksum string // SHA-256 of the copied data
+}
 
-Examples:
-    # Convert all symlinks in current directory and subdirectories
-    %ssymlink2file .%s
+// Destination of the progress messages (silenced while the TUI owns the terminal)
+var output io.Writer = os.Stdout
 
-    # Convert symlinks in /path/to/dir, delete broken ones, no backups
-    %ssymlink2file -broken-symlinks delete -no-backup /path/to/dir%s
+// Destination of the machine-readable results (paths of the converted files)
+var results io.Writer = os.Stdout
 
-    # Convert symlinks in current directory only (no subdirectories)
-    %ssymlink2file -no-recurse .%s
+// Unicode normalization of the printed paths (-normalize-output): 'none' (as on disk), 'nfc' or 'nfd'
+var outputNormalization = "none"
 
-More information:
-    %shttps://github.com/vmikk/symlink2file%s
-`,
-			headerColor, resetColor,
-			headerColor, resetColor,
-			greenColor, resetColor,
-			greenColor, resetColor,
-			greenColor, resetColor,
-			greenColor, resetColor,
-			cmdColor, resetColor,
-			cmdColor, resetColor,
-			cmdColor, resetColor,
-			cmdColor, resetColor,
-		)
-	}
-
-	flag.Parse()
-
-	// Handle version flag
-	if *showVersion {
-		fmt.Printf("symlink2file %s\n", version)
-		os.Exit(0)
-	}
-
-	// Validate broken-symlinks flag
-	if *brokenSymlinks != "keep" && *brokenSymlinks != "delete" {
-		fmt.Printf(redColor+"Invalid value for -broken-symlinks: %s. Must be 'keep' or 'delete'\n"+resetColor, *brokenSymlinks)
-		os.Exit(1)
+func coloredPrintf(color string, format string, a ...interface{}) {
+	for i, arg := range a {
+		if text, ok := arg.(string); ok {
+			a[i] = displayPath(text)
+		}
 	}
+	fmt.Fprintf(output, color+format+resetColor, a...)
+}
 
-	// Check for required non-flag argument (target directory)
-	if flag.NArg() != 1 {
-		flag.Usage()
-		os.Exit(1)
-	}
+// Subcommands, listed in the shell completion scripts and the man page
+var subcommands = []struct{ name, description string }{
+	{"systemd-install", "Print a systemd service and timer running symlink2file on a schedule (or install them with --install)"},
+	{"pre-commit", "Report the given files that are symlinks (or --fix them), as a pre-commit hook"},
+	{"export", "Stream a tar or zip archive of directories, with the targets of the symlinks stored as files"},
+	{"stage", "Prepare directories as inputs of read-only images: materialize the symlinks, normalize ownership, write a manifest"},
+	{"delink", "Replace the files identical to a file under a target root with symlinks to it"},
+	{"history", "List the recorded runs, or show the results of one of them"},
+	{"undo", "Revert the conversions of a recorded run"},
+	{"explain", "Print what a run with the given options would do with a path, and why (nothing is modified)"},
+	{"doctor", "Check the filesystem of a directory and print how symlinks will be converted there"},
+	{"bench", "Time the copy methods available on the filesystem of a directory"},
+	{"completion", "Print a completion script for bash, zsh, fish or powershell"},
+	{"man", "Print the man page"},
+	{"version", "Print the version, commit, build date, Go version and supported features"},
+}
 
-	// Convert to absolute path
-	var err error
-	targetDir = flag.Arg(0)
-	targetDir, err = filepath.Abs(targetDir)
-	if err != nil {
-		fmt.Printf(redColor+"Error resolving path: %v\n"+resetColor, err)
-		os.Exit(1)
-	}
+// Synopses of the commands, at the top of the usage message
+var usageSynopses = []string{
+	"symlink2file [options] [<directory> ...]",
+	"symlink2file systemd-install --dir <directory> [--schedule daily] [--install] [-- options]",
+	"symlink2file pre-commit [--fix] <file> ...",
+	"symlink2file export --format tar|zip [--compression deflate|store] <directory> ... > archive",
+	"symlink2file stage [--manifest FILE] [--owner 0:0] <directory> ...",
+	"symlink2file delink --target-root <directory> [--relative] [--dry-run] [-i] <directory> ...",
+	"symlink2file history [show <id|last>]",
+	"symlink2file undo --run <id|last> [--dry-run]",
+	"symlink2file explain [options] <path>",
+	"symlink2file doctor <directory>",
+	"symlink2file bench [--size 256M] [--count 10] <directory>",
+	"symlink2file completion bash|zsh|fish|powershell",
+	"symlink2file man [--dir <directory>]",
+	"symlink2file version [--json]",
+}
 
-	return noBackup, brokenSymlinks, noRecurse, targetDir
+// Options in the usage message, in the order they are listed (a newline in a description continues it on an indented line)
+var usageOptions = []struct{ name, description string }{
+	{"--action", "'convert' symlinks to files (default), or rewrite them in place: 'absolutize', 'relativize', or 'retarget'"},
+	{"--retarget", "Rewrite link destinations starting with a prefix, as 'OLD=NEW' (can be repeated; no data is copied)"},
+	{"--relative-root", "With --action relativize, only targets under this directory are made relative (default: processed directory)"},
+	{"--no-backup", "Skip creating backups of replaced symlinks"},
+	{"--backup-broken", "Back up broken symlinks before deleting or replacing them: 'yes' or 'no' (default: yes)"},
+	{"--broken-symlinks", "Action for broken symlinks: 'keep', 'delete', 'trash', 'placeholder', 'report', or 'repair' (default: keep)"},
+	{"--suggest-targets", "Suggest likely intended targets for the kept broken symlinks (also added to the --broken-report)"},
+	{"--search-root", "With --broken-symlinks repair, directory searched for the missing targets by file name (can be repeated)"},
+	{"--repair-mode", "With --broken-symlinks repair, 'retarget' the symlink to the found file or 'materialize' it (default: retarget)"},
+	{"--repair-manifest", "With --broken-symlinks repair, TSV of missing targets with expected size and SHA-256, to pick the right candidate"},
+	{"--broken-report", "With --broken-symlinks report, file listing the broken symlinks (which are kept) and their targets"},
+	{"--quarantine-dir", "With --broken-symlinks trash, move broken symlinks here instead of the XDG trash"},
+	{"--filter", "Rule with rsync semantics: '+ PATTERN', '- PATTERN', 'merge FILE' (can be repeated; first match wins)"},
+	{"--no-recurse", "Process only the specified directory, skip subdirectories"},
+	{"--max-link-depth", "Maximum number of symlinks followed to resolve a chain; longer chains are skipped (default: 40)"},
+	{"--resolve", "'full' copies the final target; 'once' dereferences one level only (a link to a link becomes a copy of that link)"},
+	{"--loops", "Action for symlink loops: 'keep', 'delete', or 'report' (to the --broken-report file) (default: keep)"},
+	{"-i, --interactive", "Prompt before modifying each symlink (yes/no/all/quit)"},
+	{"--tui", "Review and select symlinks in a full-screen interface before converting"},
+	{"--check", "Only report the symlinks found (nothing is modified); exit with status 1 if there are any"},
+	{"--audit", "Only print a categorized inventory of the symlinks with counts and sizes (nothing is modified)"},
+	{"--diff", "Only print the planned changes in a unified-diff-like format (nothing is modified)"},
+	{"--format", "Format of the --check report: 'text' or 'github' (GitHub Actions annotations)"},
+	{"--preset", "Settings for a known layout: 'nextflow' or 'snakemake' (staged inputs deduplicated with hard links),\n'nix' (convert only the symlinks into /nix/store or /gnu/store), or 'conda' (environments and venvs)"},
+	{"--copy-cache", "Keep the copies here by checksum and reuse them (reflink, or hard link) in later runs instead of copying"},
+	{"--dedup-store", "Hard-link all copies of identical content to one file in this store (on the same filesystem)"},
+	{"--link-mode", "'copy' the targets, or 'hardlink' them (copies across filesystems) (default: copy; hardlink for conda)"},
+	{"--store-dir", "With --preset nix, store directory whose symlinks are converted (can be repeated)"},
+	{"--cross-fs-only", "Convert only the symlinks whose targets are on a different filesystem than the link"},
+	{"--special-files", "Symlinks to FIFOs and device nodes: 'skip', 'recreate' the node (devices need root), or 'error' (default: skip)"},
+	{"--chmod", "Mode of the new files instead of the mode of the target: octal (0644) or symbolic (u+rw,go-w)"},
+	{"--respect-umask", "Give the new files the mode of the target without the bits of the umask, instead of an exact copy"},
+	{"--strip-special-bits", "Clear the setuid, setgid and sticky bits of the new files"},
+	{"--strip-quarantine", "Remove the com.apple.quarantine attribute from the new files, so that Gatekeeper does not prompt (macOS only)"},
+	{"--secure", "Safer settings for untrusted trees (implies --strip-special-bits)"},
+	{"--preserve", "Attributes kept: 'mode', 'timestamps', 'ownership', 'xattr', 'links', 'sparse' or 'all' (default: mode,timestamps)"},
+	{"-a, --archive", "Preserve everything, same as --preserve all (e.g. for migrations as root)"},
+	{"--times", "Times of the new files: 'target', 'link' (times of the symlink itself) or 'now' (default: target)"},
+	{"--max-file-size", "Leave the symlinks to files larger than this, e.g. '10G', and list them at the end"},
+	{"--max-total-bytes", "Convert at most this much data in a run, e.g. '500G' (the rest is deferred to the next run)"},
+	{"--min-free-space", "Keep at least this much free space on the filesystems of the symlinks, e.g. '50G'"},
+	{"--low-space", "Below --min-free-space: 'abort' (stop copying) or 'pause' (wait for free space) (default: abort)"},
+	{"--force", "Go on even if a filesystem is mounted read-only (its symlinks are listed as skipped)"},
+	{"--skip-open", "Leave the symlinks whose targets are being written by another process, and list them at the end"},
+	{"--restrict-targets", "Refuse to copy symlinks whose targets are outside this directory (can be repeated)"},
+	{"--sandbox", "Restrict the process (Landlock, unveil) to modifying only the directories, trash, quarantine and report"},
+	{"--same-fs-only", "Leave the symlinks whose targets are on a different filesystem, and list them at the end for review"},
+	{"--nfs-safe", "Sync copies before renaming them and retry stale file handles (enabled automatically on NFS)"},
+	{"--docker-context", "Prepare a Docker build context: respect .dockerignore, convert only symlinks leading outside the context"},
+	{"--output-dir", "Leave the directories untouched and build a copy here, with the symlinks materialized"},
+	{"--snapshot-before", "Create a read-only btrfs or ZFS snapshot of each directory's subvolume/dataset before modifying anything"},
+	{"--no-history", "Do not record the run in the history ($XDG_DATA_HOME/symlink2file/history)"},
+	{"--verify-after", "After processing, check that each converted file matches the size and checksum of its target"},
+	{"--files-from", "Process the symlinks listed in this file ('-' for stdin) instead of walking directories"},
+	{"--order", "Order of the conversions: 'walk' (as found, default), or after a scan 'sorted' (by path), 'largest-first' or 'smallest-first'"},
+	{"--jobs", "Number of symlinks converted at the same time (their copies run in parallel, default: 1)"},
+	{"--per-dir-limit", "With --jobs, maximum number of conversions in progress at the same time in a directory"},
+	{"-0", "Paths in --files-from and --print-converted are NUL-separated (implies --print-converted)"},
+	{"--print-converted", "Print the paths of the converted files to stdout (messages go to stderr)"},
+	{"--output", "Per-path output: 'text' or 'tsv' (action, path, target, bytes; messages go to stderr)"},
+	{"--normalize-output", "Unicode normalization of the printed paths: 'none' (as on disk, default), 'nfc' or 'nfd'"},
+	{"--summary", "Final summary: 'text', or 'json' or 'yaml' (a document on stdout; messages go to stderr)"},
+	{"--status-file", "Write the state of the run to this JSON file, and its outcome on exit (status, counts, first error)"},
+	{"--pre-hook", "Shell command to run before processing (processing is aborted if it fails)"},
+	{"--post-hook", "Shell command to run after processing ($SYMLINK2FILE_STATUS, $SYMLINK2FILE_PROCESSED)"},
+	{"--file-hook", "Shell command to run after each replaced symlink ($SYMLINK2FILE_PATH, $SYMLINK2FILE_TARGET)"},
+	{"--decider", "Command deciding per symlink (JSON on stdin, 'convert', 'skip' or 'delete' on stdout)"},
+	{"--daemon", "Keep running and rescan the directories periodically"},
+	{"--interval", "Time between rescans in the daemon mode (default: 1h)"},
+	{"--syslog", "Send the daemon logs to syslog instead of stderr"},
+	{"--cron", "Schedule of a directory in the daemon mode, as 'DIR=CRON-EXPRESSION' (can be repeated)"},
+	{"--health-addr", "Serve the daemon health status over HTTP (e.g. ':8080')"},
+	{"--serve", "Run an HTTP API server on this address (e.g. ':8080', on the loopback interface if no host is given) for the given directories"},
+	{"--run-as", "When started as root, switch to this 'USER' or 'USER:GROUP' once the logs and listeners are set up"},
+	{"-v, --verbose", "Print more details (e.g. every hop of symlink chains)"},
+	{"--stats-interval", "Print a status line (symlinks processed, bytes copied, throughput, errors) this often, e.g. 5m"},
+	{"--heartbeat", "Print a line whenever nothing was printed for this long (e.g. 5m, for CI systems stopping silent jobs)"},
+	{"--version", "Show version information"},
 }
 
-// Process the symlinks in the given directory
-func processSymlinks(targetDir string, noBackup, noRecurse *bool, brokenSymlinks string, processedSymlinks map[string]bool) error {
-	walkFunc := func(path string, info os.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("error accessing path %q: %w", path, err)
-		}
+// Examples in the usage message
+var usageExamples = []struct{ comment, command string }{
+	{"Convert all symlinks in current directory and subdirectories", "symlink2file"},
+	{"Convert symlinks in /path/to/dir, delete broken ones, no backups", "symlink2file -broken-symlinks delete -no-backup -backup-broken no /path/to/dir"},
+	{"Convert symlinks in all directories matching a pattern (expanded by symlink2file)", "symlink2file 'runs/2024-*'"},
+	{"Fail a CI job if the repository contains symlinks", "symlink2file --check --format github ."},
+	{"Convert the symlinks found by another tool", "find . -type l -name '*.txt' -print0 | symlink2file -0 --files-from -"},
+	{"Convert symlinks in current directory only (no subdirectories)", "symlink2file -no-recurse ."},
+	{"Decide for each symlink whether it should be converted", "symlink2file -i ."},
+	{"Pick the symlinks to convert in a full-screen interface", "symlink2file --tui ."},
+	{"Convert new symlinks in two directories every 30 minutes", "symlink2file --daemon --interval 30m --health-addr :8080 /data/a /data/b"},
+	{"Convert /staging every night at 02:00 and /exports hourly", "symlink2file --daemon --cron '/staging=0 2 * * *' --cron '/exports=@hourly'"},
+	{"Accept conversion requests for directories under /data over HTTP", "symlink2file --serve 127.0.0.1:8080 /data"},
+}
 
-		// Skip .symlink2file directory and handle no-recurse logic
-		if strings.Contains(path, ".symlink2file") || (info.IsDir() && *noRecurse && path != targetDir) {
-			return filepath.SkipDir
-		}
+// Width of the option names in the usage message; their descriptions start in the next column
+const usageNameWidth = 19
 
-		// Process only symlinks
-		if info.Type()&os.ModeSymlink != 0 {
-			return processPath(path, targetDir, noBackup, brokenSymlinks, processedSymlinks)
+// Print the usage message: the synopses, options and examples of the tables above, with their names colored
+func printUsage() {
+	fmt.Printf("\n%ssymlink2file%s - converts symbolic links to regular files\n\nUsage:\n", headerColor, resetColor)
+	for _, synopsis := range usageSynopses {
+		fmt.Printf("    %s%s%s\n", headerColor, synopsis, resetColor)
+	}
+	fmt.Printf("\nThe current directory is processed if no directory is given.\n\nOptions:\n")
+	for _, option := range usageOptions {
+		// Longer names are followed by a single space
+		padding := strings.Repeat(" ", max(usageNameWidth-len(option.name), 1))
+		description := strings.ReplaceAll(option.description, "\n", "\n    "+strings.Repeat(" ", usageNameWidth))
+		fmt.Printf("    %s%s%s%s%s\n", greenColor, option.name, resetColor, padding, description)
+	}
+	fmt.Printf("\nExamples:\n")
+	for i, example := range usageExamples {
+		if i > 0 {
+			fmt.Println()
 		}
-
-		return nil
+		fmt.Printf("    # %s\n    %s%s%s\n", example.comment, cmdColor, example.command, resetColor)
 	}
+	fmt.Printf(`
+Environment:
+    Every option can also be set with a SYMLINK2FILE_* variable (e.g. SYMLINK2FILE_NO_BACKUP=true);
+    options given on the command line take precedence.
+
+More information:
+    %shttps://github.com/vmikk/symlink2file%s
+`, cmdColor, resetColor)
+}
 
-	return filepath.WalkDir(targetDir, walkFunc)
+// Subcommands with their own arguments (symlink2file NAME ...), besides pre-commit, which sets the exit status itself
+var subcommandRuns = map[string]func(args []string) error{
+	"systemd-install": systemdInstall,
+	"export":          exportArchive,
+	"stage":           stage,
+	"history":         history,
+	"doctor":          doctor,
+	"bench":           bench,
+	"version":         printVersion,
+	"undo":            undo,
+	"delink":          delink,
 }
 
-// Create a backup of the symlink
-// This function also marks the symlink as processed in the processedSymlinks map.
-func backupSymlink(path, targetDir string, processedSymlinks map[string]bool) error {
+// The entry point of the program
+// - parse command-line flags
+// - set up the backup directory,
+// - initiate the process of handling symlinks in the specified target directory
+func main() {
 
-	// Create a .symlink2file directory in the same directory as the symlink
-	dir := filepath.Dir(path)
-	backupDir := filepath.Join(dir, ".symlink2file")
-	if _, err := os.Stat(backupDir); os.IsNotExist(err) {
-		if err := os.Mkdir(backupDir, 0755); err != nil {
-			return fmt.Errorf("failed to create backup directory: %w", err)
+	// Subcommands
+	if len(os.Args) > 1 {
+		if os.Args[1] == "pre-commit" {
+			os.Exit(preCommit(os.Args[2:]))
+		}
+		if run, ok := subcommandRuns[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				coloredPrintf(redColor, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
 		}
 	}
 
-	linkDest, err := os.Readlink(path)
-	if err != nil {
-		return fmt.Errorf("failed to read symlink: %w", err)
-	}
-	backupPath := filepath.Join(backupDir, filepath.Base(path))
-	if err := os.Symlink(linkDest, backupPath); err != nil {
-		return fmt.Errorf("failed to create backup symlink: %w", err)
+	opts := parseFlags()
+
+	// Modes replacing the conversion (parseFlags refuses to combine them)
+	for _, mode := range []struct {
+		active  bool
+		run     func(opts *options) error
+		failure string
+	}{
+		{opts.serveAddr != "", runServer, "Error running server"},
+		{opts.daemon, runDaemon, "Error running daemon"},
+		{opts.outputDir != "", runExport, "Error exporting"},
+		{opts.explain != "", runExplain, "Error explaining " + opts.explain},
+		{opts.diff, runDiff, "Error planning changes"},
+		{opts.audit, runAudit, "Error auditing symlinks"},
+	} {
+		if !mode.active {
+			continue
+		}
+		if err := mode.run(opts); err != nil {
+			coloredPrintf(redColor, "%s: %v\n", mode.failure, err)
+			os.Exit(1)
+		}
+		return
 	}
-	processedSymlinks[path] = true // Mark the symlink as processed
-	return nil
-}
 
-// Processes a given path within the filesystem
-// If the path is a symlink, it evaluates the symlink, potentially backs it up (based on user flags),
-// and replaces it with a copy of the target file.
-// For broken symlinks, it either deletes them or keeps them based on the provided option.
-// It also handles the logic to avoid re-processing of already processed symlinks
-func processPath(path, targetDir string, noBackup *bool, brokenSymlinks string, processedSymlinks map[string]bool) error {
+	if opts.check {
+		found, err := runCheck(opts)
+		if err != nil {
+			coloredPrintf(redColor, "Error checking symlinks: %v\n", err)
+			os.Exit(2)
+		}
+		if found > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Check if the symlink has already been processed
-	if processedSymlinks[path] {
-		fmt.Println("Symlink already processed, skipping:", path)
-		return nil
+	// Entered before anything is written, as the process may be restarted inside the sandbox and would repeat it
+	// (a failure is still recorded in the status file, which the sandbox did not restrict then)
+	if opts.sandbox {
+		if err := enterSandbox(opts); err != nil {
+			coloredPrintf(redColor, "Sandbox failed, nothing was processed: %v\n", err)
+			if opts.statusFile != "" && startStatusFile(opts) == nil {
+				finishStatusFile(opts, 0, fmt.Errorf("sandbox failed: %w", err))
+			}
+			os.Exit(1)
+		}
 	}
 
-	resolvedPath, err := filepath.EvalSymlinks(path)
-	if err != nil && !*noBackup && brokenSymlinks == "delete" {
-		// Backup broken symlink before deleting
-		if backupErr := backupSymlink(path, targetDir, processedSymlinks); backupErr != nil {
-			return fmt.Errorf("failed to backup broken symlink %q: %w", path, backupErr)
+	// Created first, so that a stale outcome of a previous run is never left behind
+	if opts.statusFile != "" {
+		if err := startStatusFile(opts); err != nil {
+			coloredPrintf(redColor, "Error writing the status file, nothing was processed: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
-	if err != nil {
-		if brokenSymlinks == "delete" {
-			if removeErr := os.Remove(path); removeErr != nil {
-				return fmt.Errorf("error removing broken symlink %q: %w", path, removeErr)
+	// A read-only mount would fail every single replacement
+	for _, root := range opts.roots {
+		if stat, err := statFS(root); err == nil && stat.readOnly {
+			if !opts.force {
+				coloredPrintf(redColor, "The filesystem of %s is mounted read-only, nothing was processed (use -force to go on anyway)\n", root)
+				finishStatusFile(opts, 0, fmt.Errorf("the filesystem of %s is mounted read-only", root))
+				os.Exit(1)
 			}
-			coloredPrintf(redColor, "Removed broken symlink: "+resetColor+"%s\n", path)
-		} else {
-			coloredPrintf(redColor, "Keeping broken symlink: "+resetColor+"%s\n", path)
+			coloredPrintf(redColor, "Warning: the filesystem of %s is mounted read-only; its symlinks will be left alone\n", root)
 		}
-		return nil
 	}
 
-	if !*noBackup {
-		if err := backupSymlink(path, targetDir, processedSymlinks); err != nil {
-			return fmt.Errorf("failed to backup symlink %q: %w", path, err)
+	// Copies on another filesystem than the dedup store cannot be hard-linked to it
+	if opts.dedupStore != "" {
+		storeInfo, err := os.Stat(opts.dedupStore)
+		for _, root := range opts.roots {
+			if rootInfo, rootErr := os.Stat(root); err == nil && rootErr == nil && !sameDevice(storeInfo, rootInfo) {
+				coloredPrintf(redColor, "Warning: %s is on another filesystem than the dedup store; its copies will not share storage\n", root)
+			}
 		}
 	}
 
-	// Replace symlink with a copy of the file it points to
-	if err := replaceSymlinkWithFile(path, resolvedPath); err != nil {
-		return fmt.Errorf("failed to replace symlink %q with its target file %q: %w", path, resolvedPath, err)
+	// The history files are opened before -run-as, which could prevent it; the history never stops a run
+	if !opts.noHistory {
+		history, err := startHistory(opts)
+		if err != nil {
+			coloredPrintf(redColor, "Warning: the run will not be recorded in the history: %v\n", err)
+		}
+		opts.stats.history = history
 	}
 
-	processedSymlinks[path] = true
-	return nil
-}
+	if opts.preHook != "" {
+		if err := runHook(opts.preHook, "SYMLINK2FILE_ROOTS="+strings.Join(opts.roots, ":")); err != nil {
+			coloredPrintf(redColor, "Pre-hook failed, nothing was processed: %v\n", err)
+			finishStatusFile(opts, 0, fmt.Errorf("pre-hook failed: %w", err))
+			os.Exit(1)
+		}
+	}
 
-// Replace a symlink with a regular file
-// It also replicates the original file's metadata (modification times and permissions) to the new file
-func replaceSymlinkWithFile(symlinkPath, targetFilePath string) error {
-	// Create a temporary file in the same directory
-	dir := filepath.Dir(symlinkPath)
-	tempFile, err := os.CreateTemp(dir, ".tmp-*")
-	if err != nil {
-		return fmt.Errorf("error creating temporary file: %w", err)
+	if opts.snapshotBefore {
+		snapshots, err := createSnapshots(opts.roots)
+		if err != nil {
+			coloredPrintf(redColor, "Snapshot failed, nothing was processed: %v\n", err)
+			finishStatusFile(opts, 0, fmt.Errorf("snapshot failed: %w", err))
+			os.Exit(1)
+		}
+		opts.stats.snapshots = snapshots
 	}
-	tempPath := tempFile.Name()
 
-	// Ensure cleanup in case of errors
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempPath)
-	}()
+	if err := dropPrivileges(opts); err != nil {
+		coloredPrintf(redColor, "Error dropping privileges, nothing was processed: %v\n", err)
+		finishStatusFile(opts, 0, fmt.Errorf("failed to drop privileges: %w", err))
+		os.Exit(1)
+	}
 
-	// Open the target file for reading
-	inputFile, err := os.Open(targetFilePath)
-	if err != nil {
-		return fmt.Errorf("error opening target file %q: %w", targetFilePath, err)
+	processedSymlinks := make(map[string]bool)
+	run := processSymlinks
+	if opts.tui {
+		run = runTUI
+	}
+	stopHeartbeat := func() {}
+	if opts.heartbeat > 0 && !opts.tui {
+		stopHeartbeat = startHeartbeat(opts, opts.heartbeat)
+	}
+	stopStats := func() {}
+	if opts.statsInterval > 0 && !opts.tui {
+		stopStats = printStats(opts, opts.statsInterval)
+	}
+	var runErr error
+	if opts.filesFrom != "" {
+		if runErr = processFileList(opts, processedSymlinks); runErr != nil {
+			coloredPrintf(redColor, "Error processing symlinks: %v\n", runErr)
+		}
 	}
-	defer inputFile.Close()
+	for _, root := range opts.roots {
+		opts.targetDir = root
+		if runErr = run(opts, processedSymlinks); runErr != nil {
+			coloredPrintf(redColor, "Error processing symlinks: %v\n", runErr)
+			break
+		}
+	}
+	stopStats()
+	stopHeartbeat()
 
-	// Copy the content to the temporary file
-	if _, err = io.Copy(tempFile, inputFile); err != nil {
-		return fmt.Errorf("error copying data to temporary file: %w", err)
+	if opts.stats.reportFile != nil {
+		if err := opts.stats.reportFile.Close(); err != nil && runErr == nil {
+			runErr = fmt.Errorf("failed to write broken symlinks report: %w", err)
+		}
+		coloredPrintf(headerColor, "Broken symlinks reported in %s\n", opts.brokenReport)
 	}
 
-	// Get the original file's metadata to replicate it
-	originalFileInfo, err := os.Stat(targetFilePath)
-	if err != nil {
-		return fmt.Errorf("error getting file info for %q: %w", targetFilePath, err)
+	// Check the converted files once everything is done
+	if runErr == nil && opts.verifyAfter {
+		if failed := verifyConversions(opts.stats.conversions); failed > 0 {
+			runErr = fmt.Errorf("verification failed for %d files", failed)
+		}
 	}
 
-	// Set the file metadata to match the original file
-	if err := tempFile.Chmod(originalFileInfo.Mode()); err != nil {
-		return fmt.Errorf("error setting file mode: %w", err)
+	if history := opts.stats.history; history != nil {
+		failures := opts.stats.inaccessible
+		if runErr != nil {
+			failures = append([]string{runErr.Error()}, failures...)
+		}
+		if err := history.finish(opts, runStatus(opts, runErr), failures); err != nil {
+			coloredPrintf(redColor, "Warning: the run could not be recorded in the history: %v\n", err)
+		}
 	}
 
-	// Close the temporary file before moving it
-	if err := tempFile.Close(); err != nil {
-		return fmt.Errorf("error closing temporary file: %w", err)
+	// The post-hook runs even if processing failed, so that it can e.g. resume a paused consumer
+	if opts.postHook != "" {
+		status := "success"
+		if runErr != nil {
+			status = "failure"
+		}
+		if err := runHook(opts.postHook,
+			"SYMLINK2FILE_ROOTS="+strings.Join(opts.roots, ":"),
+			"SYMLINK2FILE_STATUS="+status,
+			"SYMLINK2FILE_PROCESSED="+strconv.Itoa(countProcessed(processedSymlinks))); err != nil {
+			coloredPrintf(redColor, "Post-hook failed: %v\n", err)
+			finishStatusFile(opts, countProcessed(processedSymlinks), fmt.Errorf("post-hook failed: %w", err))
+			os.Exit(1)
+		}
 	}
+	finishStatusFile(opts, countProcessed(processedSymlinks), runErr)
 
-	// Remove the symlink
-	if err := os.Remove(symlinkPath); err != nil {
-		return fmt.Errorf("error removing symlink %q: %w", symlinkPath, err)
+	// A machine-readable summary replaces the messages below, including on failure
+	if opts.summary != "text" {
+		if err := printSummary(opts, summarize(opts, processedSymlinks, runErr)); err != nil {
+			coloredPrintf(redColor, "Error writing the summary: %v\n", err)
+			os.Exit(1)
+		}
+		switch runStatus(opts, runErr) {
+		case "failure":
+			os.Exit(1)
+		case "partial":
+			os.Exit(3)
+		}
+		return
+	}
+	if runErr != nil {
+		os.Exit(1)
 	}
 
-	// Rename temporary file to final location
-	if err := os.Rename(tempPath, symlinkPath); err != nil {
-		return fmt.Errorf("error moving temporary file to final location: %w", err)
+	coloredPrintf(greenColor, "Symlink replacement complete. Processed %d symlinks.\n", countProcessed(processedSymlinks))
+	if opts.stats.chains > 0 && !opts.verbose {
+		fmt.Fprintf(output, "Found %d symlink chains (use -v to show every hop).\n", opts.stats.chains)
+	} else if opts.stats.chains > 0 {
+		fmt.Fprintf(output, "Found %d symlink chains.\n", opts.stats.chains)
+	}
+	if opts.stats.loops > 0 {
+		fmt.Fprintf(output, "%d symlink loops found.\n", opts.stats.loops)
+	}
+	if len(opts.stats.tasks) > 0 {
+		printTaskSummary(opts.stats.tasks)
+	}
+	if opts.stats.lowerCopies > 0 {
+		fmt.Fprintf(output, "%d files were copied from a lower overlayfs layer into the upper layer.\n", opts.stats.lowerCopies)
+	}
+	if opts.stats.cacheHits > 0 && opts.dedupStore != "" {
+		fmt.Fprintf(output, "%d files share their storage with identical copies in the dedup store.\n", opts.stats.cacheHits)
+	} else if opts.stats.cacheHits > 0 {
+		fmt.Fprintf(output, "%d files were taken from the copy cache.\n", opts.stats.cacheHits)
+	}
+	// Symlinks left as they are for review or for a later run
+	for _, list := range []struct {
+		paths  []string
+		reason string
+	}{
+		{opts.stats.refused, "were refused because their targets are outside -restrict-targets"},
+		{opts.stats.crossFS, "lead to another filesystem and were left for review"},
+		{opts.stats.tooLarge, "were kept because their targets are larger than " + formatBytes(opts.maxFileSize)},
+		{opts.stats.inUse, "were not converted because their targets were being written (run again later)"},
+		{opts.stats.readOnly, "were skipped because their directories are read-only or immutable"},
+		{opts.stats.sockets, "lead to sockets and were not converted (sockets cannot be copied)"},
+	} {
+		if len(list.paths) == 0 {
+			continue
+		}
+		fmt.Fprintf(output, "%d symlinks %s:\n", len(list.paths), list.reason)
+		for _, path := range list.paths {
+			fmt.Fprintln(output, "  "+displayPath(path))
+		}
+	}
+	for _, snapshot := range opts.stats.snapshots {
+		fmt.Fprintln(output, "Snapshot taken before the run:", snapshot)
 	}
 
-	// Set the file times after the move
-	if err := os.Chtimes(symlinkPath, originalFileInfo.ModTime(), originalFileInfo.ModTime()); err != nil {
-		return fmt.Errorf("error setting file times: %w", err)
+	if opts.stats.deferred > 0 {
+		fmt.Fprintf(output, "Copy budget of %s reached: %d symlinks (%s) were deferred to the next run.\n",
+			formatBytes(opts.maxTotalBytes), opts.stats.deferred, formatBytes(opts.stats.deferredBytes))
 	}
 
-	return nil
+	// Some of the tree could not be read or converted: the run is only a partial success
+	if len(opts.stats.inaccessible) > 0 {
+		coloredPrintf(redColor, "%d locations could not be read:\n", len(opts.stats.inaccessible))
+		for _, location := range opts.stats.inaccessible {
+			fmt.Fprintln(output, "  "+location)
+		}
+	}
+	if opts.stats.outOfSpace {
+		coloredPrintf(redColor, "Out of quota or disk space: %d symlinks were not converted; about %s more space is needed to finish\n",
+			opts.stats.spacePending, formatBytes(opts.stats.spaceNeeded))
+	}
+	if len(opts.stats.inaccessible) > 0 || opts.stats.outOfSpace {
+		os.Exit(3)
+	}
 }
@@ -0,0 +1,698 @@
+package main
+
+// Linux implementation of the system-dependent operations (the fallbacks for other systems are in sys_nonlinux.go)
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Flags for the *at family of system calls (not exported by the syscall package)
+const (
+	atFdcwd           = -0x64 // Use the current working directory
+	atSymlinkNofollow = 0x100 // Do not dereference symlinks
+)
+
+// Read-only mount flag reported by statfs
+const stRdonly = 0x1
+
+// Longest path accepted by the kernel
+const pathMax = syscall.PathMax
+
+// Get the type, state and free space of the filesystem of a path
+func statFS(path string) (fsStat, error) {
+	fd, err := openLong(path, oPath)
+	if err != nil {
+		return fsStat{}, err
+	}
+	defer syscall.Close(fd)
+	var stat syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &stat); err != nil {
+		return fsStat{}, err
+	}
+	return fsStat{
+		magic:     uint32(stat.Type),
+		readOnly:  stat.Flags&stRdonly != 0,
+		available: int64(stat.Bavail) * int64(stat.Bsize),
+		total:     int64(stat.Blocks) * int64(stat.Bsize),
+		files:     uint64(stat.Files),
+		freeFiles: uint64(stat.Ffree),
+	}, nil
+}
+
+// Whence values of lseek finding the data and the holes of sparse files
+const (
+	sparseSeek = true
+	seekData   = 3
+	seekHole   = 4
+)
+
+// Request for the FICLONE ioctl (reflink copy on filesystems supporting it, e.g. Btrfs or XFS)
+const ficlone = 0x40049409
+
+// Make a file share the data blocks of another one (reflink), on filesystems supporting it
+func reflink(dest, source *os.File) error {
+	return ioctl(dest.Fd(), ficlone, source.Fd())
+}
+
+// Request of the FS_IOC_GETFLAGS ioctl (inode flags set by chattr; its size is that of a long), and the immutable flag
+const (
+	fsIocGetflags = 2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+	fsImmutableFl = 0x10
+)
+
+// Check if a file or directory is immutable (chattr +i): the entries of an immutable directory cannot be
+// created, renamed or removed, even by root
+func immutable(path string) bool {
+	file, err := openLongPath(path, os.O_RDONLY)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	var flags int32
+	return ioctl(file.Fd(), fsIocGetflags, uintptr(unsafe.Pointer(&flags))) == nil && flags&fsImmutableFl != 0
+}
+
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// List the names of the extended attributes of a file
+func listXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00"), nil
+}
+
+// Error of getxattr for an attribute the file does not have
+var errNoXattr error = syscall.ENODATA
+
+// Get the value of an extended attribute of a file
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(path, name, value); err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// Set an extended attribute of a file
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+// Extended attributes of an open file (the syscall package only wraps the calls taking a path)
+func listFileXattrs(file *os.File) ([]string, error) {
+	size, err := fileXattrCall(syscall.SYS_FLISTXATTR, file, nil, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = fileXattrCall(syscall.SYS_FLISTXATTR, file, nil, names); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00"), nil
+}
+
+func getFileXattr(file *os.File, name string) ([]byte, error) {
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fileXattrCall(syscall.SYS_FGETXATTR, file, namePtr, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size, err = fileXattrCall(syscall.SYS_FGETXATTR, file, namePtr, value); err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func setFileXattr(file *os.File, name string, value []byte) error {
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, err = fileXattrCall(syscall.SYS_FSETXATTR, file, namePtr, value)
+	return err
+}
+
+// Call flistxattr (without a name), fgetxattr or fsetxattr (flags 0) with a buffer, returning the size reported
+func fileXattrCall(trap uintptr, file *os.File, name *byte, buffer []byte) (int, error) {
+	var bufferPtr unsafe.Pointer
+	if len(buffer) > 0 {
+		bufferPtr = unsafe.Pointer(&buffer[0])
+	}
+	var r uintptr
+	var errno syscall.Errno
+	if name == nil {
+		r, _, errno = syscall.Syscall(trap, file.Fd(), uintptr(bufferPtr), uintptr(len(buffer)))
+	} else {
+		r, _, errno = syscall.Syscall6(trap, file.Fd(), uintptr(unsafe.Pointer(name)), uintptr(bufferPtr), uintptr(len(buffer)), 0, 0)
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// Get the access time of a file
+func accessTime(info fs.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
+
+// Set access and modification times of a path without dereferencing it if it is a symlink
+func lutimes(path string, atime, mtime time.Time) error {
+	return utimensatNofollow(atFdcwd, path, atime, mtime)
+}
+
+// Set access and modification times of a path relative to a directory descriptor, without dereferencing symlinks
+func utimensatNofollow(dirfd int, path string, atime, mtime time.Time) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	times := [2]syscall.Timespec{syscall.NsecToTimespec(atime.UnixNano()), syscall.NsecToTimespec(mtime.UnixNano())}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&times[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Get the metadata of a path relative to a directory descriptor, without dereferencing symlinks
+// (fstatat has a different system call on each architecture: the path is opened with O_PATH instead,
+// which refers to the symlink itself with O_NOFOLLOW)
+func lstatat(dirfd int, path string, stat *syscall.Stat_t) error {
+	fd, err := syscall.Openat(dirfd, path, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.Fstat(fd, stat)
+}
+
+// Create a FIFO or a device node like an existing one, with its permissions
+func (d *dirHandle) makeNode(name string, info fs.FileInfo) error {
+	mode := uint32(syscall.S_IFIFO)
+	switch {
+	case info.Mode()&os.ModeCharDevice != 0:
+		mode = syscall.S_IFCHR
+	case info.Mode()&os.ModeDevice != 0:
+		mode = syscall.S_IFBLK
+	}
+	var device int
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		device = int(stat.Rdev)
+	}
+	if err := syscall.Mknodat(d.fd, name, mode|uint32(info.Mode().Perm()), device); err != nil {
+		return err
+	}
+	return syscall.Fchmodat(d.fd, name, uint32(info.Mode().Perm()), 0) // Not limited by the umask
+}
+
+// Get the path of an open file, as resolved by the kernel when it was opened
+func openedPath(file *os.File) (string, error) {
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(int(file.Fd())))
+}
+
+// Open a path of any length: the kernel refuses paths longer than PATH_MAX, so these are opened relative to
+// the longest leading directory that fits, one component at a time (without following the directories if they are symlinks)
+func openLong(path string, flags int) (int, error) {
+	if len(path) < pathMax {
+		return syscall.Open(path, flags|syscall.O_CLOEXEC, 0)
+	}
+	split := strings.LastIndex(path[:pathMax-1], "/")
+	if split <= 0 {
+		return -1, syscall.ENAMETOOLONG // A single component is longer than PATH_MAX
+	}
+	dirfd, err := syscall.Open(path[:split], syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	rest := path[split+1:]
+	for {
+		component, remaining, more := strings.Cut(rest, "/")
+		if !more {
+			fd, err := syscall.Openat(dirfd, component, flags|syscall.O_CLOEXEC, 0)
+			syscall.Close(dirfd)
+			return fd, err
+		}
+		rest = remaining
+		if component == "" {
+			continue
+		}
+		fd, err := syscall.Openat(dirfd, component, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			return -1, err
+		}
+		dirfd = fd
+	}
+}
+
+// Open a file with os.OpenFile flags (read-only), also if its path is longer than PATH_MAX
+func openLongPath(path string, flag int) (*os.File, error) {
+	fd, err := openLong(path, flag)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Get the metadata of a path of any length, without following it if it is a symlink
+func lstatLong(path string) (fs.FileInfo, error) {
+	if len(path) < pathMax {
+		return os.Lstat(path)
+	}
+	return statOpened(path, oPath|syscall.O_NOFOLLOW)
+}
+
+// Get the metadata of a path of any length, following it if it is a symlink
+func statLong(path string) (fs.FileInfo, error) {
+	if len(path) < pathMax {
+		return os.Stat(path)
+	}
+	return statOpened(path, oPath)
+}
+
+func statOpened(path string, flags int) (fs.FileInfo, error) {
+	fd, err := openLong(path, flags)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	return file.Stat()
+}
+
+// Read the destination of a symlink at a path of any length
+func readlinkLong(path string) (string, error) {
+	if len(path) < pathMax {
+		return os.Readlink(path)
+	}
+	parent, err := openDirHandle(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	defer parent.Close()
+	dest, err := parent.readlink(filepath.Base(path))
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	return dest, nil
+}
+
+// Resolve all symlinks of a path of any length (by the kernel, which reports the path of the file it opened;
+// fails with ENAMETOOLONG if the resolved path is longer than a page)
+func evalSymlinksLong(path string) (string, error) {
+	if len(path) < pathMax {
+		return filepath.EvalSymlinks(path)
+	}
+	fd, err := openLong(path, oPath)
+	if err != nil {
+		return "", &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+}
+
+// Open directory, whose entries are accessed relative to it, not through their paths: the directory of a symlink
+// is held open while the symlink is replaced (see replaceSymlinkWithFile), and the walk opens each directory
+// relative to its parent (see walkTree), so that neither is limited by the length of the paths
+type dirHandle struct {
+	file *os.File
+	fd   int
+}
+
+func openDirHandle(dir string) (*dirHandle, error) {
+	fd, err := openLong(dir, syscall.O_RDONLY|syscall.O_DIRECTORY)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return &dirHandle{file: os.NewFile(uintptr(fd), dir), fd: fd}, nil
+}
+
+// Open a subdirectory (not followed if it is a symlink)
+func (d *dirHandle) openDir(name string) (*dirHandle, error) {
+	path := filepath.Join(d.file.Name(), name)
+	fd, err := syscall.Openat(d.fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &dirHandle{file: os.NewFile(uintptr(fd), path), fd: fd}, nil
+}
+
+// List the entries of the directory, sorted by name
+func (d *dirHandle) readDir() ([]fs.DirEntry, error) {
+	entries, err := d.file.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// Get the metadata of an entry, following it if it is a symlink (relative links are resolved from the directory);
+// the file is only referred to (O_PATH), so that FIFOs and devices are not opened
+func (d *dirHandle) stat(name string) (fs.FileInfo, error) {
+	path := filepath.Join(d.file.Name(), name)
+	fd, err := syscall.Openat(d.fd, name, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	return file.Stat()
+}
+
+// Open an entry for reading, following it if it is a symlink (without blocking if it has become a FIFO)
+func (d *dirHandle) open(name string) (*os.File, error) {
+	path := filepath.Join(d.file.Name(), name)
+	fd, err := syscall.Openat(d.fd, name, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Read the destination of a symlink
+func (d *dirHandle) readlink(name string) (string, error) {
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	for size := 256; ; size *= 2 {
+		buffer := make([]byte, size)
+		n, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(d.fd), uintptr(unsafe.Pointer(namePtr)),
+			uintptr(unsafe.Pointer(&buffer[0])), uintptr(size), 0, 0)
+		if errno != 0 {
+			return "", errno
+		}
+		if int(n) < size {
+			return string(buffer[:n]), nil
+		}
+	}
+}
+
+func (d *dirHandle) mkdir(name string, perm os.FileMode) error {
+	return syscall.Mkdirat(d.fd, name, uint32(perm.Perm()))
+}
+
+// Create a symlink to dest
+func (d *dirHandle) symlink(dest, name string) error {
+	destPtr, err := syscall.BytePtrFromString(dest)
+	if err != nil {
+		return err
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(destPtr)), uintptr(d.fd), uintptr(unsafe.Pointer(namePtr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (d *dirHandle) Close() error {
+	return d.file.Close()
+}
+
+// Get the inode of an entry, and whether it is a symlink (without following it)
+func (d *dirHandle) lstat(name string) (ino uint64, symlink bool, err error) {
+	var stat syscall.Stat_t
+	if err := lstatat(d.fd, name, &stat); err != nil {
+		return 0, false, err
+	}
+	return stat.Ino, stat.Mode&syscall.S_IFMT == syscall.S_IFLNK, nil
+}
+
+// Create a new temporary file in the directory (named with its full path)
+func (d *dirHandle) createTemp() (file *os.File, name string, err error) {
+	name, err = createTempEntry(func(name string) (err error) {
+		file, err = d.create(name, 0600)
+		return err
+	})
+	return file, name, err
+}
+
+// Create a hard link to a file (given by its path)
+func (d *dirHandle) link(oldPath, name string) error {
+	oldPtr, err := syscall.BytePtrFromString(oldPath)
+	if err != nil {
+		return err
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	cwd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(cwd), uintptr(unsafe.Pointer(oldPtr)), uintptr(d.fd), uintptr(unsafe.Pointer(namePtr)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Create a new file (not following a symlink in its place)
+func (d *dirHandle) create(name string, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(d.file.Name(), name)
+	fd, err := syscall.Openat(d.fd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Change the owner of an entry (without following symlinks)
+func (d *dirHandle) lchown(name string, uid, gid int) error {
+	return syscall.Fchownat(d.fd, name, uid, gid, atSymlinkNofollow)
+}
+
+func (d *dirHandle) remove(name string) error {
+	return syscall.Unlinkat(d.fd, name)
+}
+
+func (d *dirHandle) rename(oldName, newName string) error {
+	return syscall.Renameat(d.fd, oldName, d.fd, newName)
+}
+
+// Set the access and modification times of an entry (without following symlinks)
+func (d *dirHandle) setTimes(name string, atime, mtime time.Time) error {
+	return utimensatNofollow(d.fd, name, atime, mtime)
+}
+
+// Switch the terminal to raw mode; the returned function restores the previous state
+func makeRawTerminal() (func(), error) {
+	fd := os.Stdin.Fd()
+	var original syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&original))); err != nil {
+		return nil, fmt.Errorf("standard input is not a terminal: %w", err)
+	}
+
+	raw := original
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&original)))
+	}, nil
+}
+
+// Get the terminal height and width (defaults to 24x80 if unknown)
+func terminalSize() (rows, cols int) {
+	var size struct{ rows, cols, x, y uint16 }
+	if err := ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); err != nil || size.rows == 0 {
+		return 24, 80
+	}
+	return int(size.rows), int(size.cols)
+}
+
+// Landlock system calls and access rights (linux/landlock.h)
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+	prSetNoNewPrivs              = 38
+	prGetNoNewPrivs              = 39
+	oPath                        = 0x200000
+
+	landlockWriteFile  = 1 << 1
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	landlockRefer      = 1 << 13
+	landlockTruncate   = 1 << 14
+)
+
+// Rule of a Landlock ruleset (struct landlock_path_beneath_attr is packed,
+// the kernel reads only the first 12 bytes)
+type landlockPathBeneath struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// Environment variable marking a process re-executed inside the sandbox, set to the descriptor of the ruleset
+const sandboxedEnv = "SYMLINK2FILE_SANDBOXED"
+
+// Check the marker of a process re-executed inside the sandbox (see enterSandbox): it must name the descriptor of
+// a Landlock ruleset kept open across the exec, in a process that cannot gain privileges anymore
+// A marker inherited from the environment of another process (e.g. a hook) does not pass these checks
+func restartedInSandbox() bool {
+	marker := os.Getenv(sandboxedEnv)
+	os.Unsetenv(sandboxedEnv)
+	fd, err := strconv.Atoi(marker)
+	if err != nil || fd <= 2 {
+		return false
+	}
+	if target, err := os.Readlink("/proc/self/fd/" + marker); err != nil || target != "anon_inode:[landlock-ruleset]" {
+		return false
+	}
+	syscall.Close(fd)
+	noNewPrivs, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetNoNewPrivs, 0, 0)
+	return errno == 0 && noNewPrivs == 1
+}
+
+// Get the version of the Landlock ABI supported by the kernel (0 if none)
+func landlockABI() int {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(abi)
+}
+
+// Restrict the process with Landlock so that it can only modify the roots, the copy cache or dedup store,
+// the quarantine or trash directory, the report of broken symlinks and the history
+// Reading stays unrestricted, as the targets are only known while walking
+func enterSandbox(opts *options) error {
+	_, marked := os.LookupEnv(sandboxedEnv)
+	if marked {
+		if restartedInSandbox() {
+			return nil
+		}
+		coloredPrintf(redColor, "Warning: ignoring %s, which was not set by symlink2file itself\n", sandboxedEnv)
+	}
+
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("Landlock is not available in this kernel: %w", errno)
+	}
+
+	// Rights added by later versions of Landlock are only handled if the kernel knows them
+	handled := uint64(landlockWriteFile | landlockRemoveDir | landlockRemoveFile | landlockMakeChar | landlockMakeDir |
+		landlockMakeReg | landlockMakeSock | landlockMakeFifo | landlockMakeBlock | landlockMakeSym)
+	fileRights := uint64(landlockWriteFile)
+	if abi >= 2 {
+		handled |= landlockRefer
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+		fileRights |= landlockTruncate
+	}
+
+	dirs, files, err := sandboxPaths(opts)
+	if err != nil {
+		return err
+	}
+	rules := make(map[string]uint64)
+	for _, dir := range dirs {
+		rules[dir] = handled
+	}
+	for _, file := range files {
+		rules[file] = fileRights
+	}
+
+	attr := handled
+	rulesetFd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create Landlock ruleset: %w", errno)
+	}
+	defer syscall.Close(int(rulesetFd))
+
+	for path, access := range rules {
+		fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s for the sandbox: %w", path, err)
+		}
+		rule := landlockPathBeneath{allowedAccess: access, parentFd: int32(fd)}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, rulesetFd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		syscall.Close(fd)
+		if errno != 0 {
+			return fmt.Errorf("failed to allow %s in the sandbox: %w", path, errno)
+		}
+	}
+
+	// Landlock restricts only the calling thread, so every thread of the runtime enters the sandbox
+	_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno == 0 {
+		if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, rulesetFd, 0, 0); errno != 0 {
+			return fmt.Errorf("failed to enter the Landlock sandbox: %w", errno)
+		}
+		return nil
+	}
+	if errno != syscall.ENOTSUP {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+
+	// Binaries built with cgo cannot change all threads at once: restrict this thread
+	// and replace the process by a new one, whose threads all inherit the restriction
+	// (unless this process is such a restart whose marker could not be checked, which would restart forever)
+	if marked {
+		return fmt.Errorf("cannot restart inside the sandbox, as the marker of a restart could not be checked")
+	}
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, rulesetFd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enter the Landlock sandbox: %w", errno)
+	}
+	// The ruleset is kept open across the exec as the proof that the new process was restarted from here
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_FCNTL, rulesetFd, syscall.F_SETFD, 0); errno != 0 {
+		return fmt.Errorf("failed to keep the Landlock ruleset open: %w", errno)
+	}
+	os.Setenv(sandboxedEnv, strconv.Itoa(int(rulesetFd)))
+	return fmt.Errorf("failed to restart inside the sandbox: %w", syscall.Exec("/proc/self/exe", os.Args, os.Environ()))
+}
@@ -0,0 +1,267 @@
+//go:build !linux
+
+package main
+
+// Fallbacks for the operations that rely on Linux system calls (see sys_linux.go): the features that depend on them
+// are reported as unsupported, and the others use the portable functions of the os package
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest path accepted by the kernel (PATH_MAX of macOS and the BSDs)
+const pathMax = 1024
+
+// Get the type, state and free space of the filesystem of a path (not reported on this system)
+func statFS(path string) (fsStat, error) {
+	return fsStat{}, errors.ErrUnsupported
+}
+
+// Make a file share the data blocks of another one (reflinks are only made on Linux)
+func reflink(dest, source *os.File) error {
+	return errors.ErrUnsupported
+}
+
+// The holes of sparse files are only looked for on Linux (the whence values of lseek differ between systems),
+// elsewhere they are copied as zeros
+const (
+	sparseSeek = false
+	seekData   = 3
+	seekHole   = 4
+)
+
+// Extended attributes are only handled on Linux
+var errNoXattr = errors.New("no such attribute")
+
+func listXattrs(path string) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func listFileXattrs(file *os.File) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func getFileXattr(file *os.File, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func setFileXattr(file *os.File, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+// Immutable files are only detected on Linux (the flags of chflags are not checked)
+func immutable(path string) bool {
+	return false
+}
+
+// Get the access time of a file (the modification time, as the field differs between systems)
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// Set access and modification times of a path, except for symlinks, whose times cannot be set without following them here
+func lutimes(path string, atime, mtime time.Time) error {
+	if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// Create a FIFO or a device node like an existing one (only on Linux)
+func (d *dirHandle) makeNode(name string, info fs.FileInfo) error {
+	return errors.ErrUnsupported
+}
+
+// Get the path of an open file (resolved again from its name, as the kernel does not report it here)
+func openedPath(file *os.File) (string, error) {
+	return filepath.EvalSymlinks(file.Name())
+}
+
+// Open a file with os.OpenFile flags (paths are limited to PATH_MAX here)
+func openLongPath(path string, flag int) (*os.File, error) {
+	return os.OpenFile(path, flag, 0)
+}
+
+// Paths are limited to PATH_MAX here (see sys_linux.go)
+func lstatLong(path string) (fs.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func statLong(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func readlinkLong(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func evalSymlinksLong(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+// Open directory (see sys_linux.go); without the *at system calls, its entries are accessed through their paths
+type dirHandle struct {
+	path string
+}
+
+func openDirHandle(dir string) (*dirHandle, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &dirHandle{path: dir}, nil
+}
+
+func (d *dirHandle) Close() error {
+	return nil
+}
+
+// Open a subdirectory (not followed if it is a symlink)
+func (d *dirHandle) openDir(name string) (*dirHandle, error) {
+	path := filepath.Join(d.path, name)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errors.New("not a directory")}
+	}
+	return &dirHandle{path: path}, nil
+}
+
+// List the entries of the directory, sorted by name
+func (d *dirHandle) readDir() ([]fs.DirEntry, error) {
+	return os.ReadDir(d.path)
+}
+
+// Get the metadata of an entry, following it if it is a symlink
+func (d *dirHandle) stat(name string) (fs.FileInfo, error) {
+	return os.Stat(filepath.Join(d.path, name))
+}
+
+// Open an entry for reading, following it if it is a symlink
+func (d *dirHandle) open(name string) (*os.File, error) {
+	return os.Open(filepath.Join(d.path, name))
+}
+
+func (d *dirHandle) readlink(name string) (string, error) {
+	return os.Readlink(filepath.Join(d.path, name))
+}
+
+func (d *dirHandle) mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(filepath.Join(d.path, name), perm)
+}
+
+func (d *dirHandle) symlink(dest, name string) error {
+	return os.Symlink(dest, filepath.Join(d.path, name))
+}
+
+// Get the inode of an entry (0 where not reported), and whether it is a symlink (without following it)
+func (d *dirHandle) lstat(name string) (ino uint64, symlink bool, err error) {
+	info, err := os.Lstat(filepath.Join(d.path, name))
+	if err != nil {
+		return 0, false, err
+	}
+	_, ino, _ = fileID(info)
+	return ino, info.Mode()&os.ModeSymlink != 0, nil
+}
+
+// Create a new temporary file in the directory (named with its full path)
+func (d *dirHandle) createTemp() (file *os.File, name string, err error) {
+	name, err = createTempEntry(func(name string) (err error) {
+		file, err = d.create(name, 0600)
+		return err
+	})
+	return file, name, err
+}
+
+// Create a hard link to a file (given by its path)
+func (d *dirHandle) link(oldPath, name string) error {
+	return os.Link(oldPath, filepath.Join(d.path, name))
+}
+
+// Create a new file (not following a symlink in its place)
+func (d *dirHandle) create(name string, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Join(d.path, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL|oNofollow, perm.Perm())
+}
+
+func (d *dirHandle) lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(d.path, name), uid, gid)
+}
+
+func (d *dirHandle) remove(name string) error {
+	return os.Remove(filepath.Join(d.path, name))
+}
+
+func (d *dirHandle) rename(oldName, newName string) error {
+	return os.Rename(filepath.Join(d.path, oldName), filepath.Join(d.path, newName))
+}
+
+// Set the access and modification times of an entry (not of symlinks)
+func (d *dirHandle) setTimes(name string, atime, mtime time.Time) error {
+	return lutimes(filepath.Join(d.path, name), atime, mtime)
+}
+
+// Switch the terminal to raw mode with stty (not available on Windows); the returned function restores the previous state
+func makeRawTerminal() (func(), error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	original, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("standard input is not a terminal: %w", err)
+	}
+	if _, err := stty("-icrnl", "-ixon", "-echo", "-icanon", "-isig", "-iexten", "min", "1", "time", "0"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(original)
+	}, nil
+}
+
+// Get the terminal height and width (defaults to 24x80 if unknown)
+func terminalSize() (rows, cols int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return 24, 80
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return 24, 80
+	}
+	rows, rowsErr := strconv.Atoi(fields[0])
+	cols, colsErr := strconv.Atoi(fields[1])
+	if rowsErr != nil || colsErr != nil || rows == 0 {
+		return 24, 80
+	}
+	return rows, cols
+}
+
+// Landlock is a Linux security module
+func landlockABI() int {
+	return 0
+}
@@ -0,0 +1,50 @@
+//go:build !unix
+
+package main
+
+// Fallbacks for the file metadata and process attributes of Unix systems (see sys_unix.go)
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Symlinks cannot be refused when opening files here
+const oNofollow = 0
+
+// File owners, inodes and device numbers are not reported on this system
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func fileID(info fs.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+func deviceNumber(info fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func allocatedSize(info fs.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+// There is no umask on this system
+func currentUmask() os.FileMode {
+	return 0
+}
+
+func switchUser(uid, gid int, groups []int) error {
+	return errors.New("switching users is not supported on this system")
+}
+
+// Write permissions are only known by trying (the copies report the errors)
+func checkWritable(dir string) error {
+	return nil
+}
+
+func newSyslog() (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not available on this system")
+}
@@ -0,0 +1,99 @@
+//go:build openbsd
+
+package main
+
+// Sandbox of OpenBSD (-sandbox), with unveil(2) and pledge(2). OpenBSD only accepts system calls made by libc, so
+// both are called through the trampolines of sys_openbsd.s (as golang.org/x/sys/unix does)
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+//go:cgo_import_dynamic libc_pledge pledge "libc.so"
+//go:cgo_import_dynamic libc_unveil unveil "libc.so"
+
+var libc_pledge_trampoline_addr uintptr
+var libc_unveil_trampoline_addr uintptr
+
+// Call a libc function from its trampoline (implemented by the runtime)
+//
+//go:linkname syscall_syscall syscall.syscall
+func syscall_syscall(fn, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+// Promises of the process in the sandbox: the files, the processes of the hooks, the terminal, and the user and
+// groups of -run-as
+const sandboxPromises = "stdio rpath wpath cpath dpath fattr chown flock tty proc exec getpw id"
+
+// Promises of the hooks and the decider, which keep the unveiled paths of the process: the network is not restricted,
+// as with Landlock on Linux
+const sandboxExecPromises = sandboxPromises + " tmppath prot_exec inet dns unix"
+
+// Make only the given path visible with the given permissions (and the ones unveiled before);
+// with an empty path, no more paths can be unveiled
+func unveil(path, permissions string) error {
+	var pathPtr, permissionsPtr *byte
+	if path != "" {
+		var err error
+		if pathPtr, err = syscall.BytePtrFromString(path); err != nil {
+			return err
+		}
+		if permissionsPtr, err = syscall.BytePtrFromString(permissions); err != nil {
+			return err
+		}
+	}
+	_, _, errno := syscall_syscall(libc_unveil_trampoline_addr, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(permissionsPtr)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Restrict the process, and the programs it runs, to the system calls of the given promises
+func pledge(promises, execPromises string) error {
+	promisesPtr, err := syscall.BytePtrFromString(promises)
+	if err != nil {
+		return err
+	}
+	execPromisesPtr, err := syscall.BytePtrFromString(execPromises)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall_syscall(libc_pledge_trampoline_addr, uintptr(unsafe.Pointer(promisesPtr)), uintptr(unsafe.Pointer(execPromisesPtr)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Restrict the process with unveil so that it can only modify the roots, the copy cache or dedup store,
+// the quarantine or trash directory, the report of broken symlinks and the history, as Landlock does on Linux
+// Reading stays unrestricted, as the targets are only known while walking; the hooks and the decider inherit
+// the restriction through the promises they run with
+func enterSandbox(opts *options) error {
+	dirs, files, err := sandboxPaths(opts)
+	if err != nil {
+		return err
+	}
+	if err := unveil("/", "rx"); err != nil {
+		return fmt.Errorf("failed to unveil /: %w", err)
+	}
+	for _, dir := range dirs {
+		if err := unveil(dir, "rwxc"); err != nil {
+			return fmt.Errorf("failed to allow %s in the sandbox: %w", dir, err)
+		}
+	}
+	for _, file := range files {
+		if err := unveil(file, "rw"); err != nil {
+			return fmt.Errorf("failed to allow %s in the sandbox: %w", file, err)
+		}
+	}
+	if err := unveil("", ""); err != nil {
+		return fmt.Errorf("failed to lock the unveiled paths: %w", err)
+	}
+	if err := pledge(sandboxPromises, sandboxExecPromises); err != nil {
+		return fmt.Errorf("failed to enter the sandbox: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build openbsd
+
+#include "textflag.h"
+
+// Trampolines to the libc functions called by sys_openbsd.go
+
+TEXT libc_pledge_trampoline<>(SB),NOSPLIT,$0-0
+#ifdef GOARCH_ppc64
+	CALL	libc_pledge(SB)
+	RET
+#else
+	JMP	libc_pledge(SB)
+#endif
+
+TEXT libc_unveil_trampoline<>(SB),NOSPLIT,$0-0
+#ifdef GOARCH_ppc64
+	CALL	libc_unveil(SB)
+	RET
+#else
+	JMP	libc_unveil(SB)
+#endif
+
+#ifdef GOARCH_386
+#define PTRSIZE 4
+#else
+#ifdef GOARCH_arm
+#define PTRSIZE 4
+#else
+#define PTRSIZE 8
+#endif
+#endif
+
+GLOBL	·libc_pledge_trampoline_addr(SB), RODATA, $PTRSIZE
+DATA	·libc_pledge_trampoline_addr(SB)/PTRSIZE, $libc_pledge_trampoline<>(SB)
+GLOBL	·libc_unveil_trampoline_addr(SB), RODATA, $PTRSIZE
+DATA	·libc_unveil_trampoline_addr(SB)/PTRSIZE, $libc_unveil_trampoline<>(SB)
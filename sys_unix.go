@@ -0,0 +1,88 @@
+//go:build unix
+
+package main
+
+// File metadata and process attributes common to Unix systems (the fallbacks for other systems are in sys_nonunix.go)
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/syslog"
+	"os"
+	"syscall"
+)
+
+// Flag opening a file only if it is not a symlink
+const oNofollow = syscall.O_NOFOLLOW
+
+// Get the owner and group of a file
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// Get the device and inode numbers identifying a file
+func fileID(info fs.FileInfo) (dev, ino uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+// Get the device number of a device node
+func deviceNumber(info fs.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Rdev), true
+}
+
+// Get the disk space allocated to a file (less than its size if it has holes)
+func allocatedSize(info fs.FileInfo) (int64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(stat.Blocks) * 512, true
+}
+
+// Get the umask of the process (it can only be read by setting it)
+func currentUmask() os.FileMode {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return os.FileMode(umask)
+}
+
+// Switch the process to another user, group and supplementary groups
+// (groups first, as changing them needs the privileges given up by Setuid)
+func switchUser(uid, gid int, groups []int) error {
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set the groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set the group: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set the user: %w", err)
+	}
+	return nil
+}
+
+// Write permission mode of access(2)
+const wOK = 0x2
+
+// Check if the process may create and remove files in a directory
+func checkWritable(dir string) error {
+	return syscall.Access(dir, wOK)
+}
+
+// Connect to the system logger
+func newSyslog() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "symlink2file")
+}
@@ -0,0 +1,45 @@
+#!/usr/bin/env python3
+"""Run a command with every rename failing with EXDEV (x86_64 Linux only).
+
+The renames fail as they would on a union filesystem placing new files on another branch than the existing ones.
+"""
+
+import ctypes
+import os
+import platform
+import struct
+import sys
+
+AUDIT_ARCH_X86_64 = 0xC000003E
+SYS_RENAME, SYS_RENAMEAT, SYS_RENAMEAT2 = 82, 264, 316
+EXDEV = 18
+
+PR_SET_NO_NEW_PRIVS, PR_SET_SECCOMP, SECCOMP_MODE_FILTER = 38, 22, 2
+SECCOMP_RET_ALLOW, SECCOMP_RET_ERRNO = 0x7FFF0000, 0x00050000
+LD_W_ABS, JEQ_K, RET_K = 0x20, 0x15, 0x06
+
+if platform.system() != "Linux" or platform.machine() != "x86_64":
+    sys.exit("fail_renames.py only runs on x86_64 Linux")
+
+# Offsets in struct seccomp_data: nr 0, arch 4
+program = [
+    (LD_W_ABS, 0, 0, 4),
+    (JEQ_K, 0, 5, AUDIT_ARCH_X86_64),
+    (LD_W_ABS, 0, 0, 0),
+    (JEQ_K, 2, 0, SYS_RENAME),
+    (JEQ_K, 1, 0, SYS_RENAMEAT),
+    (JEQ_K, 0, 1, SYS_RENAMEAT2),
+    (RET_K, 0, 0, SECCOMP_RET_ERRNO | EXDEV),
+    (RET_K, 0, 0, SECCOMP_RET_ALLOW),
+]
+filters = ctypes.create_string_buffer(b"".join(struct.pack("HBBI", *op) for op in program))
+fprog = struct.pack("HxxxxxxP", len(program), ctypes.addressof(filters))
+fprog_buffer = ctypes.create_string_buffer(fprog)
+
+libc = ctypes.CDLL(None, use_errno=True)
+libc.prctl.argtypes = [ctypes.c_int] + [ctypes.c_ulong] * 4
+if libc.prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) != 0:
+    sys.exit("prctl(PR_SET_NO_NEW_PRIVS): " + os.strerror(ctypes.get_errno()))
+if libc.prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, ctypes.addressof(fprog_buffer), 0, 0) != 0:
+    sys.exit("prctl(PR_SET_SECCOMP): " + os.strerror(ctypes.get_errno()))
+os.execvp(sys.argv[1], sys.argv[1:])
@@ -77,6 +77,28 @@ setup() {
     assert_link_exists ./test_symlinks/.symlink2file/222.txt
 }
 
+@test "broken links, backup policy" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+
+    ./symlink2file -broken-symlinks delete -no-backup ./test_symlinks
+
+    ## Broken link backed up despite --no-backup
+    assert_link_not_exists ./test_symlinks/.symlink2file/111.txt
+    assert_link_exists ./test_symlinks/.symlink2file/222.txt
+
+    rm -rf ./test_symlinks/.symlink2file
+    ln -s "$(pwd)/test_files/333.txt" "./test_symlinks/333.txt"
+    ./symlink2file -broken-symlinks delete -backup-broken no ./test_symlinks
+
+    ## No backup of the broken link
+    assert_link_not_exists ./test_symlinks/333.txt
+    assert_link_not_exists ./test_symlinks/.symlink2file/333.txt
+}
+
 
 @test "backup enabled" {
     rm -rf ./test_files ./test_symlinks/
@@ -186,3 +208,1024 @@ setup() {
     assert_link_exists ./test_symlinks/.symlink2file/final.txt
 }
 
+
+@test "backup keeps symlink timestamps" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    touch -h -d "2001-01-01 00:00:00" ./test_symlinks/111.txt
+    original_mtime=$(stat -c %Y ./test_symlinks/111.txt)
+
+    ./symlink2file ./test_symlinks
+
+    ## Backup symlink carries the original link time
+    backup_mtime=$(stat -c %Y ./test_symlinks/.symlink2file/111.txt)
+    assert_equal $original_mtime $backup_mtime
+}
+
+@test "per-directory config overrides options" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/keep
+    echo 111 > test_files/111.bam
+    echo 222 > test_files/222.txt
+    ln -s "$(pwd)/test_files/111.bam" "./test_symlinks/keep/111.bam"
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/keep/222.txt"
+    ln -s "$(pwd)/test_files/333.txt" "./test_symlinks/keep/333.txt"
+    ln -s "$(pwd)/test_files/333.txt" "./test_symlinks/333.txt"
+    printf 'broken-symlinks: keep\nexclude: ["*.bam"]\n' > ./test_symlinks/keep/.symlink2file.yaml
+
+    ./symlink2file -broken-symlinks delete ./test_symlinks
+
+    ## Excluded symlink and broken symlink kept in the configured subtree
+    assert_link_exists ./test_symlinks/keep/111.bam
+    assert_link_exists ./test_symlinks/keep/333.txt
+
+    ## Other symlinks processed as usual
+    assert_link_not_exists ./test_symlinks/keep/222.txt
+    assert_file_exists ./test_symlinks/keep/222.txt
+    assert_link_not_exists ./test_symlinks/333.txt
+}
+
+@test "current directory by default" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    (cd ./test_symlinks && ../symlink2file)
+
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_file_exists ./test_symlinks/111.txt
+}
+
+@test "print converted paths" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+
+    run --separate-stderr ./symlink2file --print-converted ./test_symlinks
+    assert_success
+    assert_output "$(pwd)/test_symlinks/111.txt"
+}
+
+@test "summary as JSON" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run --separate-stderr ./symlink2file --summary json ./test_symlinks
+    assert_success
+    assert_line --partial '"status": "success"'
+    assert_line --partial '"converted": 1'
+    assert_line --partial '"bytes": 4'
+}
+
+@test "status file" {
+    rm -rf ./test_files ./test_symlinks/ ./status.json
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file --status-file ./status.json ./test_symlinks
+    assert_success
+    assert_file_contains ./status.json '"status": "success"'
+
+    run ./symlink2file --status-file ./status.json --pre-hook false ./test_symlinks
+    assert_failure
+    assert_file_contains ./status.json '"status": "failure"'
+    rm -f ./status.json
+}
+
+@test "cron schedules in the daemon mode" {
+    rm -rf ./test_files ./test_symlinks/ ./test_daemon.log
+    mkdir -p ./test_files ./test_symlinks/hourly ./test_symlinks/nightly
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/hourly/111.txt"
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/nightly/111.txt"
+
+    ## Invalid expressions are refused
+    run ./symlink2file --daemon --cron "./test_symlinks/nightly=61 * * * *"
+    assert_failure
+    assert_line --partial "Invalid cron expression"
+
+    ## The root without a schedule is converted at once, the nightly one waits for 02:00
+    port=$((20000 + RANDOM % 10000))
+    ./symlink2file --daemon --interval 48h --health-addr "127.0.0.1:$port" \
+        --cron "./test_symlinks/nightly=0 2 * * *" ./test_symlinks/hourly > /dev/null 2> ./test_daemon.log &
+    pid=$!
+    for attempt in $(seq 50); do
+        grep -q "run complete" ./test_daemon.log && break
+        sleep 0.1
+    done
+    health=$(curl -s "http://127.0.0.1:$port/")
+    kill $pid
+    wait $pid || true
+
+    assert_link_not_exists ./test_symlinks/hourly/111.txt
+    assert_link_exists ./test_symlinks/nightly/111.txt
+    [[ "$health" == *'"next_run":"'*'T02:00:00'* ]]
+    rm -f ./test_daemon.log
+}
+
+@test "options from environment variables" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+
+    ## Flags take precedence over the environment
+    SYMLINK2FILE_NO_BACKUP=true SYMLINK2FILE_BROKEN_SYMLINKS=delete ./symlink2file --broken-symlinks keep ./test_symlinks
+
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_file_exists ./test_symlinks/111.txt
+    assert_not_exist ./test_symlinks/.symlink2file/111.txt
+    assert_link_exists ./test_symlinks/222.txt
+
+    ## Invalid values are reported with the name of the variable
+    SYMLINK2FILE_NO_RECURSE=maybe run ./symlink2file ./test_symlinks
+    assert_failure
+    assert_line --partial "SYMLINK2FILE_NO_RECURSE"
+}
+
+@test "glob patterns in directory arguments" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/run-1 ./test_symlinks/run-2 ./test_symlinks/other
+    echo 111 > test_files/111.txt
+    for dir in run-1 run-2 other; do
+        ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/$dir/111.txt"
+    done
+
+    run ./symlink2file './test_symlinks/run-*'
+    assert_success
+
+    ## Only the matching directories are processed
+    assert_link_not_exists ./test_symlinks/run-1/111.txt
+    assert_link_not_exists ./test_symlinks/run-2/111.txt
+    assert_link_exists ./test_symlinks/other/111.txt
+
+    ## A pattern matching nothing is an error
+    run ./symlink2file './test_symlinks/none-*'
+    assert_failure
+}
+
+@test "NUL-separated file list" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/with space.txt"
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/with
+newline.txt"
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/not listed.txt"
+
+    run bash -c "find ./test_symlinks -name 'with*' -print0 | ./symlink2file -0 --files-from - 2>/dev/null | tr '\0' '|'"
+    assert_success
+
+    ## Only the listed symlinks are converted, and printed NUL-separated
+    assert_link_not_exists "./test_symlinks/with space.txt"
+    assert_link_not_exists "./test_symlinks/with
+newline.txt"
+    assert_link_exists "./test_symlinks/not listed.txt"
+    assert_output --partial "$(pwd)/test_symlinks/with space.txt|"
+    assert_output --partial "$(pwd)/test_symlinks/with
+newline.txt|"
+}
+
+@test "per-path output as TSV" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+
+    run --separate-stderr ./symlink2file --output tsv ./test_symlinks
+    assert_success
+    assert_line "$(printf 'converted\t%s\t%s\t4' "$(pwd)/test_symlinks/111.txt" "$(pwd)/test_files/111.txt")"
+    assert_line "$(printf 'kept\t%s\t%s\t0' "$(pwd)/test_symlinks/222.txt" "$(pwd)/test_files/222.txt")"
+}
+
+@test "check with GitHub annotations" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+
+    ## No symlinks
+    run ./symlink2file --check --format github ./test_symlinks
+    assert_success
+
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    run ./symlink2file --check --format github ./test_symlinks
+    assert_failure
+    assert_line --partial "::error file=test_symlinks/111.txt"
+
+    ## Nothing is modified
+    assert_link_exists ./test_symlinks/111.txt
+    assert_not_exist ./test_symlinks/.symlink2file
+}
+
+@test "verify after conversion" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    echo 222 > test_files/222.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file --verify-after ./test_symlinks
+    assert_success
+    assert_line --partial "Verification passed: 1 files"
+
+    ## Copy changed after its conversion
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+    run ./symlink2file --verify-after --file-hook 'echo 333 >> "$SYMLINK2FILE_PATH"' ./test_symlinks
+    assert_failure
+    assert_line --partial "Verification failed: 1 of 1 files"
+}
+
+@test "broken links, trash" {
+    rm -rf ./test_files ./test_symlinks/ ./test_data
+    mkdir -p ./test_files ./test_symlinks/
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+    export XDG_DATA_HOME="$(pwd)/test_data"
+
+    run ./symlink2file --broken-symlinks trash ./test_symlinks
+    assert_success
+
+    ## Broken link moved to the trash, with its original location
+    assert_link_not_exists ./test_symlinks/222.txt
+    assert_link_exists ./test_data/Trash/files/222.txt
+    assert_file_contains ./test_data/Trash/info/222.txt.trashinfo "Path=$(pwd)/test_symlinks/222.txt"
+
+    ## Restored from the trash
+    mv ./test_data/Trash/files/222.txt ./test_symlinks/222.txt
+    assert_equal "$(readlink ./test_symlinks/222.txt)" "$(pwd)/test_files/222.txt"
+    rm -rf ./test_data
+}
+
+@test "broken links, placeholder" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+
+    run ./symlink2file --broken-symlinks placeholder ./test_symlinks
+    assert_success
+
+    ## Regular file naming the missing target
+    assert_link_not_exists ./test_symlinks/222.txt
+    assert_file_exists ./test_symlinks/222.txt
+    assert_file_contains ./test_symlinks/222.txt "Missing target: $(pwd)/test_files/222.txt"
+    assert_link_exists ./test_symlinks/.symlink2file/222.txt
+}
+
+@test "broken links, report" {
+    rm -rf ./test_files ./test_symlinks/ ./test_report.tsv
+    mkdir -p ./test_files ./test_symlinks/
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+
+    run ./symlink2file --broken-symlinks report --broken-report ./test_report.tsv ./test_symlinks
+    assert_success
+
+    ## Broken link left untouched and listed with its target
+    assert_link_exists ./test_symlinks/222.txt
+    assert_file_contains ./test_report.tsv "$(printf '%s\t%s' "$(pwd)/test_symlinks/222.txt" "$(pwd)/test_files/222.txt")"
+
+    ## The report file is required
+    run ./symlink2file --broken-symlinks report ./test_symlinks
+    assert_failure
+    rm -f ./test_report.tsv
+}
+
+@test "broken links, repair" {
+    rm -rf ./test_files ./test_symlinks/ ./test_archive
+    mkdir -p ./test_files ./test_symlinks/ ./test_archive/2024
+    echo 222 > ./test_archive/2024/222.txt
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+    ln -s "$(pwd)/test_files/333.txt" "./test_symlinks/333.txt"
+
+    run ./symlink2file --broken-symlinks repair --search-root ./test_archive ./test_symlinks
+    assert_success
+
+    ## Retargeted to the file found under the search root
+    assert_symlink_to test_archive/2024/222.txt test_symlinks/222.txt
+
+    ## No candidate: kept
+    assert_link_exists ./test_symlinks/333.txt
+    assert_file_not_exists ./test_symlinks/333.txt
+
+    ## Materialized from the candidate
+    rm -rf ./test_symlinks/222.txt ./test_symlinks/.symlink2file
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+    run ./symlink2file --broken-symlinks repair --repair-mode materialize --search-root ./test_archive ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/222.txt
+    assert_file_contains ./test_symlinks/222.txt 222
+    rm -rf ./test_archive
+}
+
+@test "suggest targets of broken links" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/README.md
+    ln -s "$(pwd)/test_files/readme.md" "./test_symlinks/readme.md"
+
+    run ./symlink2file --suggest-targets ./test_symlinks
+    assert_success
+    assert_line --partial "Did you mean: $(pwd)/test_files/README.md"
+    assert_link_exists ./test_symlinks/readme.md
+}
+
+@test "symlink loops" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    ln -s 222.txt ./test_symlinks/111.txt
+    ln -s 111.txt ./test_symlinks/222.txt
+
+    ## Kept and counted by default
+    run ./symlink2file ./test_symlinks
+    assert_success
+    assert_line --partial "2 symlink loops found"
+    assert_link_exists ./test_symlinks/111.txt
+    assert_link_exists ./test_symlinks/222.txt
+
+    ## Deleted with their own policy
+    run ./symlink2file --loops delete ./test_symlinks
+    assert_success
+    assert_line --partial "Removed symlink loop"
+    assert_link_not_exists ./test_symlinks/111.txt
+}
+
+@test "resolve a single level" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" ./test_files/managed.txt
+    ln -s "$(pwd)/test_files/managed.txt" ./test_symlinks/111.txt
+
+    run ./symlink2file --resolve once ./test_symlinks
+    assert_success
+
+    ## The symlink became a copy of the intermediate link
+    assert_equal "$(readlink ./test_symlinks/111.txt)" "$(pwd)/test_files/111.txt"
+}
+
+@test "absolutize relative symlinks" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "../test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file --action absolutize ./test_symlinks
+    assert_success
+
+    ## Link text rewritten, no copy made
+    assert_equal "$(readlink ./test_symlinks/111.txt)" "$(pwd)/test_files/111.txt"
+    assert_link_exists ./test_symlinks/.symlink2file/111.txt
+}
+
+@test "relativize absolute symlinks" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    ln -s "$(pwd)/symlink2file" "./test_symlinks/outside"
+
+    run ./symlink2file --action relativize --relative-root ./test_files ./test_symlinks
+    assert_success
+
+    ## Target under the root made relative
+    assert_equal "$(readlink ./test_symlinks/111.txt)" "../test_files/111.txt"
+    assert_symlink_to test_files/111.txt test_symlinks/111.txt
+
+    ## Target outside of the root left alone
+    assert_equal "$(readlink ./test_symlinks/outside)" "$(pwd)/symlink2file"
+}
+
+@test "rewrite symlinks below a symlinked directory" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files/project/data ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd -P)/test_files/project" ./test_symlinks/project
+    ln -s ../../111.txt ./test_files/project/data/relative.txt
+    ln -s "$(pwd -P)/test_files/111.txt" ./test_files/project/data/absolute.txt
+
+    ## ".." leads out of the real directory of the symlinks, not out of the symlinked one
+    run ./symlink2file --action absolutize --no-backup ./test_symlinks/project/data
+    assert_success
+    assert_equal "$(readlink ./test_files/project/data/relative.txt)" "$(pwd -P)/test_files/111.txt"
+
+    run ./symlink2file --action relativize --relative-root ./test_files --no-backup ./test_symlinks/project/data
+    assert_success
+    assert_equal "$(readlink ./test_files/project/data/absolute.txt)" "../../111.txt"
+    assert_files_equal ./test_files/111.txt ./test_files/project/data/absolute.txt
+}
+
+@test "retarget link destinations" {
+    rm -rf ./test_files ./test_symlinks/ ./test_moved
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    ## Storage migration
+    mv ./test_files ./test_moved
+
+    run ./symlink2file --retarget "$(pwd)/test_files=$(pwd)/test_moved" ./test_symlinks
+    assert_success
+
+    ## Link points to the new location, no copy made
+    assert_equal "$(readlink ./test_symlinks/111.txt)" "$(pwd)/test_moved/111.txt"
+    assert_symlink_to test_moved/111.txt test_symlinks/111.txt
+    rm -rf ./test_moved
+}
+
+@test "delink copies back into symlinks" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    cp ./test_files/111.txt ./test_symlinks/111.txt
+    echo 222 > ./test_symlinks/222.txt
+
+    run ./symlink2file delink --target-root ./test_files ./test_symlinks
+    assert_success
+    assert_line --partial "Replaced 1 files"
+
+    ## Copy replaced by a symlink to the reference file
+    assert_symlink_to test_files/111.txt test_symlinks/111.txt
+
+    ## File without a reference copy left alone
+    assert_link_not_exists ./test_symlinks/222.txt
+    assert_file_exists ./test_symlinks/222.txt
+}
+
+@test "export as tar" {
+    rm -rf ./test_files ./test_symlinks/ ./test_export.tar
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    echo 222 > test_symlinks/222.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    ./symlink2file export --format tar ./test_symlinks > ./test_export.tar
+
+    ## The symlink is stored as a regular file with the content of its target
+    run tar -tvf ./test_export.tar
+    assert_line --regexp '^-.* 111\.txt$'
+    assert_equal "$(tar -xOf ./test_export.tar 111.txt)" 111
+    assert_equal "$(tar -xOf ./test_export.tar 222.txt)" 222
+
+    ## The directory is not modified
+    assert_link_exists ./test_symlinks/111.txt
+    rm -f ./test_export.tar
+}
+
+@test "export as zip" {
+    rm -rf ./test_files ./test_symlinks/ ./test_export.zip
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    ./symlink2file export --format zip ./test_symlinks > ./test_export.zip
+    assert_equal "$(unzip -p ./test_export.zip 111.txt)" 111
+
+    ## Stored without compression
+    ./symlink2file export --format zip --compression store ./test_symlinks > ./test_export.zip
+    run unzip -v ./test_export.zip
+    assert_line --partial "Stored"
+    assert_equal "$(unzip -p ./test_export.zip 111.txt)" 111
+    rm -f ./test_export.zip
+}
+
+@test "filter rules" {
+    rm -rf ./test_files ./test_symlinks/ ./test_rules.txt
+    mkdir -p ./test_files ./test_symlinks/
+    for name in 111.txt 222.tmp 333.log; do
+        echo "$name" > "test_files/$name"
+        ln -s "$(pwd)/test_files/$name" "./test_symlinks/$name"
+    done
+    echo '- *.log' > ./test_rules.txt
+
+    run ./symlink2file --filter '- *.tmp' --filter 'merge ./test_rules.txt' ./test_symlinks
+    assert_success
+    assert_line --partial "Excluded by filter, skipping: $(pwd)/test_symlinks/222.tmp"
+
+    ## Only the symlink not excluded is converted
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_file_exists ./test_symlinks/111.txt
+    assert_link_exists ./test_symlinks/222.tmp
+    assert_link_exists ./test_symlinks/333.log
+    rm -f ./test_rules.txt
+}
+
+@test "symlinks to FIFOs" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    mkfifo ./test_files/fifo
+    ln -s "$(pwd)/test_files/fifo" "./test_symlinks/fifo"
+
+    ## Skipped by default
+    run ./symlink2file ./test_symlinks
+    assert_success
+    assert_link_exists ./test_symlinks/fifo
+
+    run ./symlink2file --special-files error ./test_symlinks
+    assert_failure
+    assert_link_exists ./test_symlinks/fifo
+
+    ## Replaced with a new FIFO
+    run ./symlink2file --special-files recreate ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/fifo
+    [ -p ./test_symlinks/fifo ]
+}
+
+@test "symlinks to sockets" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    python3 -c 'import socket, sys; socket.socket(socket.AF_UNIX).bind(sys.argv[1])' ./test_files/socket
+    ln -s "$(pwd)/test_files/socket" "./test_symlinks/socket"
+
+    run ./symlink2file ./test_symlinks
+    assert_success
+    assert_line --partial "1 symlinks lead to sockets"
+    assert_link_exists ./test_symlinks/socket
+}
+
+@test "out of space" {
+    if [ "$(id -u)" -ne 0 ]; then
+        skip "requires root"
+    fi
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    mount -t tmpfs -o size=64k tmpfs ./test_symlinks || skip "cannot mount a tmpfs"
+    head -c 40000 /dev/zero > ./test_files/111.bin
+    head -c 40000 /dev/zero > ./test_files/222.bin
+    ln -s "$(pwd)/test_files/111.bin" "./test_symlinks/111.bin"
+    ln -s "$(pwd)/test_files/222.bin" "./test_symlinks/222.bin"
+
+    run ./symlink2file ./test_symlinks
+    umount_status=0
+    find ./test_symlinks -name '.tmp-*' > ./test_files/temp.txt
+    links=$(find ./test_symlinks -maxdepth 1 -type l | wc -l)
+    umount ./test_symlinks || umount_status=$?
+
+    ## One copy fits, the other symlink is left with the space needed
+    assert_failure 3
+    assert_line --partial "Out of quota or disk space: 1 symlinks were not converted"
+    assert_equal "$links" 1
+    assert_file_empty ./test_files/temp.txt
+    assert_equal "$umount_status" 0
+}
+
+@test "minimum free space" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file --min-free-space 1000T ./test_symlinks
+    assert_failure
+    assert_line --partial "Free space below"
+    assert_link_exists ./test_symlinks/111.txt
+
+    run ./symlink2file --min-free-space 1M ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/111.txt
+}
+
+@test "copy budget of a run" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    for name in 111 222 333; do
+        echo $name > "test_files/$name.txt"
+        ln -s "$(pwd)/test_files/$name.txt" "./test_symlinks/$name.txt"
+    done
+
+    run ./symlink2file --max-total-bytes 8 ./test_symlinks
+    assert_success
+    assert_line --partial "1 symlinks (4 B) were deferred to the next run"
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_link_not_exists ./test_symlinks/222.txt
+    assert_link_exists ./test_symlinks/333.txt
+
+    ## Converted by the next run
+    run ./symlink2file --max-total-bytes 8 ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/333.txt
+}
+
+@test "copy budget with parallel conversions" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    for i in $(seq 8); do
+        head -c 4M /dev/urandom > "test_files/$i.bin"
+        ln -s "$(pwd)/test_files/$i.bin" "./test_symlinks/$i.bin"
+    done
+
+    ## The copies still running count against the budget
+    run ./symlink2file --jobs 4 --max-total-bytes 10M ./test_symlinks
+    assert_success
+    assert_line --partial "6 symlinks (24.0 MiB) were deferred to the next run"
+    assert_equal "$(find ./test_symlinks -maxdepth 1 -type f | wc -l)" 2
+}
+
+@test "maximum file size" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    head -c 2048 /dev/zero > test_files/222.bin
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    ln -s "$(pwd)/test_files/222.bin" "./test_symlinks/222.bin"
+
+    run ./symlink2file --max-file-size 1K ./test_symlinks
+    assert_success
+    assert_line --partial "1 symlinks were kept because their targets are larger than 1.0 KiB"
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_link_exists ./test_symlinks/222.bin
+}
+
+@test "mode of the new files" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    echo 222 > test_files/222.txt
+    chmod 0444 test_files/111.txt test_files/222.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file --chmod 0640 ./test_symlinks
+    assert_success
+    assert_equal "$(stat -c %a ./test_symlinks/111.txt)" 640
+
+    ## Symbolic modes apply to the mode of the target
+    ln -s "$(pwd)/test_files/222.txt" "./test_symlinks/222.txt"
+    run ./symlink2file --chmod u+w,o-r ./test_symlinks
+    assert_success
+    assert_equal "$(stat -c %a ./test_symlinks/222.txt)" 640
+
+    run ./symlink2file --chmod u+z ./test_symlinks
+    assert_failure
+    assert_line --partial "Invalid value for -chmod"
+}
+
+@test "sandbox confines hooks" {
+    rm -rf ./test_files ./test_symlinks/ ./outside.txt
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file --sandbox ./test_symlinks
+    if [[ "$output" == *"Sandbox failed"*"available"* ]]; then
+        skip "Landlock is not available"
+    fi
+    assert_success
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_file_exists ./test_symlinks/111.txt
+
+    ## Writes outside of the processed directories are denied
+    run ./symlink2file --sandbox --pre-hook 'touch ./outside.txt' ./test_symlinks
+    assert_failure
+    assert_file_not_exists ./outside.txt
+}
+
+@test "run as another user" {
+    if [ "$(id -u)" -ne 0 ]; then
+        skip "requires root"
+    fi
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    ## Directory owned by root, not writable once the privileges are dropped
+    run ./symlink2file --run-as nobody ./test_symlinks
+    assert_failure
+    assert_link_exists ./test_symlinks/111.txt
+
+    ## Directory owned by the user, the copy belongs to them
+    chown -R nobody ./test_symlinks
+    run ./symlink2file --run-as nobody ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_file_exists ./test_symlinks/111.txt
+    assert_equal "$(stat -c %U ./test_symlinks/111.txt)" "nobody"
+}
+
+@test "copy cache across runs" {
+    rm -rf ./test_files ./test_symlinks/ ./test_cache
+    mkdir -p ./test_files ./test_symlinks/first ./test_symlinks/second
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/first/111.txt"
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/second/111.txt"
+
+    run ./symlink2file --copy-cache ./test_cache ./test_symlinks/first
+    assert_success
+
+    ## Copy kept in the cache by checksum
+    checksum=$(sha256sum ./test_files/111.txt | awk '{ print $1 }')
+    assert_file_exists "./test_cache/${checksum:0:2}/$checksum"
+
+    ## Second run takes the copy from the cache
+    run ./symlink2file --copy-cache ./test_cache ./test_symlinks/second
+    assert_success
+    assert_line --partial "1 files were taken from the copy cache"
+    assert_link_not_exists ./test_symlinks/second/111.txt
+    assert_file_contains ./test_symlinks/second/111.txt 111
+    rm -rf ./test_cache
+}
+
+@test "dedup store shares identical copies" {
+    rm -rf ./test_files ./test_symlinks/ ./test_store
+    mkdir -p ./test_files ./test_symlinks/first ./test_symlinks/second
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/first/111.txt"
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/second/111.txt"
+
+    run ./symlink2file --dedup-store ./test_store ./test_symlinks/first ./test_symlinks/second
+    assert_success
+    assert_line --partial "1 files share their storage"
+
+    ## Both copies are hard links to the file of the store
+    assert_link_not_exists ./test_symlinks/first/111.txt
+    assert_link_not_exists ./test_symlinks/second/111.txt
+    assert_equal "$(stat -c %h ./test_symlinks/first/111.txt)" 3
+    assert_equal "$(stat -c %i ./test_symlinks/first/111.txt)" "$(stat -c %i ./test_symlinks/second/111.txt)"
+    rm -rf ./test_store
+}
+
+@test "undo the last run" {
+    rm -rf ./test_files ./test_symlinks/ ./test_data
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+    export XDG_DATA_HOME="$(pwd)/test_data"
+
+    run ./symlink2file ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/111.txt
+
+    ## The run is recorded in the history
+    assert_dir_exists ./test_data/symlink2file/history
+
+    run ./symlink2file undo --run last
+    assert_success
+    assert_line --partial "1 symlinks restored"
+
+    ## Original symlink is back
+    assert_symlink_to test_files/111.txt test_symlinks/111.txt
+    rm -rf ./test_data
+}
+
+@test "sorted order" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/b ./test_symlinks/a
+    echo 111 > test_files/111.txt
+    for path in b/2.txt a/3.txt b/1.txt a/1.txt 0.txt; do
+        ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/$path"
+    done
+
+    run --separate-stderr ./symlink2file --order sorted --print-converted ./test_symlinks
+    assert_success
+    assert_output "$(printf '%s\n' 0.txt a/1.txt a/3.txt b/1.txt b/2.txt | sed "s|^|$(pwd)/test_symlinks/|")"
+}
+
+@test "size orders" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    for size in 3 1 2; do
+        head -c "${size}000" /dev/zero > "test_files/$size.bin"
+        ln -s "$(pwd)/test_files/$size.bin" "./test_symlinks/$size.bin"
+    done
+
+    run --separate-stderr ./symlink2file --order largest-first --print-converted --no-backup ./test_symlinks
+    assert_success
+    assert_output "$(printf '%s\n' 3.bin 2.bin 1.bin | sed "s|^|$(pwd)/test_symlinks/|")"
+
+    for size in 3 1 2; do
+        rm "./test_symlinks/$size.bin"
+        ln -s "$(pwd)/test_files/$size.bin" "./test_symlinks/$size.bin"
+    done
+    run --separate-stderr ./symlink2file --order smallest-first --print-converted --no-backup ./test_symlinks
+    assert_success
+    assert_output "$(printf '%s\n' 1.bin 2.bin 3.bin | sed "s|^|$(pwd)/test_symlinks/|")"
+}
+
+@test "parallel conversions" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files
+    for dir in 1 2 3 4; do
+        mkdir -p "./test_symlinks/$dir"
+        for name in 1 2 3 4 5 6 7 8; do
+            head -c 100000 /dev/urandom > "test_files/$dir-$name.bin"
+            ln -s "$(pwd)/test_files/$dir-$name.bin" "./test_symlinks/$dir/$name.bin"
+        done
+    done
+
+    run ./symlink2file --jobs 4 --per-dir-limit 1 ./test_symlinks
+    assert_success
+    assert_line --partial "Processed 32 symlinks"
+
+    ## Every copy is complete
+    for dir in 1 2 3 4; do
+        for name in 1 2 3 4 5 6 7 8; do
+            assert_link_not_exists "./test_symlinks/$dir/$name.bin"
+            cmp "./test_files/$dir-$name.bin" "./test_symlinks/$dir/$name.bin"
+        done
+    done
+
+    ## Conflicting options
+    run ./symlink2file --jobs 0 ./test_symlinks
+    assert_failure
+    run ./symlink2file --jobs 2 -i ./test_symlinks
+    assert_failure
+}
+
+@test "more symlinks than the queue holds" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    for name in $(seq 1500); do
+        ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/$name.txt"
+    done
+
+    run ./symlink2file --no-backup ./test_symlinks
+    assert_success
+    assert_line --partial "Processed 1500 symlinks"
+    assert_equal "$(find ./test_symlinks -type l | wc -l)" 0
+}
+
+@test "stage timings in verbose output" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    run ./symlink2file -v ./test_symlinks
+    assert_success
+    assert_line --partial "Stages of $(pwd)/test_symlinks: scan"
+    assert_line --partial "1 symlinks"
+}
+
+@test "renames failing across devices" {
+    if [ "$(uname -sm)" != "Linux x86_64" ] || ! command -v python3 > /dev/null; then
+        skip "requires python3 on x86_64 Linux"
+    fi
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    chmod 640 test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    ## Every rename fails with EXDEV, so the copy is written again in place of the symlink
+    run python3 "$BATS_TEST_DIRNAME/fail_renames.py" ./symlink2file -no-history ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_files_equal ./test_files/111.txt ./test_symlinks/111.txt
+    assert_equal "$(stat -c %a ./test_symlinks/111.txt)" 640
+    assert_equal "$(find ./test_symlinks -name '.tmp-*' | wc -l)" 0
+}
+
+@test "symlink swapped during the run" {
+    for mode in "" "-link-mode hardlink" "-copy-cache ./test_files/cache" "-broken-symlinks placeholder"; do
+        rm -rf ./test_files ./test_symlinks/
+        mkdir -p ./test_files ./test_symlinks/
+        echo 111 > test_files/111.txt
+        echo 222 > test_files/222.txt
+        echo 333 > test_files/333.txt
+        if [[ "$mode" == *placeholder* ]]; then
+            ln -s "$(pwd)/test_files/missing.txt" "./test_symlinks/111.txt"
+        else
+            ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+        fi
+        ln -s "$(pwd)/test_files/333.txt" "./test_symlinks/333.txt"
+
+        ## The decider points the first symlink elsewhere after it was checked
+        run ./symlink2file $mode -decider "grep -q 111.txt && ln -sfn '$(pwd)/test_files/222.txt' ./test_symlinks/111.txt; echo convert" ./test_symlinks
+        assert_success
+        assert_line --partial "symlink changed since it was checked, left alone"
+        assert_symlink_to test_files/222.txt test_symlinks/111.txt
+        assert_not_exist ./test_symlinks/.symlink2file/111.txt
+        assert_link_not_exists ./test_symlinks/333.txt
+        assert_files_equal ./test_files/333.txt ./test_symlinks/333.txt
+    done
+}
+
+@test "HTTP API limited to the given directories" {
+    if ! command -v curl > /dev/null; then
+        skip "requires curl"
+    fi
+    run ./symlink2file -serve 127.0.0.1:18089
+    assert_failure
+    assert_output --partial "requires at least one directory"
+
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/project
+    echo 111 > test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/project/111.txt"
+    ln -s "$(pwd)/test_files" "./test_symlinks/escape"
+
+    ./symlink2file -serve :18089 ./test_symlinks 3>&- &
+    server=$!
+    for _ in $(seq 50); do
+        curl -s 127.0.0.1:18089/status > /dev/null && break
+        sleep 0.1
+    done
+
+    ## A symlinked directory leading outside of the root is refused
+    run curl -s -X POST 127.0.0.1:18089/convert -d "{\"dir\": \"$(pwd)/test_symlinks/escape\"}"
+    escape=$output
+    run curl -s -X POST 127.0.0.1:18089/convert -d "{\"dir\": \"$(pwd)/test_symlinks/project\"}"
+    project=$output
+    for _ in $(seq 50); do
+        [ -L ./test_symlinks/project/111.txt ] || break
+        sleep 0.1
+    done
+    kill $server
+
+    assert_equal "$escape" '{"error":"dir is outside of the allowed roots"}'
+    [[ "$project" == *'"status":"queued"'* ]]
+    assert_link_not_exists ./test_symlinks/project/111.txt
+    assert_files_equal ./test_files/111.txt ./test_symlinks/project/111.txt
+}
+
+@test "hard links with mode or time overrides" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    chmod 755 test_files/111.txt
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/111.txt"
+
+    ## An explicit hard link mode is refused
+    run ./symlink2file -link-mode hardlink -chmod 0600 ./test_symlinks
+    assert_failure
+    assert_output --partial "cannot be combined with -chmod"
+    assert_link_exists ./test_symlinks/111.txt
+
+    ## The conda preset makes a copy instead of linking the target
+    run ./symlink2file -preset conda -chmod 0600 ./test_symlinks
+    assert_success
+    assert_link_not_exists ./test_symlinks/111.txt
+    assert_equal "$(stat -c '%a %h' ./test_symlinks/111.txt)" "600 1"
+    assert_equal "$(stat -c '%a %h' ./test_files/111.txt)" "755 1"
+
+    ## Symlinks to the same target get their own times with -times link
+    rm -rf ./test_symlinks/
+    mkdir -p ./test_symlinks/
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/a.txt"
+    ln -s "$(pwd)/test_files/111.txt" "./test_symlinks/b.txt"
+    touch -h -d "2020-01-01 00:00:00" ./test_symlinks/a.txt
+    touch -h -d "2021-01-01 00:00:00" ./test_symlinks/b.txt
+    run ./symlink2file -preserve mode,timestamps,links -times link ./test_symlinks
+    assert_success
+    assert_equal "$(stat -c '%h %y' ./test_symlinks/a.txt | cut -c1-12)" "1 2020-01-01"
+    assert_equal "$(stat -c '%h %y' ./test_symlinks/b.txt | cut -c1-12)" "1 2021-01-01"
+}
+
+@test "paths longer than PATH_MAX" {
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files ./test_symlinks/
+    echo 111 > test_files/111.txt
+    top=$(pwd)
+    name=$(printf 'd%.0s' $(seq 200))
+
+    ## 25 directories of 200 bytes each put the symlinks beyond 4096 bytes (entered one by one, as cd refuses the path)
+    enter_deep() {
+        cd "$top/test_symlinks"
+        for _ in $(seq 25); do
+            mkdir -p "$name" && cd "$name"
+        done
+    }
+    enter_deep
+    ln -s "$top/test_files/111.txt" ./111.txt
+    ln -s "$top/test_files/missing.txt" ./missing.txt
+    ln -s "$top/test_files/skipped.txt" ./skipped.txt
+    [ "$(pwd | wc -c)" -gt 4096 ]
+    cd "$top"
+
+    ## The policy applies as to any other symlink: the decider and the broken symlinks options
+    run ./symlink2file -broken-symlinks delete -decider "grep -q skipped.txt && echo skip || echo convert" ./test_symlinks
+    assert_success
+    enter_deep
+    assert_link_not_exists ./111.txt
+    assert_files_equal "$top/test_files/111.txt" ./111.txt
+    assert_not_exist ./missing.txt
+    assert_link_exists ./skipped.txt
+    assert_equal "$(readlink ./.symlink2file/111.txt)" "$top/test_files/111.txt"
+    assert_equal "$(readlink ./.symlink2file/missing.txt)" "$top/test_files/missing.txt"
+    cd "$top"
+}
+
+@test "mount points with spaces" {
+    if [ "$(id -u)" -ne 0 ]; then
+        skip "requires root"
+    fi
+    rm -rf ./test_files ./test_symlinks/
+    mkdir -p ./test_files "./test_symlinks/with space"
+    mount -t tmpfs tmpfs "./test_symlinks/with space" || skip "cannot mount a tmpfs"
+
+    ## The mount point is escaped in /proc/self/mountinfo (\040)
+    run ./symlink2file doctor "./test_symlinks/with space"
+    umount "./test_symlinks/with space"
+    assert_success
+    assert_line --partial "Mount point:           $(pwd)/test_symlinks/with space (tmpfs)"
+    assert_line --partial "Type:                  tmpfs"
+}
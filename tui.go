@@ -0,0 +1,298 @@
+package main
+
+// Terminal interface to review the symlinks before converting them (-tui)
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A symlink listed in the TUI
+type tuiEntry struct {
+	path     string   // Location of the symlink
+	opts     *options // Options effective in the directory of the symlink
+	target   string   // Resolved target (or raw link text for broken symlinks)
+	size     int64    // Size of the target found by the scan (0 for broken symlinks)
+	broken   bool     // The symlink cannot be resolved
+	selected bool     // The symlink will be processed when the selection is committed
+	status   string   // Outcome of the processing
+}
+
+// State of the full-screen interface
+type tui struct {
+	mu      sync.Mutex // Held while the screen is drawn during the processing (also refreshed by a ticker)
+	opts    *options
+	entries []*tuiEntry
+	cursor  int // Index of the highlighted entry
+	offset  int // Index of the first visible entry
+	rows    int // Terminal height
+	cols    int // Terminal width
+	message string
+}
+
+// Scan the target directory, let the user include/exclude symlinks in a full-screen interface,
+// and process the selected ones while showing the progress
+func runTUI(opts *options, processedSymlinks map[string]bool) error {
+	var entries []*tuiEntry
+	err := walkSymlinks(opts, func(path string, opts *options) error {
+		entry := &tuiEntry{path: path, opts: opts}
+		resolvedPath, err := evalSymlinksNormalized(path, opts.maxLinkDepth)
+		if err != nil {
+			entry.broken = true
+			entry.target, _ = os.Readlink(path)
+			entry.selected = opts.brokenSymlinks != "keep"
+		} else {
+			entry.target = resolvedPath
+			entry.selected = true
+			if info, err := os.Stat(resolvedPath); err == nil && info.Mode().IsRegular() {
+				entry.size = info.Size()
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		coloredPrintf(greenColor, "No symlinks found in %s\n", opts.targetDir)
+		return nil
+	}
+
+	restoreTerminal, err := makeRawTerminal()
+	if err != nil {
+		return fmt.Errorf("failed to initialize the terminal: %w", err)
+	}
+	fmt.Print("\033[?1049h\033[?25l") // Switch to the alternate screen and hide the cursor
+	defer func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		restoreTerminal()
+	}()
+
+	t := &tui{opts: opts, entries: entries}
+	commit, err := t.selectEntries()
+	if err != nil || !commit {
+		return err
+	}
+	t.applySelection(processedSymlinks)
+
+	// Keep the results on screen until a key is pressed
+	t.mu.Lock()
+	t.message = "Done. Press any key to exit."
+	t.render()
+	t.mu.Unlock()
+	_, err = readKey()
+	return err
+}
+
+// Handle the key presses of the selection screen
+// Returns true if the user committed the selection
+func (t *tui) selectEntries() (bool, error) {
+	t.message = "[up/down] move  [space] toggle  [a] toggle all  [enter] convert selected  [q] quit"
+	for {
+		t.render()
+		key, err := readKey()
+		if err != nil {
+			return false, err
+		}
+		switch key {
+		case "up", "k":
+			if t.cursor > 0 {
+				t.cursor--
+			}
+		case "down", "j":
+			if t.cursor < len(t.entries)-1 {
+				t.cursor++
+			}
+		case "pgup":
+			t.cursor = max(t.cursor-t.pageSize(), 0)
+		case "pgdown":
+			t.cursor = min(t.cursor+t.pageSize(), len(t.entries)-1)
+		case " ":
+			entry := t.entries[t.cursor]
+			entry.selected = !entry.selected && t.selectable(entry)
+		case "a":
+			selectAll := false
+			for _, entry := range t.entries {
+				if !entry.selected && t.selectable(entry) {
+					selectAll = true
+				}
+			}
+			for _, entry := range t.entries {
+				entry.selected = selectAll && t.selectable(entry)
+			}
+		case "enter":
+			return true, nil
+		case "q", "esc", "ctrl-c":
+			return false, nil
+		}
+	}
+}
+
+// Broken symlinks can only be selected when they are going to be deleted
+func (t *tui) selectable(entry *tuiEntry) bool {
+	return !entry.broken || entry.opts.brokenSymlinks != "keep"
+}
+
+// Process the selected entries, updating the screen after each one and every second
+// (with the throughput and the estimated time remaining, from the sizes found by the scan)
+func (t *tui) applySelection(processedSymlinks map[string]bool) {
+	output = io.Discard
+	defer func() { output = os.Stdout }()
+
+	progress := newProgressMeter()
+	for _, entry := range t.entries {
+		if entry.selected {
+			progress.totalFiles++
+			progress.totalBytes += entry.size
+		}
+	}
+	ticker := time.NewTicker(time.Second)
+	stopTicker := make(chan struct{})
+	defer func() {
+		ticker.Stop()
+		close(stopTicker)
+	}()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				t.mu.Lock()
+				t.message = "Processing " + progress.String()
+				t.render()
+				t.mu.Unlock()
+			case <-stopTicker:
+				return
+			}
+		}
+	}()
+
+	failed := 0
+	for i, entry := range t.entries {
+		t.mu.Lock()
+		if !entry.selected {
+			entry.status = "skipped"
+			t.mu.Unlock()
+			continue
+		}
+		t.cursor = i
+		t.message = "Processing " + progress.String()
+		t.render()
+		t.mu.Unlock()
+
+		err := processPath(entry.path, entry.opts, processedSymlinks)
+		t.mu.Lock()
+		if err != nil {
+			entry.status = "error: " + err.Error()
+			failed++
+		} else if entry.broken {
+			entry.status = map[string]string{"delete": "deleted", "trash": "trashed", "placeholder": "placeholder", "report": "reported", "repair": "repaired"}[entry.opts.brokenSymlinks]
+		} else {
+			entry.status = "converted"
+		}
+		progress.add(1, entry.size)
+		t.mu.Unlock()
+	}
+	t.mu.Lock()
+	t.message = fmt.Sprintf("Processed %d/%d symlinks (%s), %d errors.", progress.doneFiles, progress.totalFiles, formatBytes(progress.doneBytes), failed)
+	t.mu.Unlock()
+}
+
+// Number of list rows that fit on the screen
+func (t *tui) pageSize() int {
+	return max(t.rows-4, 1)
+}
+
+// Draw the whole screen
+func (t *tui) render() {
+	t.rows, t.cols = terminalSize()
+
+	// Keep the cursor within the visible window
+	if t.cursor < t.offset {
+		t.offset = t.cursor
+	}
+	if t.cursor >= t.offset+t.pageSize() {
+		t.offset = t.cursor - t.pageSize() + 1
+	}
+
+	selected := 0
+	for _, entry := range t.entries {
+		if entry.selected {
+			selected++
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	b.WriteString(headerColor + t.fit(fmt.Sprintf("symlink2file %s - %d symlinks, %d selected", t.opts.targetDir, len(t.entries), selected)) + resetColor + "\r\n\r\n")
+	for i := t.offset; i < len(t.entries) && i < t.offset+t.pageSize(); i++ {
+		entry := t.entries[i]
+		mark := "[ ]"
+		if entry.selected {
+			mark = "[x]"
+		}
+		relPath, err := filepath.Rel(t.opts.targetDir, entry.path)
+		if err != nil {
+			relPath = entry.path
+		}
+		line := fmt.Sprintf("%s %s -> %s", mark, relPath, entry.target)
+		if entry.broken {
+			line += " (broken)"
+		}
+		if entry.status != "" {
+			line += "  [" + entry.status + "]"
+		}
+		line = t.fit(line)
+
+		switch {
+		case i == t.cursor:
+			line = "\033[7m" + line + resetColor
+		case strings.HasPrefix(entry.status, "error"), entry.broken:
+			line = redColor + line + resetColor
+		case entry.status != "" && entry.status != "skipped":
+			line = greenColor + line + resetColor
+		}
+		b.WriteString(line + "\r\n")
+	}
+	fmt.Printf("%s\033[%d;1H%s%s%s", b.String(), t.rows, cmdColor, t.fit(t.message), resetColor)
+}
+
+// Truncate a line to the terminal width
+func (t *tui) fit(line string) string {
+	if t.cols > 0 && len(line) > t.cols {
+		return line[:t.cols]
+	}
+	return line
+}
+
+// Read a single key press from the terminal (in raw mode)
+func readKey() (string, error) {
+	buf := make([]byte, 8)
+	n, err := os.Stdin.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	switch seq := string(buf[:n]); seq {
+	case "\033[A":
+		return "up", nil
+	case "\033[B":
+		return "down", nil
+	case "\033[5~":
+		return "pgup", nil
+	case "\033[6~":
+		return "pgdown", nil
+	case "\r", "\n":
+		return "enter", nil
+	case "\033":
+		return "esc", nil
+	case "\003":
+		return "ctrl-c", nil
+	default:
+		return seq, nil
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+// Version information (-version)
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Build and platform information of the binary, printed by the version subcommand
+type versionInfo struct {
+	Version   string          `json:"version"`
+	Commit    string          `json:"commit"`
+	BuildDate string          `json:"build_date"`
+	GoVersion string          `json:"go_version"`
+	Platform  string          `json:"platform"`
+	Features  map[string]bool `json:"features"` // Supported by the binary (landlock: also by the running kernel)
+}
+
+// Collect the build information: commit and build date from -ldflags, or else from the version control
+// information recorded by the Go toolchain (when built in a git checkout)
+func buildInfo() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	linux := runtime.GOOS == "linux"
+	info.Features = map[string]bool{
+		"reflink":         linux, // FICLONE, with -copy-cache and -dedup-store
+		"copy_file_range": linux,
+		"sparse":          sparseSeek, // SEEK_DATA/SEEK_HOLE, with -preserve sparse
+		"xattr":           linux,
+		"acl":             linux, // Copied as the system.posix_acl_* extended attributes
+		"landlock":        landlockABI() > 0,
+		"unveil":          runtime.GOOS == "openbsd", // pledge and unveil, for -sandbox
+	}
+	return info
+}
+
+// Print the version of symlink2file with its build information, as text or as JSON with --json
+func printVersion(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the information as a JSON object")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errors.New("usage: symlink2file version [--json]")
+	}
+	info := buildInfo()
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+	fmt.Printf("symlink2file %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("  Commit:     %s\n", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Printf("  Built:      %s\n", info.BuildDate)
+	}
+	fmt.Printf("  Go:         %s (%s)\n", info.GoVersion, info.Platform)
+	features := make([]string, 0, len(info.Features))
+	for feature, enabled := range info.Features {
+		if enabled {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	fmt.Printf("  Features:   %s\n", strings.Join(features, ", "))
+	return nil
+}
@@ -0,0 +1,521 @@
+package main
+
+// Walking the directory trees and dispatching the symlinks to the workers (-jobs, -order, -files-from)
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Process the symlinks in the given directory
+func processSymlinks(opts *options, processedSymlinks map[string]bool) error {
+	return walkOrdered(opts, opts.jobs, func(path string, opts *options) error {
+		err := processPath(path, opts, processedSymlinks)
+		if errors.Is(err, errQuit) {
+			return filepath.SkipAll
+		}
+		return err
+	})
+}
+
+// Symlink found by a scan, with the options effective in its directory
+type scannedLink struct {
+	path string
+	opts *options
+	size int64 // Size of the target, for the orders by size (0 if the symlink is broken)
+}
+
+// Record a symlink found by a scan, with the size of its target if the order needs it
+func scanLink(path string, opts *options) scannedLink {
+	link := scannedLink{path: path, opts: opts}
+	if opts.order == "largest-first" || opts.order == "smallest-first" {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			link.size = info.Size()
+		}
+	}
+	return link
+}
+
+// Number of symlinks found by the scan and waiting for fn: the scan pauses while the queue is full,
+// so that the memory used stays the same however large the tree is
+const scanQueueSize = 1000
+
+// Call fn for every symlink of the target directory (see walkSymlinks) in the order of -order:
+// as they are found, or once the whole tree is scanned, sorted (on several workers if jobs > 1, see processParallel)
+func walkOrdered(opts *options, jobs int, fn func(path string, opts *options) error) error {
+	return runPipeline(opts, displayPath(opts.targetDir), jobs, func(send func(link scannedLink) bool) error {
+		return walkSymlinks(opts, func(path string, opts *options) error {
+			if !send(scannedLink{path: path, opts: opts}) {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+	}, fn)
+}
+
+// Run a scan in its own goroutine, passing the symlinks it sends to fn through a bounded queue, so that they are
+// processed while the scan goes on (with -order walk), or once it is over and they are sorted (with the other orders)
+// The scan stops when send returns false: fn failed, or returned filepath.SkipAll
+// With jobs > 1, fn is called by several workers (see processParallel)
+// With -verbose, the time spent by each stage and waiting for the other one is printed at the end
+func runPipeline(opts *options, name string, jobs int, scan func(send func(link scannedLink) bool) error,
+	fn func(path string, opts *options) error) error {
+	queue := make(chan scannedLink, scanQueueSize)
+	stop := make(chan struct{})
+	scanErr := make(chan error, 1)
+	var scanTime, scanBlocked time.Duration
+	start := time.Now()
+	go func() {
+		defer close(queue)
+		feed := func(link scannedLink) bool {
+			select {
+			case queue <- link:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+		if opts.order == "walk" {
+			err := scan(func(link scannedLink) bool {
+				select {
+				case queue <- link:
+					return true
+				default: // Full queue: the scan waits for fn
+				}
+				blocked := time.Now()
+				defer func() { scanBlocked += time.Since(blocked) }()
+				return feed(link)
+			})
+			scanTime = time.Since(start)
+			scanErr <- err
+			return
+		}
+		var links []scannedLink
+		err := scan(func(link scannedLink) bool {
+			links = append(links, scanLink(link.path, link.opts))
+			return true
+		})
+		sortLinks(links, opts.order)
+		scanTime = time.Since(start)
+		for _, link := range links {
+			if err != nil || !feed(link) {
+				break
+			}
+		}
+		scanErr <- err
+	}()
+
+	var idle time.Duration
+	var count int
+	var err error
+	if jobs > 1 {
+		count, idle, err = processParallel(opts, jobs, queue, fn)
+	} else {
+		err = func() error {
+			for {
+				waiting := time.Now()
+				link, ok := <-queue
+				idle += time.Since(waiting)
+				if !ok {
+					return nil
+				}
+				count++
+				if err := fn(link.path, link.opts); errors.Is(err, filepath.SkipAll) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}()
+	}
+	// An error or a quit stops the scan; the symlinks still queued are dropped
+	close(stop)
+	for range queue {
+	}
+	if walkErr := <-scanErr; err == nil {
+		err = walkErr
+	}
+	if opts.verbose {
+		fmt.Fprintf(output, "Stages of %s: scan %s (%s waiting for the processing), processing %s (%s waiting for the scan), %d symlinks\n",
+			name, scanTime.Round(time.Millisecond), scanBlocked.Round(time.Millisecond),
+			(time.Since(start) - idle).Round(time.Millisecond), idle.Round(time.Millisecond), count)
+	}
+	return err
+}
+
+// Call fn for the queued symlinks on several workers, with at most -per-dir-limit of them in progress in the same
+// directory: the symlinks of a directory at its limit wait (up to scanQueueSize of them) while those of other
+// directories are handed out. Only the copies of data run in parallel; the rest of each call of fn holds
+// opts.stats.work (see releaseWork), as the state of the run and the output are shared
+// Returns the number of symlinks processed and the time spent with no worker busy, waiting for the scan
+func processParallel(opts *options, jobs int, queue <-chan scannedLink,
+	fn func(path string, opts *options) error) (int, time.Duration, error) {
+	type result struct {
+		dir string
+		err error
+	}
+	work := make(chan scannedLink)
+	done := make(chan result)
+	opts.stats.work = &sync.Mutex{}
+	defer func() { opts.stats.work = nil }()
+	var workers sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for link := range work {
+				opts.stats.work.Lock()
+				err := fn(link.path, link.opts)
+				opts.stats.work.Unlock()
+				done <- result{filepath.Dir(link.path), err}
+			}
+		}()
+	}
+
+	var ready []scannedLink                   // Symlinks that can be handed out to a worker
+	waiting := make(map[string][]scannedLink) // Symlinks of directories at their limit
+	inFlight := make(map[string]int)          // Symlinks of each directory that are ready or in progress
+	held, busy, count := 0, 0, 0
+	var idle time.Duration
+	var err error
+	stopped := false // fn failed or returned filepath.SkipAll: the symlinks not handed out yet are dropped
+	input := queue
+	for {
+		in := input
+		if stopped || len(ready)+held >= scanQueueSize {
+			in = nil
+		}
+		var out chan scannedLink
+		var next scannedLink
+		if !stopped && len(ready) > 0 {
+			out, next = work, ready[0]
+		}
+		if in == nil && out == nil && busy == 0 {
+			break
+		}
+		waitStart := time.Now()
+		select {
+		case link, ok := <-in:
+			if busy == 0 {
+				idle += time.Since(waitStart)
+			}
+			if !ok {
+				input = nil
+				continue
+			}
+			count++
+			dir := filepath.Dir(link.path)
+			if opts.perDirLimit > 0 && inFlight[dir] >= opts.perDirLimit {
+				waiting[dir] = append(waiting[dir], link)
+				held++
+				continue
+			}
+			inFlight[dir]++
+			ready = append(ready, link)
+		case out <- next:
+			ready = ready[1:]
+			busy++
+		case finished := <-done:
+			busy--
+			if finished.err != nil {
+				if !stopped && !errors.Is(finished.err, filepath.SkipAll) {
+					err = finished.err
+				}
+				stopped = true
+			}
+			inFlight[finished.dir]--
+			if links := waiting[finished.dir]; len(links) > 0 {
+				inFlight[finished.dir]++
+				ready = append(ready, links[0])
+				held--
+				if waiting[finished.dir] = links[1:]; len(links) == 1 {
+					delete(waiting, finished.dir)
+				}
+			} else if inFlight[finished.dir] == 0 {
+				delete(inFlight, finished.dir)
+			}
+		}
+	}
+	close(work)
+	workers.Wait()
+	return count, idle, err
+}
+
+// Sort scanned symlinks by path (byte-wise, so independent of the locale), or by the size of their targets
+// (symlinks with targets of the same size stay sorted by path)
+func sortLinks(links []scannedLink, order string) {
+	sort.Slice(links, func(i, j int) bool {
+		switch {
+		case order == "largest-first" && links[i].size != links[j].size:
+			return links[i].size > links[j].size
+		case order == "smallest-first" && links[i].size != links[j].size:
+			return links[i].size < links[j].size
+		}
+		return links[i].path < links[j].path
+	})
+}
+
+// Process the symlinks listed in the --files-from file (one per line, or NUL-separated with -0)
+// Listed paths that are not symlinks are reported and skipped
+func processFileList(opts *options, processedSymlinks map[string]bool) error {
+	input := os.Stdin
+	if opts.filesFrom != "-" {
+		file, err := os.Open(opts.filesFrom)
+		if err != nil {
+			return fmt.Errorf("error opening file list: %w", err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	opts.targetDir = workDir
+
+	separator := byte('\n')
+	if opts.nullData {
+		separator = 0
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if index := bytes.IndexByte(data, separator); index >= 0 {
+			return index + 1, data[:index], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	return runPipeline(opts, "the file list", opts.jobs, func(send func(link scannedLink) bool) error {
+		for scanner.Scan() {
+			path := scanner.Text()
+			if !opts.nullData {
+				path = strings.TrimRight(path, "\r")
+			}
+			if path == "" {
+				continue
+			}
+			path, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("error resolving path: %w", err)
+			}
+
+			info, err := os.Lstat(path)
+			if err != nil {
+				return fmt.Errorf("error accessing path %q: %w", path, err)
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				fmt.Fprintln(output, "Not a symlink, skipping:", displayPath(path))
+				recordAction(opts, "skipped", path, "", 0)
+				continue
+			}
+			if !send(scannedLink{path: path, opts: opts}) {
+				return nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading file list: %w", err)
+		}
+		return nil
+	}, func(path string, opts *options) error {
+		err := processPath(path, opts, processedSymlinks)
+		if errors.Is(err, errQuit) {
+			return filepath.SkipAll
+		}
+		return err
+	})
+}
+
+// Walk the target directory and call fn for every symlink found, together with the options effective in its directory
+// The backup directories are skipped, as well as subdirectories if recursion is disabled.
+// Config files found on the way override the options for their subtree
+func walkSymlinks(opts *options, fn func(path string, opts *options) error) error {
+	targetDir := opts.targetDir
+	dirOptions := map[string]*options{filepath.Dir(targetDir): opts}
+	var ignore *dockerIgnore
+	if opts.dockerContext {
+		var err error
+		if ignore, err = loadDockerIgnore(targetDir); err != nil {
+			return err
+		}
+	}
+	if _, ok := opts.stats.overlays[targetDir]; !ok {
+		opts.stats.overlays[targetDir] = findOverlay(targetDir)
+		if mount := opts.stats.overlays[targetDir]; mount != nil {
+			coloredPrintf(redColor, "Warning: %s is on overlayfs; converted files are written to the upper layer "+
+				"(copies of files from the lower layers take additional space)\n", targetDir)
+		}
+	}
+	walkFunc := func(path string, info os.DirEntry, err error) error {
+		// Unreadable subdirectories are recorded and the rest of the tree is processed
+		if (errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.ENAMETOOLONG)) && path != targetDir {
+			recordInaccessible(opts, path, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error accessing path %q: %w", path, err)
+		}
+		if opts.verbose && info.IsDir() && overlayOpaque(path) {
+			fmt.Fprintln(output, "Opaque overlayfs directory (hides the lower layers):", displayPath(path))
+		}
+
+		// Paths excluded by the filter rules are left alone; excluded directories are not walked
+		if len(opts.filters) > 0 && path != targetDir {
+			relPath, _ := filepath.Rel(targetDir, path)
+			if filterExcludes(opts.filters, relPath, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				if info.Type()&os.ModeSymlink != 0 {
+					fmt.Fprintln(output, "Excluded by filter, skipping:", displayPath(path))
+					recordAction(opts, "skipped", path, "", 0)
+				}
+				return nil
+			}
+		}
+
+		// Paths excluded from the Docker build context are not sent to the daemon, so they are left alone
+		if ignore != nil && path != targetDir {
+			relPath, _ := filepath.Rel(targetDir, path)
+			if ignore.matches(relPath) {
+				if info.IsDir() && !ignore.hasExceptions() {
+					return filepath.SkipDir
+				}
+				if info.Type()&os.ModeSymlink != 0 {
+					fmt.Fprintln(output, "Ignored by .dockerignore, skipping:", displayPath(path))
+					recordAction(opts, "skipped", path, "", 0)
+					return nil
+				}
+			}
+		}
+
+		// Skip .symlink2file directory and handle no-recurse logic
+		if info.IsDir() && (info.Name() == ".symlink2file" || (opts.noRecurse && path != targetDir)) {
+			return filepath.SkipDir
+		}
+		// Snakemake keeps its metadata, environments and shadow directories in .snakemake
+		if opts.preset == "snakemake" && info.IsDir() && info.Name() == ".snakemake" {
+			return filepath.SkipDir
+		}
+
+		// Options of a directory are inherited from the parent and merged with the local config file
+		if info.IsDir() {
+			parentOpts := dirOptions[filepath.Dir(path)]
+			if parentOpts == nil {
+				parentOpts = opts
+			}
+			localOpts, err := loadDirConfig(path, parentOpts)
+			if errors.Is(err, fs.ErrPermission) && path != targetDir {
+				recordInaccessible(opts, path, err)
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if localOpts.skip {
+				return filepath.SkipDir
+			}
+			dirOptions[path] = localOpts
+			return nil
+		}
+
+		// Process only symlinks
+		if info.Type()&os.ModeSymlink != 0 {
+			localOpts := dirOptions[filepath.Dir(path)]
+			for _, pattern := range localOpts.exclude {
+				if ok, _ := filepath.Match(pattern, info.Name()); ok {
+					fmt.Fprintln(output, "Excluded by config, skipping:", displayPath(path))
+					recordAction(localOpts, "skipped", path, "", 0)
+					return nil
+				}
+			}
+			return fn(path, localOpts)
+		}
+
+		return nil
+	}
+
+	return walkTree(targetDir, walkFunc)
+}
+
+// Walk a directory tree like filepath.WalkDir (in lexical order, with the same use of fn's errors), but open each
+// directory relative to its parent, so that trees deeper than PATH_MAX are walked too (the kernel refuses longer paths)
+func walkTree(root string, fn fs.WalkDirFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkTreeEntry(nil, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// Call fn for an entry and, for a directory, for everything below it (parent is nil for the root)
+func walkTreeEntry(parent *dirHandle, path string, entry fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, entry, nil); err != nil || !entry.IsDir() {
+		if err == filepath.SkipDir && entry.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	var dir *dirHandle
+	var err error
+	if parent == nil {
+		dir, err = openDirHandle(path)
+	} else {
+		dir, err = parent.openDir(entry.Name())
+	}
+	var entries []fs.DirEntry
+	if err == nil {
+		defer dir.Close()
+		entries, err = dir.readDir()
+	}
+	if err != nil {
+		// As with filepath.WalkDir, fn is called a second time with the error
+		if err = fn(path, entry, err); err != nil {
+			if err == filepath.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range entries {
+		if err := walkTreeEntry(dir, filepath.Join(path, child.Name()), child, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Let the other workers (-jobs) run while a conversion copies data or waits for the disk, which must not touch
+// the shared state of the run meanwhile; the returned function takes the lock back
+func releaseWork(opts *options) func() {
+	work := opts.stats.work
+	if work == nil {
+		return func() {}
+	}
+	work.Unlock()
+	return work.Lock
+}